@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/calmh/imapchive/db"
+	"github.com/calmh/imapchive/query"
+	"gopkg.in/yaml.v3"
+)
+
+// config is the contents of the configuration file.
+type config struct {
+	Accounts []*account `yaml:"accounts"`
+}
+
+// account is an IMAP account and how to archive it.
+type account struct {
+	Name     string `yaml:"name"`
+	Server   string `yaml:"server"` // host[:port], using TLS
+	Email    string `yaml:"email"`
+	Password string `yaml:"password"`
+
+	// Alternatives to keeping the password in the file: an environment
+	// variable, a file or a command giving the password. See
+	// resolvePassword.
+	PasswordEnv     string `yaml:"password_env"`
+	PasswordFile    string `yaml:"password_file"`
+	PasswordCommand string `yaml:"password_command"`
+
+	// Include and Exclude are patterns selecting the mailboxes to
+	// archive, where * matches any text and ? any single character. All
+	// mailboxes are included by default.
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+
+	Directory   string    `yaml:"directory"` // where the archives are kept
+	Concurrency int       `yaml:"concurrency"`
+	Retries     int       `yaml:"retries"`     // for failed messages and connections
+	BatchSize   string    `yaml:"batch_size"`  // bytes of messages per fetch command, such as "4M"
+	Pipeline    int       `yaml:"pipeline"`    // fetch commands in flight per connection
+	Compression string    `yaml:"compression"` // for new archives
+	TLS         tlsConfig `yaml:"tls"`
+
+	// MaxBandwidth, such as "2M", limits the bytes received per second,
+	// and MaxRequestsPerSecond the commands sent, over all connections.
+	MaxBandwidth         string  `yaml:"max_bandwidth"`
+	MaxRequestsPerSecond float64 `yaml:"max_requests_per_second"`
+
+	// GmailAllMail archives only Gmail's All Mail mailbox, which holds
+	// every message with its labels, instead of each label's mailbox.
+	// Include and Exclude are then ignored.
+	GmailAllMail bool `yaml:"gmail_all_mail"`
+
+	// Safe requires the server to open mailboxes read-only and disables
+	// all commands that could alter them.
+	Safe bool `yaml:"safe"`
+
+	batchBytes int64
+	limits     *limits
+	resolved   bool // the password has been resolved
+
+	// window restricts the messages fetched. If nil, the window recorded
+	// in the archive applies; a zero window fetches everything.
+	window *db.Window
+
+	// rescan searches the whole mailbox, instead of only above the
+	// highest UID scanned by earlier runs.
+	rescan bool
+}
+
+const (
+	defaultBatchSize = "1M"
+	defaultPipeline  = 4
+)
+
+type tlsConfig struct {
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	ServerName         string `yaml:"server_name"`
+	CAFile             string `yaml:"ca_file"` // PEM certificates to trust instead of the system roots
+}
+
+// defaultConfigFile returns the path of the configuration file used when
+// none is given.
+func defaultConfigFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "imapchive.yaml"
+	}
+	return filepath.Join(dir, "imapchive", "config.yaml")
+}
+
+// loadConfig reads and validates a configuration file, filling in
+// defaults. Passwords are resolved when an account is used.
+func loadConfig(file string) (*config, error) {
+	bs, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg config
+	dec := yaml.NewDecoder(bytes.NewReader(bs))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	if len(cfg.Accounts) == 0 {
+		return nil, fmt.Errorf("%s: no accounts configured", file)
+	}
+
+	seen := make(map[string]bool)
+	for i, acc := range cfg.Accounts {
+		if acc.Name == "" {
+			return nil, fmt.Errorf("%s: account %d has no name", file, i+1)
+		}
+		if seen[acc.Name] {
+			return nil, fmt.Errorf("%s: duplicate account %q", file, acc.Name)
+		}
+		seen[acc.Name] = true
+		if err := acc.prepare(); err != nil {
+			return nil, fmt.Errorf("%s: account %q: %w", file, acc.Name, err)
+		}
+	}
+	return &cfg, nil
+}
+
+func (acc *account) prepare() error {
+	if acc.Server == "" {
+		return errors.New("no server")
+	}
+	switch acc.Compression {
+	case "":
+		acc.Compression = "gzip"
+	case "gzip", "zstd":
+	default:
+		return fmt.Errorf("unknown compression %q", acc.Compression)
+	}
+	if acc.Concurrency <= 0 {
+		acc.Concurrency = 4
+	}
+	if acc.Retries <= 0 {
+		acc.Retries = 5
+	}
+	if acc.BatchSize == "" {
+		acc.BatchSize = defaultBatchSize
+	}
+	n, err := query.ParseSize(acc.BatchSize)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("invalid batch size %q", acc.BatchSize)
+	}
+	acc.batchBytes = n
+	if acc.Pipeline <= 0 {
+		acc.Pipeline = defaultPipeline
+	}
+	if err := acc.setLimits(); err != nil {
+		return err
+	}
+	if acc.Directory == "" {
+		acc.Directory = acc.Name
+	} else if rest, ok := strings.CutPrefix(acc.Directory, "~/"); ok {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		acc.Directory = filepath.Join(home, rest)
+	}
+	if rest, ok := strings.CutPrefix(acc.PasswordFile, "~/"); ok {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		acc.PasswordFile = filepath.Join(home, rest)
+	}
+	return nil
+}
+
+// selected returns the mailboxes that should be archived, of those given.
+func (acc *account) selected(mailboxes []string) []string {
+	var res []string
+	for _, mb := range mailboxes {
+		if (len(acc.Include) == 0 || matchAny(acc.Include, mb)) && !matchAny(acc.Exclude, mb) {
+			res = append(res, mb)
+		}
+	}
+	return res
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pat := range patterns {
+		if match(pat, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// match reports whether the name matches the pattern, where * matches any
+// text and ? any single character.
+func match(pat, name string) bool {
+	for pat != "" {
+		switch pat[0] {
+		case '*':
+			for i := len(name); i >= 0; i-- {
+				if match(pat[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if name == "" {
+				return false
+			}
+			_, n := utf8.DecodeRuneInString(name)
+			pat, name = pat[1:], name[n:]
+		default:
+			if name == "" || pat[0] != name[0] {
+				return false
+			}
+			pat, name = pat[1:], name[1:]
+		}
+	}
+	return name == ""
+}
+
+// tlsConfig returns the TLS configuration to connect with.
+func (acc *account) tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		InsecureSkipVerify: acc.TLS.InsecureSkipVerify,
+		ServerName:         acc.TLS.ServerName,
+	}
+	if acc.TLS.CAFile != "" {
+		pem, err := os.ReadFile(acc.TLS.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", acc.TLS.CAFile)
+		}
+	}
+	return cfg, nil
+}
+
+// account returns the named account, or nil.
+func (cfg *config) account(name string) *account {
+	for _, acc := range cfg.Accounts {
+		if acc.Name == name {
+			return acc
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pat, name string
+		want      bool
+	}{
+		{"INBOX", "INBOX", true},
+		{"INBOX", "inbox", false},
+		{"INBOX", "INBOX/Sub", false},
+		{"*", "", true},
+		{"*", "anything", true},
+		{"INBOX/*", "INBOX/Sub", true},
+		{"INBOX/*", "INBOX", false},
+		{"*/Trash", "[Gmail]/Trash", true},
+		{"*Sent*", "[Gmail]/Sent Mail", true},
+		{"a*b*c", "abxbc", true},
+		{"a*b*c", "acb", false},
+		{"?", "", false},
+		{"?", "x", true},
+		{"?", "ä", true},
+		{"?", "xy", false},
+		{"Arch?ve", "Archive", true},
+		{"", "", true},
+		{"", "x", false},
+	} {
+		if got := match(tc.pat, tc.name); got != tc.want {
+			t.Errorf("match(%q, %q) = %v, want %v", tc.pat, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSelected(t *testing.T) {
+	mailboxes := []string{"INBOX", "INBOX/Sub", "Sent", "[Gmail]/Spam", "[Gmail]/Trash", "Archive"}
+	for _, tc := range []struct {
+		include, exclude []string
+		want             []string
+	}{
+		{nil, nil, mailboxes},
+		{[]string{"INBOX*"}, nil, []string{"INBOX", "INBOX/Sub"}},
+		{nil, []string{"[Gmail]/*"}, []string{"INBOX", "INBOX/Sub", "Sent", "Archive"}},
+		{[]string{"INBOX*", "Sent"}, []string{"*/Sub"}, []string{"INBOX", "Sent"}},
+		{[]string{"Nothing"}, nil, nil},
+		{nil, []string{"*"}, nil},
+	} {
+		acc := &account{Include: tc.include, Exclude: tc.exclude}
+		if got := acc.selected(mailboxes); !slices.Equal(got, tc.want) {
+			t.Errorf("include %q, exclude %q: selected %q, want %q", tc.include, tc.exclude, got, tc.want)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		config string
+		err    string // part of the error, if one is expected
+		check  func(t *testing.T, cfg *config)
+	}{
+		{
+			name: "defaults",
+			config: `accounts:
+  - name: work
+    server: imap.example.com
+`,
+			check: func(t *testing.T, cfg *config) {
+				acc := cfg.account("work")
+				if acc == nil {
+					t.Fatal("account not found")
+				}
+				if acc.Directory != "work" || acc.Compression != "gzip" || acc.Concurrency != 4 ||
+					acc.Retries != 5 || acc.Pipeline != defaultPipeline || acc.batchBytes != 1<<20 {
+					t.Errorf("defaults not filled in: %+v", acc)
+				}
+				if cfg.account("other") != nil {
+					t.Error("found an account that is not configured")
+				}
+			},
+		},
+		{
+			name: "settings",
+			config: `accounts:
+  - name: work
+    server: imap.example.com:993
+    directory: ~/mail/work
+    password_file: ~/.work-password
+    compression: zstd
+    concurrency: 2
+    retries: 1
+    batch_size: 4M
+    pipeline: 8
+    include: ["INBOX*"]
+    exclude: ["*/Trash"]
+  - name: home
+    server: imap.example.org
+`,
+			check: func(t *testing.T, cfg *config) {
+				acc := cfg.account("work")
+				if acc.Directory != filepath.Join(home, "mail/work") || acc.PasswordFile != filepath.Join(home, ".work-password") {
+					t.Errorf("paths not expanded: %q, %q", acc.Directory, acc.PasswordFile)
+				}
+				if acc.Compression != "zstd" || acc.Concurrency != 2 || acc.Retries != 1 ||
+					acc.Pipeline != 8 || acc.batchBytes != 4<<20 {
+					t.Errorf("settings not kept: %+v", acc)
+				}
+				if got := acc.selected([]string{"INBOX", "INBOX/Trash", "Sent"}); !slices.Equal(got, []string{"INBOX"}) {
+					t.Errorf("selected %q", got)
+				}
+				if cfg.account("home") == nil {
+					t.Error("second account not found")
+				}
+			},
+		},
+		{name: "no accounts", config: "accounts: []\n", err: "no accounts configured"},
+		{name: "unknown field", config: "accounts:\n  - name: a\n    server: s\n    passwd: x\n", err: "passwd"},
+		{name: "no name", config: "accounts:\n  - server: s\n", err: "account 1 has no name"},
+		{name: "duplicate", config: "accounts:\n  - name: a\n    server: s\n  - name: a\n    server: t\n", err: `duplicate account "a"`},
+		{name: "no server", config: "accounts:\n  - name: a\n", err: "no server"},
+		{name: "compression", config: "accounts:\n  - name: a\n    server: s\n    compression: lzma\n", err: `unknown compression "lzma"`},
+		{name: "batch size", config: "accounts:\n  - name: a\n    server: s\n    batch_size: lots\n", err: `invalid batch size "lots"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(file, []byte(tc.config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := loadConfig(file)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("error %v, want one containing %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.check(t, cfg)
+		})
+	}
+
+	if _, err := loadConfig(filepath.Join(t.TempDir(), "missing.yaml")); !os.IsNotExist(err) {
+		t.Errorf("missing file: %v", err)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// resolvePassword sets the account password from the configured source:
+// the password itself, an environment variable, a file or a command. If
+// none is configured, the password and possibly the user name are looked
+// up in the netrc file. The password is never logged or included in
+// errors. Once it has succeeded, resolving the account again does nothing.
+func (acc *account) resolvePassword() error {
+	if acc.resolved {
+		return nil
+	}
+	if err := acc.readPassword(); err != nil {
+		return err
+	}
+	acc.resolved = true
+	return nil
+}
+
+// readPassword sets the account password, as described for
+// resolvePassword.
+func (acc *account) readPassword() error {
+	var sources []string
+	for _, src := range []struct {
+		name string
+		set  bool
+	}{
+		{"password", acc.Password != ""},
+		{"password_env", acc.PasswordEnv != ""},
+		{"password_file", acc.PasswordFile != ""},
+		{"password_command", acc.PasswordCommand != ""},
+	} {
+		if src.set {
+			sources = append(sources, src.name)
+		}
+	}
+	if len(sources) > 1 {
+		return fmt.Errorf("more than one password source given (%s)", strings.Join(sources, ", "))
+	}
+
+	switch {
+	case acc.Password != "":
+		return nil
+
+	case acc.PasswordEnv != "":
+		acc.Password = os.Getenv(acc.PasswordEnv)
+		if acc.Password == "" {
+			return fmt.Errorf("environment variable %s is not set", acc.PasswordEnv)
+		}
+
+	case acc.PasswordFile != "":
+		pw, err := readPasswordFile(acc.PasswordFile)
+		if err != nil {
+			return err
+		}
+		acc.Password = pw
+
+	case acc.PasswordCommand != "":
+		pw, err := runPasswordCommand(acc.PasswordCommand)
+		if err != nil {
+			return err
+		}
+		acc.Password = pw
+
+	default:
+		file := netrcFile()
+		if file == "" {
+			return nil
+		}
+		login, pw, err := lookupNetrc(file, serverHost(acc.Server), acc.Email)
+		if err != nil {
+			return err
+		}
+		if acc.Email == "" {
+			acc.Email = login
+		}
+		acc.Password = pw
+	}
+	return nil
+}
+
+// readPasswordFile returns the first line of the file, warning if it is
+// readable by others.
+func readPasswordFile(file string) (string, error) {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return "", fmt.Errorf("password file: %w", err)
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm()&0o077 != 0 {
+		log.Printf("Warning: password file %s is accessible by other users", file)
+	}
+	bs, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("password file: %w", err)
+	}
+	pw := firstLine(bs)
+	if pw == "" {
+		return "", fmt.Errorf("password file %s is empty", file)
+	}
+	return pw, nil
+}
+
+// runPasswordCommand runs the command using the shell and returns the
+// first line of its output. The command's standard error is passed
+// through, so that it can prompt for a passphrase and report problems.
+func runPasswordCommand(command string) (string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("password command: %w", err)
+	}
+	pw := firstLine(out)
+	if pw == "" {
+		return "", errors.New("password command gave no output")
+	}
+	return pw, nil
+}
+
+func firstLine(bs []byte) string {
+	line, _, _ := bytes.Cut(bs, []byte("\n"))
+	return strings.TrimSuffix(string(line), "\r")
+}
+
+// serverHost returns the host part of a host[:port] server address.
+func serverHost(server string) string {
+	if host, _, err := net.SplitHostPort(server); err == nil {
+		return host
+	}
+	return server
+}
+
+// netrcFile returns the netrc file to use, given by $NETRC or in the home
+// directory, or the empty string if there is none.
+func netrcFile() string {
+	if file := os.Getenv("NETRC"); file != "" {
+		return file
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	file := filepath.Join(home, ".netrc")
+	if _, err := os.Stat(file); err != nil {
+		return ""
+	}
+	return file
+}
+
+// lookupNetrc returns the login and password for the host from a netrc
+// file. If login is given, only entries for that login, or without one,
+// match. The default entry is used when no machine matches.
+func lookupNetrc(file, host, login string) (string, string, error) {
+	bs, err := os.ReadFile(file)
+	if err != nil {
+		return "", "", fmt.Errorf("netrc: %w", err)
+	}
+
+	type entry struct {
+		machine, login, password string
+		isDefault                bool
+	}
+	var entries []*entry
+	var cur *entry
+
+	sc := bufio.NewScanner(bytes.NewReader(bs))
+	inMacro := false
+	for sc.Scan() {
+		line := sc.Text()
+		if inMacro {
+			// Macro definitions end at an empty line.
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			if strings.HasPrefix(fields[i], "#") {
+				break
+			}
+			value := func() string {
+				if i+1 < len(fields) {
+					i++
+					return fields[i]
+				}
+				return ""
+			}
+			switch fields[i] {
+			case "machine":
+				cur = &entry{machine: value()}
+				entries = append(entries, cur)
+			case "default":
+				cur = &entry{isDefault: true}
+				entries = append(entries, cur)
+			case "login":
+				if cur != nil {
+					cur.login = value()
+				}
+			case "password":
+				if cur != nil {
+					cur.password = value()
+				}
+			case "account":
+				value()
+			case "macdef":
+				value()
+				inMacro = true
+				i = len(fields)
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return "", "", fmt.Errorf("netrc: %w", err)
+	}
+
+	matches := func(e *entry) bool {
+		return login == "" || e.login == "" || e.login == login
+	}
+	for _, e := range entries {
+		if !e.isDefault && strings.EqualFold(e.machine, host) && matches(e) {
+			return e.login, e.password, nil
+		}
+	}
+	for _, e := range entries {
+		if e.isDefault && matches(e) {
+			return e.login, e.password, nil
+		}
+	}
+	return "", "", nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolvePasswordTwice(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "password")
+	if err := os.WriteFile(file, []byte("secret\nignored\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("IMAPCHIVE_TEST_PASSWORD", "from-env")
+
+	for _, acc := range []*account{
+		{Password: "secret"},
+		{PasswordEnv: "IMAPCHIVE_TEST_PASSWORD"},
+		{PasswordFile: file},
+		{PasswordCommand: "echo secret"},
+	} {
+		want := "secret"
+		if acc.PasswordEnv != "" {
+			want = "from-env"
+		}
+		for i := 0; i < 2; i++ {
+			if err := acc.resolvePassword(); err != nil {
+				t.Fatalf("%+v: resolving %d: %v", acc, i, err)
+			}
+			if acc.Password != want {
+				t.Errorf("%+v: resolving %d: password %q, want %q", acc, i, acc.Password, want)
+			}
+		}
+	}
+}
+
+func TestResolvePasswordSources(t *testing.T) {
+	acc := &account{Password: "secret", PasswordEnv: "HOME"}
+	if err := acc.resolvePassword(); err == nil {
+		t.Error("two password sources accepted")
+	}
+}
+
+func TestLookupNetrc(t *testing.T) {
+	const netrc = `# comment
+machine imap.example.com login alice password a1
+machine imap.example.com
+    login bob
+    password b2 # trailing comment
+
+macdef init
+machine imap.example.com login mallory password m3
+
+machine other.example.com password o4
+default login dave password d5
+`
+	file := filepath.Join(t.TempDir(), "netrc")
+	if err := os.WriteFile(file, []byte(netrc), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		host, login       string
+		wantLogin, wantPw string
+	}{
+		{"imap.example.com", "", "alice", "a1"},
+		{"IMAP.example.com", "", "alice", "a1"},
+		{"imap.example.com", "alice", "alice", "a1"},
+		{"imap.example.com", "bob", "bob", "b2"},
+		{"imap.example.com", "mallory", "", ""}, // inside a macro
+		{"imap.example.com", "dave", "dave", "d5"},
+		{"other.example.com", "anyone", "", "o4"},
+		{"unknown.example.com", "", "dave", "d5"},
+		{"unknown.example.com", "erin", "", ""},
+	}
+	for _, tc := range cases {
+		login, pw, err := lookupNetrc(file, tc.host, tc.login)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if login != tc.wantLogin || pw != tc.wantPw {
+			t.Errorf("lookupNetrc(%q, %q) = %q, %q, want %q, %q", tc.host, tc.login, login, pw, tc.wantLogin, tc.wantPw)
+		}
+	}
+
+	if _, _, err := lookupNetrc(filepath.Join(t.TempDir(), "missing"), "x", ""); err == nil {
+		t.Error("missing file accepted")
+	}
+}
+
+func TestServerHost(t *testing.T) {
+	cases := []struct{ server, host string }{
+		{"imap.example.com", "imap.example.com"},
+		{"imap.example.com:993", "imap.example.com"},
+		{"[::1]:993", "::1"},
+	}
+	for _, tc := range cases {
+		if got := serverHost(tc.server); got != tc.host {
+			t.Errorf("serverHost(%q) = %q, want %q", tc.server, got, tc.host)
+		}
+	}
+}
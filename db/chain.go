@@ -0,0 +1,243 @@
+package db
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Every record in the archive extends a hash chain: the chain value after
+// a record is the SHA256 of the chain value before it followed by the
+// record's stored bytes. Message records carry the chain value preceding
+// them, so that removing or replacing a record breaks the chain at the
+// next one. Checkpoints sign the chain value preceding them, proving the
+// integrity of everything up to that point.
+
+// checkpointInterval is the number of records between checkpoints.
+const checkpointInterval = 1000
+
+var checkpointContext = []byte("imapchive checkpoint")
+
+func chainNext(chain, payload []byte) []byte {
+	h := sha256.New()
+	h.Write(chain)
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+func initialChain() []byte {
+	return make([]byte, sha256.Size)
+}
+
+// writeChained writes a record and returns the new chain value.
+func writeChained(w io.Writer, chain, payload []byte) ([]byte, error) {
+	if err := writePayload(w, payload); err != nil {
+		return nil, err
+	}
+	return chainNext(chain, payload), nil
+}
+
+func checkpointMessage(chainHash []byte, t int64) []byte {
+	msg := append([]byte(nil), checkpointContext...)
+	msg = append(msg, chainHash...)
+	return binary.BigEndian.AppendUint64(msg, uint64(t))
+}
+
+// writeCheckpoint writes a checkpoint signing the given chain value and
+// returns the new chain value.
+func (db *DB) writeCheckpoint(w io.Writer, chain []byte) ([]byte, error) {
+	key := db.opts.SigningKey
+	now := time.Now().Unix()
+	bs, err := proto.Marshal(&Envelope{
+		Checkpoint: &Checkpoint{
+			ChainHash: chain,
+			Time:      now,
+			PublicKey: key.Public().(ed25519.PublicKey),
+			Signature: ed25519.Sign(key, checkpointMessage(chain, now)),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return writeChained(w, chain, bs)
+}
+
+// checkpoint appends a checkpoint to the archive, if signing is enabled
+// and there are records since the previous one.
+func (db *DB) checkpoint() error {
+	if !db.signing || db.unsigned == 0 {
+		return nil
+	}
+	if _, err := db.fd.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	chain, err := db.writeCheckpoint(db.fd, db.chain)
+	if err != nil {
+		return err
+	}
+	db.chain = chain
+	db.unsigned = 0
+	return nil
+}
+
+// ReadSigningKey reads an ed25519 private key seed, stored as for
+// ReadKeyFile.
+func ReadSigningKey(name string) (ed25519.PrivateKey, error) {
+	seed, err := ReadKeyFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// ReadPublicKey reads an ed25519 public key, stored as for ReadKeyFile.
+func ReadPublicKey(name string) (ed25519.PublicKey, error) {
+	key, err := ReadKeyFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// VerifyResult describes a verified archive.
+type VerifyResult struct {
+	Records        int       // message records read
+	Messages       int       // messages stored, whose hash was verified
+	Unchained      int       // records written before the hash chain was introduced
+	Checkpoints    int       // checkpoints with a valid signature
+	LastCheckpoint time.Time // time of the last checkpoint
+	Unsigned       int       // records following the last checkpoint
+
+	// EmbeddedKey is set when the checkpoints were verified only against
+	// the public key each of them carries, for lack of a given one. That
+	// shows the chain is intact, but not who signed it: anyone rewriting
+	// the archive can sign it again with a key of their own.
+	EmbeddedKey bool
+}
+
+// Verify reads the whole archive and checks the hash of every message.
+// With chain set, the hash chain and the signatures of all checkpoints
+// are verified as well. If publicKey is given, checkpoints must be signed
+// with it. The first problem found is returned as an error.
+func (db *DB) Verify(chain bool, publicKey ed25519.PublicKey) (VerifyResult, error) {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+
+	var res VerifyResult
+
+	size, err := db.fd.Seek(0, io.SeekEnd)
+	if err != nil {
+		return res, err
+	}
+	sr := io.NewSectionReader(db.fd, 0, size)
+	magic := make([]byte, len(fileMagic))
+	if _, err := io.ReadFull(sr, magic); err != nil || !bytes.Equal(magic, fileMagic) {
+		sr.Seek(0, io.SeekStart)
+	}
+
+	cur := initialChain()
+	chained := false
+	run := chunkRun{verify: true}
+	var buf []byte
+	for {
+		offs, _ := sr.Seek(0, io.SeekCurrent)
+		data, err := readPayload(sr, &buf)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return res, fmt.Errorf("read record at %d: %w", offs, err)
+		}
+		prev := cur
+		cur = chainNext(cur, data)
+
+		var env Envelope
+		if !bytes.HasPrefix(data, gzipMagic) && proto.Unmarshal(data, &env) == nil && env.Checkpoint != nil {
+			if !chain {
+				continue
+			}
+			cp := env.Checkpoint
+			if !bytes.Equal(cp.ChainHash, prev) {
+				return res, fmt.Errorf("checkpoint at %d: chain broken", offs)
+			}
+			if len(cp.PublicKey) != ed25519.PublicKeySize || !ed25519.Verify(cp.PublicKey, checkpointMessage(cp.ChainHash, cp.Time), cp.Signature) {
+				return res, fmt.Errorf("checkpoint at %d: invalid signature", offs)
+			}
+			if publicKey != nil && !publicKey.Equal(ed25519.PublicKey(cp.PublicKey)) {
+				return res, fmt.Errorf("checkpoint at %d: signed by unexpected key %x", offs, cp.PublicKey)
+			}
+			res.Checkpoints++
+			res.LastCheckpoint = time.Unix(cp.Time, 0)
+			res.Unsigned = 0
+			continue
+		}
+
+		rec, err := db.decodeRecord(data, db.ad(offs))
+		if err == errControlRecord {
+			continue
+		} else if err != nil {
+			return res, fmt.Errorf("decode record at %d: %w", offs, err)
+		}
+		res.Records++
+		res.Unsigned++
+
+		if chunked(rec) {
+			if err := run.add(rec, offs); err != nil {
+				return res, fmt.Errorf("record at %d: %w", offs, err)
+			}
+			if !rec.More {
+				res.Messages++
+			}
+		} else if len(rec.MessageHash) > 0 {
+			if hash := sha256.Sum256(rec.MessageData); !bytes.Equal(hash[:], rec.MessageHash) {
+				return res, fmt.Errorf("message %d at %d: hash mismatch", rec.MessageId, offs)
+			}
+			res.Messages++
+		}
+
+		if !chain {
+			continue
+		}
+		switch {
+		case len(rec.PrevHash) == 0 && chained:
+			return res, fmt.Errorf("message %d at %d: record outside hash chain", rec.MessageId, offs)
+		case len(rec.PrevHash) == 0:
+			res.Unchained++
+		case !bytes.Equal(rec.PrevHash, prev):
+			return res, fmt.Errorf("message %d at %d: chain broken", rec.MessageId, offs)
+		default:
+			chained = true
+		}
+	}
+
+	if chain && publicKey != nil && res.Checkpoints == 0 {
+		return res, errors.New("no signed checkpoints")
+	}
+	res.EmbeddedKey = res.Checkpoints > 0 && publicKey == nil
+	return res, nil
+}
+
+// GenerateSigningKey writes a new ed25519 private key seed, hex encoded,
+// to the named file and returns the corresponding public key.
+func GenerateSigningKey(name string) (ed25519.PublicKey, error) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(fd, "%x\n", priv.Seed()); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return pub, fd.Close()
+}
@@ -0,0 +1,268 @@
+package db
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// signedArchive returns the bytes of an archive signed with
+// testSigningKey, holding messages 1 to 3, a checkpoint, messages 4 to 6
+// and another checkpoint.
+func signedArchive(t *testing.T) []byte {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "test.imapchive")
+	d, err := Open(name, Options{SigningKey: testSigningKey(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := uint32(1); id <= 6; id++ {
+		if err := d.WriteMessage(id, []byte(fmt.Sprintf("Subject: %d\r\n\r\nbody\r\n", id)), nil, 0); err != nil {
+			t.Fatal(err)
+		}
+		if id == 3 || id == 6 {
+			if err := d.WriteClose(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	d.Close()
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// splitRecords returns the records of an archive following the magic
+// bytes: the header, the messages and the checkpoints.
+func splitRecords(t *testing.T, data []byte) [][]byte {
+	t.Helper()
+	r := bytes.NewReader(data[len(fileMagic):])
+	var recs [][]byte
+	var buf []byte
+	for {
+		bs, err := readPayload(r, &buf)
+		if err == io.EOF {
+			return recs
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, bytes.Clone(bs))
+	}
+}
+
+func joinRecords(t *testing.T, recs [][]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	buf.Write(fileMagic)
+	for _, bs := range recs {
+		if err := writePayload(&buf, bs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// checkpointAt returns the checkpoint record at index i.
+func checkpointAt(t *testing.T, recs [][]byte, i int) *Checkpoint {
+	t.Helper()
+	var env Envelope
+	if err := proto.Unmarshal(recs[i], &env); err != nil || env.Checkpoint == nil {
+		t.Fatalf("record %d is not a checkpoint: %v", i, err)
+	}
+	return env.Checkpoint
+}
+
+func marshalCheckpoint(t *testing.T, cp *Checkpoint) []byte {
+	t.Helper()
+	bs, err := proto.Marshal(&Envelope{Checkpoint: cp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bs
+}
+
+func TestVerifyTampered(t *testing.T) {
+	orig := signedArchive(t)
+	pub := testSigningKey(t).Public().(ed25519.PublicKey)
+	other := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{9}, ed25519.SeedSize))
+
+	// The records are the header, messages 1 to 3, a checkpoint,
+	// messages 4 to 6 and a checkpoint.
+	const msg2, msg3, cp1, msg5, cp2 = 2, 3, 4, 6, 8
+	if n := len(splitRecords(t, orig)); n != 9 {
+		t.Fatalf("%d records, want 9", n)
+	}
+
+	cases := []struct {
+		name   string
+		tamper func(recs [][]byte) [][]byte
+		err    string // with the public key, or "" if it verifies
+		anyKey string // without it
+		open   bool   // already found on opening
+	}{
+		{name: "untouched"},
+		{
+			name: "removed record",
+			tamper: func(recs [][]byte) [][]byte {
+				return append(recs[:msg5:msg5], recs[msg5+1:]...)
+			},
+			err:    "chain broken",
+			anyKey: "chain broken",
+		},
+		{
+			// Cutting the archive short leaves a valid chain; only the
+			// count of records tells.
+			name: "removed last records",
+			tamper: func(recs [][]byte) [][]byte {
+				return recs[:msg5]
+			},
+		},
+		{
+			name: "reordered records",
+			tamper: func(recs [][]byte) [][]byte {
+				recs[msg2], recs[msg3] = recs[msg3], recs[msg2]
+				return recs
+			},
+			err:    "chain broken",
+			anyKey: "chain broken",
+		},
+		{
+			name: "altered record",
+			tamper: func(recs [][]byte) [][]byte {
+				// A consistent record with other data, carrying the
+				// original chain value.
+				d := &DB{}
+				rec, err := d.decodeRecord(recs[msg2], nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rec.MessageData = []byte("Subject: forged\r\n\r\nbody\r\n")
+				hash := sha256.Sum256(rec.MessageData)
+				rec.MessageHash = hash[:]
+				if recs[msg2], err = d.encodeRecord(rec, nil); err != nil {
+					t.Fatal(err)
+				}
+				return recs
+			},
+			err:    "chain broken",
+			anyKey: "chain broken",
+		},
+		{
+			name: "altered data",
+			tamper: func(recs [][]byte) [][]byte {
+				recs[msg2][len(recs[msg2])-5] ^= 0xff
+				return recs
+			},
+			open: true,
+		},
+		{
+			name: "forged signature",
+			tamper: func(recs [][]byte) [][]byte {
+				cp := checkpointAt(t, recs, cp1)
+				cp.Signature[0] ^= 0xff
+				recs[cp1] = marshalCheckpoint(t, cp)
+				return recs
+			},
+			err:    "invalid signature",
+			anyKey: "invalid signature",
+		},
+		{
+			name: "signature of another time",
+			tamper: func(recs [][]byte) [][]byte {
+				cp := checkpointAt(t, recs, cp1)
+				cp.Time++
+				recs[cp1] = marshalCheckpoint(t, cp)
+				return recs
+			},
+			err:    "invalid signature",
+			anyKey: "invalid signature",
+		},
+		{
+			// Someone rewriting the archive signs it again with a key
+			// of their own; only the public key tells.
+			name: "signed by another key",
+			tamper: func(recs [][]byte) [][]byte {
+				cp := checkpointAt(t, recs, cp2)
+				cp.PublicKey = other.Public().(ed25519.PublicKey)
+				cp.Signature = ed25519.Sign(other, checkpointMessage(cp.ChainHash, cp.Time))
+				recs[cp2] = marshalCheckpoint(t, cp)
+				return recs
+			},
+			err: "signed by unexpected key",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			data := orig
+			if tc.tamper != nil {
+				data = joinRecords(t, tc.tamper(splitRecords(t, orig)))
+			}
+			name := writeFile(t, data)
+			d, err := Open(name, Options{ReadOnly: true})
+			if tc.open {
+				if err == nil {
+					d.Close()
+					t.Error("opened")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+
+			for _, key := range []ed25519.PublicKey{pub, nil} {
+				want := tc.err
+				if key == nil {
+					want = tc.anyKey
+				}
+				res, err := d.Verify(true, key)
+				switch {
+				case want == "" && err != nil:
+					t.Errorf("public key %v: %v", key != nil, err)
+				case want != "" && (err == nil || !strings.Contains(err.Error(), want)):
+					t.Errorf("public key %v: %v, want %q", key != nil, err, want)
+				case err == nil && res.EmbeddedKey != (key == nil):
+					t.Errorf("public key %v: embedded key %v", key != nil, res.EmbeddedKey)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyEmbeddedKey(t *testing.T) {
+	d, err := Open(writeFile(t, signedArchive(t)), Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	pub := testSigningKey(t).Public().(ed25519.PublicKey)
+	res, err := d.Verify(true, pub)
+	if err != nil || res.Checkpoints != 2 || res.Messages != 6 || res.Unsigned != 0 || res.EmbeddedKey {
+		t.Errorf("with public key: %+v, %v", res, err)
+	}
+	res, err = d.Verify(true, nil)
+	if err != nil || res.Checkpoints != 2 || !res.EmbeddedKey {
+		t.Errorf("without public key: %+v, %v", res, err)
+	}
+	// Without checking the chain, no checkpoint is verified at all.
+	res, err = d.Verify(false, nil)
+	if err != nil || res.Checkpoints != 0 || res.EmbeddedKey {
+		t.Errorf("without chain: %+v, %v", res, err)
+	}
+
+	if _, err := d.Verify(true, ed25519.PublicKey(make([]byte, ed25519.PublicKeySize))); err == nil {
+		t.Error("verified with a different public key")
+	}
+}
@@ -0,0 +1,310 @@
+package db
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// chunkSize is the amount of message data per record when a message is
+// written as a stream. Smaller messages are written as a single record.
+const chunkSize = 1 << 20
+
+// chunked reports whether the record is part of a chunked message.
+func chunked(rec *MessageRecord) bool {
+	return rec.More || rec.Chunk > 0
+}
+
+// chunkRun follows the chunks of a message while the archive is read in
+// order. Chunks are written consecutively, so a chunk that does not
+// continue the current run is out of sequence; this happens when writing
+// a chunked message was interrupted.
+type chunkRun struct {
+	verify bool // check the hash of the message at the last chunk
+
+	msgid uint32
+	next  uint32 // number of the next chunk
+	start int64  // offset of the first chunk
+	size  int64  // message data so far
+	hash  hash.Hash
+}
+
+// add follows a chunk read at offs. At the last chunk the run is complete,
+// and the message starts at start.
+func (c *chunkRun) add(rec *MessageRecord, offs int64) error {
+	if rec.Chunk == 0 {
+		c.msgid, c.start, c.size = rec.MessageId, offs, 0
+		c.next = 0
+		if c.verify {
+			c.hash = sha256.New()
+		}
+	}
+	if rec.MessageId != c.msgid || rec.Chunk != c.next {
+		c.next = 0
+		return fmt.Errorf("message %d: chunk %d out of sequence", rec.MessageId, rec.Chunk)
+	}
+
+	c.next++
+	c.size += int64(len(rec.MessageData))
+	if c.verify {
+		c.hash.Write(rec.MessageData)
+	}
+	if rec.More {
+		return nil
+	}
+
+	c.next = 0
+	if c.verify && !bytes.Equal(c.hash.Sum(nil), rec.MessageHash) {
+		return fmt.Errorf("message %d: hash mismatch", rec.MessageId)
+	}
+	return nil
+}
+
+// readMessage reads the next message record from r like readRecord, but
+// joins the chunks of a chunked message into a single record.
+func (db *DB) readMessage(r io.ReadSeeker, buf *[]byte) (*MessageRecord, error) {
+	rec, err := db.readRecord(r, buf)
+	if err != nil || !chunked(rec) {
+		return rec, err
+	}
+
+	var run chunkRun
+	data := rec.MessageData
+	for {
+		if err := run.add(rec, 0); err != nil {
+			return nil, err
+		}
+		if !rec.More {
+			break
+		}
+		rec, err = db.readRecord(r, buf)
+		if err == io.EOF {
+			return nil, fmt.Errorf("message %d: %w", run.msgid, io.ErrUnexpectedEOF)
+		} else if err != nil {
+			return nil, err
+		}
+		data = append(data, rec.MessageData...)
+	}
+
+	rec.MessageData = data
+	rec.Chunk = 0
+	return rec, nil
+}
+
+// MessageReader returns a reader for the data of a live message. Chunked
+// messages are read a chunk at a time, and checked against their hash on
+// reaching the end, so that large messages need not be held in memory.
+func (db *DB) MessageReader(msgid uint32) (io.Reader, error) {
+	defer db.mut.Unlock()
+	db.mut.Lock()
+
+	offs, ok := db.offsets[msgid]
+	if !ok || offs < 0 {
+		return nil, fmt.Errorf("message %d: %w", msgid, os.ErrNotExist)
+	}
+	return db.readerAt(msgid, offs, true)
+}
+
+// MessageSize returns the size of the data of a live message. The chunks
+// of a chunked message are followed, counted and checked against the hash
+// of the message, but not joined, so that the message is never held in
+// memory.
+func (db *DB) MessageSize(msgid uint32) (int64, error) {
+	defer db.mut.Unlock()
+	db.mut.Lock()
+
+	offs, ok := db.offsets[msgid]
+	if !ok || offs < 0 {
+		return 0, fmt.Errorf("message %d: %w", msgid, os.ErrNotExist)
+	}
+	fi, err := db.fd.Stat()
+	if err != nil {
+		return 0, err
+	}
+	sr := io.NewSectionReader(db.fd, offs, fi.Size()-offs)
+
+	run := chunkRun{verify: true}
+	var buf []byte
+	for {
+		rec, err := db.readRecord(sr, &buf)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, fmt.Errorf("message %d: %w", msgid, err)
+		}
+		switch {
+		case !chunked(rec) && run.next == 0:
+			return int64(len(rec.MessageData)), nil
+		case !chunked(rec):
+			return 0, fmt.Errorf("message %d: %w", msgid, errIncomplete)
+		}
+		if err := run.add(rec, 0); err != nil {
+			return 0, err
+		}
+		if !rec.More {
+			return run.size, nil
+		}
+	}
+}
+
+// readerAt returns a reader for the data of the message at offs. If lock
+// is set, the reader locks the archive to read further chunks; otherwise
+// it must be used while the caller holds the lock.
+func (db *DB) readerAt(msgid uint32, offs int64, lock bool) (io.Reader, error) {
+	fi, err := db.fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	mr := &messageReader{
+		db:   db,
+		sr:   io.NewSectionReader(db.fd, offs, fi.Size()-offs),
+		run:  chunkRun{verify: true},
+		lock: lock,
+	}
+	rec, err := db.readRecord(mr.sr, &mr.buf)
+	if err != nil {
+		return nil, fmt.Errorf("message %d: %w", msgid, err)
+	}
+	if !chunked(rec) {
+		return bytes.NewReader(rec.MessageData), nil
+	}
+	if err := mr.add(rec); err != nil {
+		return nil, err
+	}
+	return mr, nil
+}
+
+// messageReader reads the chunks of a chunked message.
+type messageReader struct {
+	db   *DB
+	sr   *io.SectionReader
+	buf  []byte
+	run  chunkRun
+	data []byte // unread data of the current chunk
+	more bool   // further chunks follow
+	lock bool   // lock the archive to read further chunks
+	err  error
+}
+
+func (mr *messageReader) Read(p []byte) (int, error) {
+	for len(mr.data) == 0 {
+		if mr.err != nil {
+			return 0, mr.err
+		}
+		if !mr.more {
+			return 0, io.EOF
+		}
+		if mr.lock {
+			mr.db.mut.Lock()
+		}
+		rec, err := mr.db.readRecord(mr.sr, &mr.buf)
+		if mr.lock {
+			mr.db.mut.Unlock()
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			mr.err = fmt.Errorf("message %d: %w", mr.run.msgid, err)
+			continue
+		}
+		mr.err = mr.add(rec)
+	}
+
+	n := copy(p, mr.data)
+	mr.data = mr.data[n:]
+	return n, nil
+}
+
+func (mr *messageReader) add(rec *MessageRecord) error {
+	if !chunked(rec) {
+		return fmt.Errorf("message %d: %w", mr.run.msgid, errIncomplete)
+	}
+	if err := mr.run.add(rec, 0); err != nil {
+		return err
+	}
+	mr.data, mr.more = rec.MessageData, rec.More
+	return nil
+}
+
+var errIncomplete = errors.New("chunked message incomplete")
+
+// WriteMessageStream stores a message read from r, like WriteMessage. A
+// message larger than a chunk is stored as a run of chunk records, so
+// that it is never held in memory as a whole. The archive is locked
+// until r is exhausted, so r should not wait on the network. Archives
+// created before chunking hold each message in a single record; compact
+// or recompress them to enable chunking.
+func (db *DB) WriteMessageStream(msgid uint32, r io.Reader, labels []string, threadID uint64) error {
+	defer db.mut.Unlock()
+	db.mut.Lock()
+
+	if db.header == nil || db.header.Features&FeatureChunked == 0 {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return db.writeMessage(msgid, data, labels, threadID)
+	}
+
+	data := make([]byte, chunkSize)
+	n, err := io.ReadFull(r, data)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return db.writeMessage(msgid, data[:n], labels, threadID)
+	} else if err != nil {
+		return err
+	}
+
+	offs, err := db.fd.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	for chunk := uint32(0); ; chunk++ {
+		next := make([]byte, chunkSize)
+		n, err := io.ReadFull(r, next)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		hash.Write(data)
+		rec := &MessageRecord{
+			MessageId:   msgid,
+			MessageData: data,
+			Chunk:       chunk,
+			More:        n > 0,
+		}
+		if n == 0 {
+			rec.MessageHash = hash.Sum(nil)
+			rec.Labels = labels
+			rec.ThreadId = threadID
+		}
+		if err := db.writeRecord(rec); err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		data = next[:n]
+	}
+
+	// The message exists only once its last chunk is written.
+	db.offsets[msgid] = offs
+	db.labels[msgid] = labels
+	if db.search != nil {
+		// The message is read back from the archive to be indexed,
+		// a chunk at a time.
+		mr, err := db.readerAt(msgid, offs, false)
+		if err != nil {
+			return err
+		}
+		db.search.AddReader(msgid, mr)
+	}
+	return db.maybeWriteIndex()
+}
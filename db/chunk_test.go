@@ -0,0 +1,260 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+
+	"github.com/calmh/imapchive/fts"
+)
+
+// testData returns n bytes that do not repeat within a chunk.
+func testData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i*7 + i/251)
+	}
+	return data
+}
+
+// records returns the number of records in the archive, and how many of
+// them are chunks.
+func records(t *testing.T, d *DB) (n, chunks int) {
+	t.Helper()
+	if err := d.Rewind(); err != nil {
+		t.Fatal(err)
+	}
+	var buf []byte
+	for {
+		rec, err := d.readRecord(d.fd, &buf)
+		if err == io.EOF {
+			return n, chunks
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		n++
+		if chunked(rec) {
+			chunks++
+		}
+	}
+}
+
+func TestWriteMessageStream(t *testing.T) {
+	for _, tc := range []struct {
+		size   int
+		chunks int
+	}{
+		{0, 0},
+		{1, 0},
+		{chunkSize - 1, 0},
+		{chunkSize, 0},
+		{chunkSize + 1, 2},
+		{2 * chunkSize, 2},
+		{5*chunkSize/2 + 3, 3},
+	} {
+		name := filepath.Join(t.TempDir(), "test.imapchive")
+		d, err := Open(name, Options{Compression: Codec_ZSTD})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := testData(tc.size)
+		// A reader returning little at a time must make no difference.
+		if err := d.WriteMessageStream(1, iotest.HalfReader(bytes.NewReader(data)), []string{"L"}, 9); err != nil {
+			t.Fatal(err)
+		}
+		if n, chunks := records(t, d); n != max(tc.chunks, 1) || chunks != tc.chunks {
+			t.Errorf("%d bytes: %d records, %d chunks, want %d chunks", tc.size, n, chunks, tc.chunks)
+		}
+		if err := d.WriteClose(); err != nil {
+			t.Fatal(err)
+		}
+		d.Close()
+
+		// Read it back both with and without the index.
+		for _, reindex := range []bool{false, true} {
+			if reindex {
+				if err := os.Remove(name + ".idx"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			d, err := Open(name, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec, err := d.Message(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(rec.MessageData, data) || rec.ThreadId != 9 || len(rec.Labels) != 1 {
+				t.Errorf("%d bytes, reindex %v: Message returned %d bytes, thread %d, labels %v", tc.size, reindex, len(rec.MessageData), rec.ThreadId, rec.Labels)
+			}
+			r, err := d.MessageReader(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := iotest.TestReader(r, data); err != nil {
+				t.Errorf("%d bytes, reindex %v: MessageReader: %v", tc.size, reindex, err)
+			}
+			if size, err := d.MessageSize(1); err != nil || size != int64(tc.size) {
+				t.Errorf("%d bytes, reindex %v: MessageSize %d, %v", tc.size, reindex, size, err)
+			}
+			d.Close()
+		}
+	}
+}
+
+func TestInterruptedChunkedWrite(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.imapchive")
+	d, err := Open(name, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := testData(3 * chunkSize)
+	failing := io.MultiReader(bytes.NewReader(large[:5*chunkSize/2]), iotest.ErrReader(errors.New("connection lost")))
+	if err := d.WriteMessageStream(1, failing, nil, 0); err == nil {
+		t.Fatal("interrupted write succeeded")
+	}
+	if d.Have(1) {
+		t.Error("interrupted message exists")
+	}
+	if _, err := d.MessageSize(1); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("size of interrupted message: %v", err)
+	}
+	if _, chunks := records(t, d); chunks == 0 {
+		t.Fatal("no chunks written before the interruption")
+	}
+
+	// Later messages are unaffected, and the message can be written
+	// again.
+	if err := d.WriteMessage(2, []byte("Subject: small\r\n\r\n"), nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.WriteMessageStream(3, bytes.NewReader(large), nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.WriteClose(); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+	if err := os.Remove(name + ".idx"); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = Open(name, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if d.Have(1) || !d.Have(2) || !d.Have(3) {
+		t.Errorf("messages %v after reindexing, want [2 3]", d.MessageIDs())
+	}
+	if rec, err := d.Message(3); err != nil || !bytes.Equal(rec.MessageData, large) {
+		t.Errorf("message after an interrupted one: %v", err)
+	}
+	if _, err := d.Verify(true, nil); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+
+	if err := d.WriteMessageStream(1, bytes.NewReader(large), nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !d.Have(1) {
+		t.Error("message written again does not exist")
+	}
+
+	// Compaction drops the interrupted chunks.
+	if _, err := d.Compact(false); err != nil {
+		t.Fatal(err)
+	}
+	if n, chunks := records(t, d); n != 7 || chunks != 6 {
+		t.Errorf("%d records, %d chunks after compaction, want 7 and 6", n, chunks)
+	}
+}
+
+func TestChunkedHashMismatch(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.imapchive")
+	d, err := Open(name, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Write the chunks of a message whose hash does not match its data.
+	data := testData(2 * chunkSize)
+	offs, _ := d.fd.Seek(0, io.SeekEnd)
+	for i, rec := range []*MessageRecord{
+		{MessageId: 1, MessageData: data[:chunkSize], More: true},
+		{MessageId: 1, MessageData: data[chunkSize:], Chunk: 1, MessageHash: make([]byte, 32)},
+	} {
+		if err := d.writeRecord(rec); err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+	}
+	d.offsets[1] = offs
+
+	r, err := d.MessageReader(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err == nil {
+		t.Error("MessageReader read a message with the wrong hash")
+	}
+	if _, err := d.MessageSize(1); err == nil {
+		t.Error("MessageSize counted a message with the wrong hash")
+	}
+	if _, err := d.Verify(false, nil); err == nil {
+		t.Error("Verify accepted a message with the wrong hash")
+	}
+	if _, err := d.Compact(false); err == nil {
+		t.Error("Compact copied a message with the wrong hash")
+	}
+}
+
+func TestIndexWrittenDuringChunkedWrite(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.imapchive")
+	d, err := Open(name, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.SearchIndex(); err != nil {
+		t.Fatal(err)
+	}
+	// The index falls due in the middle of the chunked message.
+	for id := uint32(1); id < indexInterval-1; id++ {
+		if err := d.WriteMessage(id, []byte("Subject: small\r\n\r\nbody\r\n"), nil, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	large := largeMessage("needle")
+	if err := d.WriteMessageStream(indexInterval, bytes.NewReader(large), nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(name + ".idx"); err != nil {
+		t.Fatalf("index not written: %v", err)
+	}
+	// Interrupted without writing the index again.
+	d.Close()
+
+	d, err = Open(name, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if !d.Have(indexInterval) {
+		t.Fatal("chunked message missing after reopening")
+	}
+	if rec, err := d.Message(indexInterval); err != nil || !bytes.Equal(rec.MessageData, large) {
+		t.Errorf("chunked message: %v", err)
+	}
+	idx, err := d.SearchIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := idx.Search(fts.Phrase("needle")); len(got) != 1 || got[0] != indexInterval {
+		t.Errorf("search found %v", got)
+	}
+}
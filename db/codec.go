@@ -0,0 +1,224 @@
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/proto"
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// encode compresses, and if the archive is encrypted encrypts, data, with
+// ad as the associated data; see recordAD.
+// Unencrypted gzip output is written bare, as in archives predating the
+// envelope, so that such archives remain readable by older versions;
+// anything else is wrapped in an Envelope.
+func (db *DB) encode(data, ad []byte) ([]byte, error) {
+	env := &Envelope{
+		Codec: db.codec,
+	}
+
+	switch db.codec {
+	case Codec_GZIP:
+		env.Data = compress(data)
+		if db.aead == nil {
+			return env.Data, nil
+		}
+
+	case Codec_ZSTD:
+		if db.enc == nil {
+			var opts []zstd.EOption
+			if dict := db.dicts[db.dict]; dict != nil {
+				opts = append(opts, zstd.WithEncoderDict(dict))
+			}
+			enc, err := zstd.NewWriter(nil, opts...)
+			if err != nil {
+				return nil, err
+			}
+			db.enc = enc
+		}
+		env.DictionaryId = db.dict
+		env.Data = db.enc.EncodeAll(data, nil)
+
+	default:
+		return nil, fmt.Errorf("unsupported codec %v", db.codec)
+	}
+
+	if db.aead != nil {
+		var err error
+		env.Nonce, env.Data, err = seal(db.aead, env.Data, ad)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return proto.Marshal(env)
+}
+
+// decode reverses encode, for any codec. Envelopes that describe the
+// archive rather than hold data result in errControlRecord.
+func (db *DB) decode(data, ad []byte) ([]byte, error) {
+	if bytes.HasPrefix(data, gzipMagic) {
+		return decompress(data)
+	}
+
+	var env Envelope
+	if err := proto.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("decode envelope: %w", err)
+	}
+	if env.Dictionary != nil || env.Header != nil || env.Checkpoint != nil || env.Window != nil || env.Migration != nil {
+		return nil, errControlRecord
+	}
+
+	data, err := db.open(&env, ad)
+	if err != nil {
+		return nil, err
+	}
+
+	switch env.Codec {
+	case Codec_GZIP:
+		return decompress(data)
+
+	case Codec_ZSTD:
+		if env.DictionaryId != 0 && db.dicts[env.DictionaryId] == nil {
+			return nil, fmt.Errorf("unknown dictionary %d", env.DictionaryId)
+		}
+		if db.dec == nil {
+			if err := db.resetDecoder(); err != nil {
+				return nil, err
+			}
+		}
+		return db.dec.DecodeAll(data, nil)
+
+	default:
+		return nil, fmt.Errorf("unsupported codec %v", env.Codec)
+	}
+}
+
+// open returns the envelope data, decrypted if necessary.
+func (db *DB) open(env *Envelope, ad []byte) ([]byte, error) {
+	if env.Nonce == nil {
+		return env.Data, nil
+	}
+	if db.aead == nil {
+		return nil, ErrEncrypted
+	}
+	data, err := db.aead.Open(nil, env.Nonce, env.Data, ad)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt: %w", err)
+	}
+	return data, nil
+}
+
+// sealMessage encrypts the contents of a control record, with ad as the
+// associated data.
+func (db *DB) sealMessage(msg proto.Message, ad []byte) (nonce, data []byte, err error) {
+	bs, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return seal(db.aead, bs, ad)
+}
+
+// openMessage reverses sealMessage, reading the contents of the control
+// record into msg.
+func (db *DB) openMessage(env *Envelope, ad []byte, msg proto.Message) error {
+	bs, err := db.open(env, ad)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(bs, msg)
+}
+
+// errControlRecord is returned when decoding a record that describes the
+// archive itself rather than holding a message.
+var errControlRecord = errors.New("control record")
+
+// addDictionary makes a zstd dictionary available for decoding, and for
+// encoding subsequent records.
+func (db *DB) addDictionary(dict []byte) error {
+	info, err := zstd.InspectDictionary(dict)
+	if err != nil {
+		return fmt.Errorf("load dictionary: %w", err)
+	}
+	db.dicts[info.ID()] = dict
+	db.dict = info.ID()
+	db.enc = nil
+	return db.resetDecoder()
+}
+
+func (db *DB) resetDecoder() error {
+	if db.dec != nil {
+		db.dec.Close()
+	}
+	var dicts [][]byte
+	for _, dict := range db.dicts {
+		dicts = append(dicts, dict)
+	}
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderDicts(dicts...))
+	if err != nil {
+		return err
+	}
+	db.dec = dec
+	return nil
+}
+
+// maxSample is the amount of each sample message used to train a
+// dictionary.
+const maxSample = 8 << 10
+
+// TrainDictionary builds a zstd dictionary from sample messages.
+func TrainDictionary(samples [][]byte) ([]byte, error) {
+	const maxHistory = 64 << 10
+
+	var history []byte
+	contents := make([][]byte, 0, len(samples))
+	for _, s := range samples {
+		if len(s) > maxSample {
+			s = s[:maxSample]
+		}
+		contents = append(contents, s)
+		if len(history) < maxHistory {
+			history = append(history, s[:len(s)/4]...)
+		}
+	}
+	if len(history) > maxHistory {
+		history = history[:maxHistory]
+	}
+
+	// Dictionary IDs below 32768 are reserved for registered dictionaries.
+	var id [4]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+
+	return zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       binary.BigEndian.Uint32(id[:])%(1<<31-32768) + 32768,
+		Contents: contents,
+		History:  history,
+		Offsets:  [3]int{1, 4, 8},
+	})
+}
+
+func compress(data []byte) []byte {
+	buf := new(bytes.Buffer)
+	gw := gzip.NewWriter(buf)
+	gw.Write(data)
+	gw.Close()
+	return buf.Bytes()
+}
+
+func decompress(data []byte) ([]byte, error) {
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(gr)
+}
@@ -0,0 +1,281 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	cases := []struct {
+		name string
+		opts Options
+		bare bool // written as bare gzip, readable by old versions
+	}{
+		{name: "gzip", bare: true},
+		{name: "zstd", opts: Options{Compression: Codec_ZSTD}},
+		{name: "encrypted gzip", opts: Options{Key: testKey()}},
+		{name: "encrypted zstd", opts: Options{Key: testKey(), Compression: Codec_ZSTD}},
+	}
+	for _, tc := range cases {
+		d, err := Open(filepath.Join(t.TempDir(), "test.imapchive"), tc.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, data := range [][]byte{nil, []byte("x"), bytes.Repeat([]byte("Subject: hello\r\n"), 1000)} {
+			enc, err := d.encode(data, d.ad(123))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bare := bytes.HasPrefix(enc, gzipMagic); bare != tc.bare {
+				t.Errorf("%s: bare gzip %v, want %v", tc.name, bare, tc.bare)
+			}
+			dec, err := d.decode(enc, d.ad(123))
+			if err != nil {
+				t.Errorf("%s: decode: %v", tc.name, err)
+			} else if !bytes.Equal(dec, data) {
+				t.Errorf("%s: decoded %d bytes, want %d", tc.name, len(dec), len(data))
+			}
+		}
+		d.Close()
+	}
+}
+
+func TestDecodeAnyCodec(t *testing.T) {
+	open := func(opts Options) *DB {
+		d, err := Open(filepath.Join(t.TempDir(), "test.imapchive"), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { d.Close() })
+		return d
+	}
+	gz, zs := open(Options{}), open(Options{Compression: Codec_ZSTD})
+
+	// Records are decoded whatever codec the archive writes with.
+	data := []byte("Subject: hello\r\n\r\nworld\r\n")
+	for _, pair := range [][2]*DB{{gz, zs}, {zs, gz}} {
+		enc, err := pair[0].encode(data, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dec, err := pair[1].decode(enc, nil); err != nil || !bytes.Equal(dec, data) {
+			t.Errorf("decoding %v with %v: %q, %v", pair[0].codec, pair[1].codec, dec, err)
+		}
+	}
+
+	// Control records are told apart from messages.
+	for _, env := range []*Envelope{
+		{Window: &Window{MaxSize: 1}},
+		{Migration: &Migration{Destination: "x"}},
+		{Checkpoint: &Checkpoint{}},
+	} {
+		bs, err := proto.Marshal(env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := gz.decode(bs, nil); err != errControlRecord {
+			t.Errorf("decoding %v: %v, want %v", env, err, errControlRecord)
+		}
+	}
+
+	// Encrypted records need the key.
+	enc, err := open(Options{Key: testKey()}).encode(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gz.decode(enc, nil); !errors.Is(err, ErrEncrypted) {
+		t.Errorf("decoding encrypted record without key: %v", err)
+	}
+
+	if _, err := gz.decode([]byte{0xff, 0xff}, nil); err == nil {
+		t.Error("decoded garbage")
+	}
+}
+
+// sampleMessages returns n similar messages.
+func sampleMessages(n int) [][]byte {
+	var msgs [][]byte
+	for i := 0; i < n; i++ {
+		msgs = append(msgs, []byte(fmt.Sprintf("Received: from mail%d.example.com by mx.example.com\r\n"+
+			"From: sender%d@example.com\r\nTo: recipient@example.com\r\n"+
+			"Subject: Weekly report %d\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n"+
+			"Hello,\r\n\r\nthis is report number %d. %s\r\n", i%7, i%13, i, i, strings.Repeat("Nothing new. ", i%5))))
+	}
+	return msgs
+}
+
+func TestDictionary(t *testing.T) {
+	dict, err := TrainDictionary(sampleMessages(200))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := filepath.Join(t.TempDir(), "test.imapchive")
+	d, err := Open(name, Options{Compression: Codec_ZSTD})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if err := d.addDictionary(dict); err != nil {
+		t.Fatal(err)
+	}
+
+	data := sampleMessages(201)[200]
+	enc, err := d.encode(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec, err := d.decode(enc, nil); err != nil || !bytes.Equal(dec, data) {
+		t.Fatalf("decode with dictionary: %q, %v", dec, err)
+	}
+
+	other, err := Open(filepath.Join(t.TempDir(), "other.imapchive"), Options{Compression: Codec_ZSTD})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if _, err := other.decode(enc, nil); err == nil || !strings.Contains(err.Error(), "unknown dictionary") {
+		t.Errorf("decode without dictionary: %v", err)
+	}
+
+	if err := d.addDictionary([]byte("not a dictionary")); err == nil {
+		t.Error("invalid dictionary accepted")
+	}
+}
+
+func TestRecompress(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.imapchive")
+	d, err := Open(name, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := sampleMessages(50)
+	for i, m := range msgs {
+		if err := d.WriteMessage(uint32(i+1), m, []string{`\Inbox`}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	large := largeMessage("needle")
+	if err := d.WriteMessageStream(100, bytes.NewReader(large), nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetLabels(1, []string{`\Starred`}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DeleteMessage(2); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(step string, d *DB) {
+		t.Helper()
+		if n := len(d.MessageIDs()); n != len(msgs) {
+			t.Errorf("%s: %d messages, want %d", step, n, len(msgs))
+		}
+		for i, m := range msgs {
+			id := uint32(i + 1)
+			rec, err := d.Message(id)
+			if id == 2 {
+				if err == nil {
+					t.Errorf("%s: deleted message %d is back", step, id)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s: message %d: %v", step, id, err)
+			}
+			if !bytes.Equal(rec.MessageData, m) {
+				t.Errorf("%s: message %d differs", step, id)
+			}
+		}
+		if got := d.Labels(1); fmt.Sprint(got) != `[\Starred]` {
+			t.Errorf("%s: labels of 1: %v", step, got)
+		}
+		if rec, err := d.Message(100); err != nil || !bytes.Equal(rec.MessageData, large) {
+			t.Errorf("%s: chunked message: %v", step, err)
+		}
+		if _, err := d.Verify(true, nil); err != nil {
+			t.Errorf("%s: verify: %v", step, err)
+		}
+	}
+
+	if _, _, err := d.Recompress(Codec_GZIP, true); err == nil {
+		t.Error("gzip with a dictionary accepted")
+	}
+
+	for _, step := range []struct {
+		codec Codec
+		dict  bool
+	}{
+		{Codec_ZSTD, true},
+		{Codec_ZSTD, false},
+		{Codec_GZIP, false},
+	} {
+		desc := fmt.Sprintf("%v (dictionary %v)", step.codec, step.dict)
+		before, after, err := d.Recompress(step.codec, step.dict)
+		if err != nil {
+			t.Fatalf("%s: %v", desc, err)
+		}
+		if before <= 0 || after <= 0 {
+			t.Errorf("%s: sizes %d, %d", desc, before, after)
+		}
+		check(desc, d)
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Existing archives are read whatever codec is asked for.
+		d, err = Open(name, Options{Compression: Codec_GZIP})
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(desc+", reopened", d)
+	}
+	d.Close()
+}
+
+func TestSampleMessages(t *testing.T) {
+	d, err := Open(filepath.Join(t.TempDir(), "test.imapchive"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	for id, size := range []int{100, maxSample, 3 * maxSample, 20 * maxSample} {
+		if err := d.WriteMessage(uint32(id+1), testData(size), nil, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.WriteMessageStream(10, bytes.NewReader(testData(2*chunkSize)), nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	size, err := d.fd.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, n := range []int{2, 10} {
+		samples, err := d.sampleMessages(size, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := min(n, 4); len(samples) != want {
+			t.Errorf("%d samples, want %d", len(samples), want)
+		}
+		for _, s := range samples {
+			// Only the start of each message is kept, and nothing
+			// else of it.
+			if len(s) > maxSample || cap(s) > maxSample+64 {
+				t.Errorf("sample of %d bytes, capacity %d", len(s), cap(s))
+			}
+			if !bytes.Equal(s, testData(len(s))) {
+				t.Error("sample is not the start of a message")
+			}
+		}
+	}
+}
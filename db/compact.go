@@ -0,0 +1,145 @@
+package db
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// CompactResult describes the outcome of a compaction.
+type CompactResult struct {
+	Messages int   // live messages written
+	Deleted  int   // deletion records written
+	Before   int64 // archive size before compaction
+	After    int64 // archive size after compaction
+}
+
+// Compact rewrites the archive so that it contains only the latest state
+// of each live message, and deletion records if keepDeleted is set. The
+// new archive is verified before it atomically replaces the old one, after
+// which the index is regenerated.
+func (db *DB) Compact(keepDeleted bool) (CompactResult, error) {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+
+	var res CompactResult
+
+	size, err := db.fd.Seek(0, io.SeekEnd)
+	if err != nil {
+		return res, err
+	}
+
+	// Build the current state from the archive itself rather than the
+	// index, so that compaction also repairs a stale index.
+
+	offsets := make(map[uint32]int64)
+	labels := make(map[uint32][]string)
+	sr := io.NewSectionReader(db.fd, db.start, size-db.start)
+	var buf []byte
+	var run chunkRun
+	for {
+		offs, _ := sr.Seek(0, io.SeekCurrent)
+		offs += db.start
+		rec, err := db.readRecord(sr, &buf)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return res, fmt.Errorf("read record at %d: %w", offs, err)
+		}
+
+		if rec.Deleted {
+			offsets[rec.MessageId] = -1
+			delete(labels, rec.MessageId)
+			continue
+		}
+		if chunked(rec) {
+			if err := run.add(rec, offs); err != nil || rec.More {
+				continue
+			}
+			offs = run.start
+		}
+		if len(rec.MessageHash) > 0 {
+			offsets[rec.MessageId] = offs
+		}
+		labels[rec.MessageId] = rec.Labels
+	}
+
+	// Keep messages in archive order, with deletion records first.
+
+	msgids := make([]uint32, 0, len(offsets))
+	for msgid := range offsets {
+		msgids = append(msgids, msgid)
+	}
+	sort.Slice(msgids, func(a, b int) bool {
+		oa, ob := offsets[msgids[a]], offsets[msgids[b]]
+		if oa != ob {
+			return oa < ob
+		}
+		return msgids[a] < msgids[b]
+	})
+
+	res.Before, res.After, err = db.rewrite(func(emit func(*MessageRecord) error) error {
+		for _, msgid := range msgids {
+			offs := offsets[msgid]
+			if offs < 0 {
+				if !keepDeleted {
+					continue
+				}
+				if err := emit(&MessageRecord{MessageId: msgid, Deleted: true}); err != nil {
+					return err
+				}
+				res.Deleted++
+				continue
+			}
+
+			if err := db.copyMessage(msgid, io.NewSectionReader(db.fd, offs, size-offs), &buf, labels[msgid], emit); err != nil {
+				return err
+			}
+			res.Messages++
+		}
+		return nil
+	})
+	return res, err
+}
+
+// copyMessage emits the message read from r with the given labels,
+// checking its hash. The chunks of a chunked message are emitted one at a
+// time.
+func (db *DB) copyMessage(msgid uint32, r io.ReadSeeker, buf *[]byte, labels []string, emit func(*MessageRecord) error) error {
+	run := chunkRun{verify: true}
+	for {
+		rec, err := db.readRecord(r, buf)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return fmt.Errorf("read message %d: %w", msgid, err)
+		}
+
+		if !chunked(rec) {
+			if run.next > 0 {
+				return fmt.Errorf("message %d: %w", msgid, errIncomplete)
+			}
+			if hash := sha256.Sum256(rec.MessageData); !bytes.Equal(hash[:], rec.MessageHash) {
+				return fmt.Errorf("message %d: hash mismatch", msgid)
+			}
+			rec.Labels = labels
+			return emit(rec)
+		}
+
+		if err := run.add(rec, 0); err != nil {
+			return err
+		}
+		if !rec.More {
+			rec.Labels = labels
+		}
+		if err := emit(rec); err != nil {
+			return err
+		}
+		if !rec.More {
+			return nil
+		}
+	}
+}
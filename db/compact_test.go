@@ -0,0 +1,214 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestCompact(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		opts        Options
+		keepDeleted bool
+		staleIndex  bool // the index is removed before compacting
+	}{
+		{name: "plain"},
+		{name: "keep deleted", keepDeleted: true},
+		{name: "stale index", staleIndex: true},
+		{name: "encrypted", opts: Options{Key: testKey(), Compression: Codec_ZSTD}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "test.imapchive")
+			d, err := Open(name, tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msgs := sampleMessages(10)
+			for i, m := range msgs {
+				if err := d.WriteMessage(uint32(i+1), m, []string{`\Inbox`}, uint64(i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			large := largeMessage("needle")
+			if err := d.WriteMessageStream(100, bytes.NewReader(large), []string{"Large"}, 0); err != nil {
+				t.Fatal(err)
+			}
+			// Message 3 is rewritten, 4 and 5 relabelled twice, and 6 and
+			// 100 deleted; 7 is deleted and fetched again.
+			if err := d.WriteMessage(3, []byte("Subject: changed\r\n\r\n"), nil, 0); err != nil {
+				t.Fatal(err)
+			}
+			for _, labels := range [][]string{{"A"}, {"B", "C"}} {
+				for _, id := range []uint32{4, 5} {
+					if err := d.SetLabels(id, labels); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			for _, id := range []uint32{6, 100, 7} {
+				if err := d.DeleteMessage(id); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := d.WriteMessage(7, msgs[6], []string{"Again"}, 0); err != nil {
+				t.Fatal(err)
+			}
+			win := &Window{Since: 1546300800, MaxSize: 1 << 20}
+			if err := d.SetWindow(win); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.MarkAppending("dest", 1); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.MarkAppended("dest", 1); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.MarkAppending("dest", 2); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.SetScanState(&Scan{Highest: 500, Failed: []uint32{42}, UidValidity: 7}); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.WriteClose(); err != nil {
+				t.Fatal(err)
+			}
+			if tc.staleIndex {
+				if err := os.Remove(name + ".idx"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			d, err = Open(name, tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := d.Compact(tc.keepDeleted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantDeleted := 0
+			if tc.keepDeleted {
+				wantDeleted = 2
+			}
+			if res.Messages != 9 || res.Deleted != wantDeleted || res.After >= res.Before {
+				t.Errorf("result %+v", res)
+			}
+
+			check := func(step string, d *DB) {
+				t.Helper()
+				want := map[uint32]string{3: "[]", 4: "[B C]", 5: "[B C]", 7: "[Again]"}
+				for id := uint32(1); id <= 10; id++ {
+					if id == 6 {
+						if d.Have(id) {
+							t.Errorf("%s: deleted message %d is back", step, id)
+						}
+						continue
+					}
+					rec, err := d.Message(id)
+					if err != nil {
+						t.Fatalf("%s: message %d: %v", step, id, err)
+					}
+					data := msgs[id-1]
+					if id == 3 {
+						data = []byte("Subject: changed\r\n\r\n")
+					}
+					if !bytes.Equal(rec.MessageData, data) {
+						t.Errorf("%s: message %d differs", step, id)
+					}
+					labels, ok := want[id]
+					if !ok {
+						labels = `[\Inbox]`
+					}
+					if got := fmt.Sprint(d.Labels(id)); got != labels {
+						t.Errorf("%s: labels of %d: %s, want %s", step, id, got, labels)
+					}
+				}
+				if rec, err := d.Message(2); err != nil || rec.ThreadId != 1 {
+					t.Errorf("%s: thread of 2: %v", step, err)
+				}
+				if d.Have(100) {
+					t.Errorf("%s: deleted chunked message is back", step)
+				}
+				if n := len(d.MessageIDs()); n != 9 {
+					t.Errorf("%s: %d messages, want 9", step, n)
+				}
+				if w := d.Window(); !proto.Equal(w, win) {
+					t.Errorf("%s: window %v, want %v", step, w, win)
+				}
+				appended, appending := d.Migration("dest")
+				if fmt.Sprint(appended) != "map[1:true]" || fmt.Sprint(appending) != "map[2:true]" {
+					t.Errorf("%s: migration %v, %v", step, appended, appending)
+				}
+				if _, err := d.Verify(true, nil); err != nil {
+					t.Errorf("%s: verify: %v", step, err)
+				}
+			}
+			check("compacted", d)
+			// The scan state is kept only in the index.
+			if scan := d.ScanState(); (scan == nil) != tc.staleIndex || scan != nil && (scan.Highest != 500 || fmt.Sprint(scan.Failed) != "[42]" || scan.UidValidity != 7) {
+				t.Errorf("scan state %v", scan)
+			}
+			if err := d.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The archive reads the same without its index.
+			if err := os.Remove(name + ".idx"); err != nil {
+				t.Fatal(err)
+			}
+			d, err = Open(name, tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+			check("reindexed", d)
+		})
+	}
+}
+
+func TestCompactChunked(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.imapchive")
+	d, err := Open(name, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	large := largeMessage("needle")
+	if err := d.WriteMessageStream(1, bytes.NewReader(large), []string{"A"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetLabels(1, []string{"B"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Compact(false); err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := d.Message(1); err != nil || !bytes.Equal(rec.MessageData, large) {
+		t.Fatalf("chunked message after compaction: %v", err)
+	}
+	if got := fmt.Sprint(d.Labels(1)); got != "[B]" {
+		t.Errorf("labels %s, want [B]", got)
+	}
+
+	// Each chunk is a record of its own.
+	var chunks int
+	var buf []byte
+	d.Rewind()
+	for {
+		rec, err := d.readRecord(d.fd, &buf)
+		if err != nil {
+			break
+		}
+		if chunked(rec) {
+			chunks++
+		}
+	}
+	if want := len(large)/chunkSize + 1; chunks != want {
+		t.Errorf("%d chunks, want %d", chunks, want)
+	}
+}
@@ -0,0 +1,168 @@
+package db
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+var (
+	// ErrEncrypted is returned when opening an encrypted archive without
+	// a passphrase or key.
+	ErrEncrypted = errors.New("archive is encrypted; passphrase or key required")
+
+	// ErrNotEncrypted is returned when a passphrase or key is given for
+	// an existing archive that is not encrypted.
+	ErrNotEncrypted = errors.New("archive is not encrypted")
+
+	// ErrWrongKey is returned when the passphrase or key does not match
+	// the one the archive was encrypted with.
+	ErrWrongKey = errors.New("wrong passphrase or key")
+)
+
+// Key derivation parameters for new archives, following the
+// recommendations in RFC 9106.
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 << 10 // KiB
+	argon2Threads = 4
+	saltSize      = 16
+)
+
+var keyCheckPlaintext = []byte("imapchive")
+
+// newEncryption returns encryption parameters for a new archive, and the
+// cipher for the key given in opts.
+func newEncryption(opts Options) (*Encryption, cipher.AEAD, error) {
+	enc := &Encryption{
+		KeyDerivation: KeyDerivation_KEY_FILE,
+	}
+	if opts.Passphrase != "" {
+		salt := make([]byte, saltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, nil, err
+		}
+		enc = &Encryption{
+			KeyDerivation: KeyDerivation_ARGON2ID,
+			Salt:          salt,
+			Argon2Time:    argon2Time,
+			Argon2Memory:  argon2Memory,
+			Argon2Threads: argon2Threads,
+		}
+	}
+
+	aead, err := deriveKey(enc, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce, data, err := seal(aead, keyCheckPlaintext, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	enc.KeyCheck = append(nonce, data...)
+
+	return enc, aead, nil
+}
+
+// deriveKey returns the cipher for the key described by enc, using the
+// passphrase or key in opts.
+func deriveKey(enc *Encryption, opts Options) (cipher.AEAD, error) {
+	var key []byte
+	switch enc.KeyDerivation {
+	case KeyDerivation_ARGON2ID:
+		if opts.Passphrase == "" {
+			return nil, ErrEncrypted
+		}
+		key = argon2.IDKey([]byte(opts.Passphrase), enc.Salt, enc.Argon2Time, enc.Argon2Memory, uint8(enc.Argon2Threads), chacha20poly1305.KeySize)
+
+	case KeyDerivation_KEY_FILE:
+		if opts.Key == nil {
+			return nil, ErrEncrypted
+		}
+		key = opts.Key
+
+	default:
+		return nil, fmt.Errorf("unsupported key derivation %v", enc.KeyDerivation)
+	}
+
+	return chacha20poly1305.NewX(key)
+}
+
+// checkKey verifies that aead holds the key the archive was encrypted
+// with. New archives have no key check yet and always pass.
+func checkKey(aead cipher.AEAD, enc *Encryption) error {
+	if enc.KeyCheck == nil {
+		return nil
+	}
+	ns := aead.NonceSize()
+	if len(enc.KeyCheck) < ns {
+		return errors.New("key check truncated")
+	}
+	pt, err := aead.Open(nil, enc.KeyCheck[:ns], enc.KeyCheck[ns:], nil)
+	if err != nil || !bytes.Equal(pt, keyCheckPlaintext) {
+		return ErrWrongKey
+	}
+	return nil
+}
+
+// seal encrypts data under a fresh random nonce, authenticating the
+// associated data along with it.
+func seal(aead cipher.AEAD, data, ad []byte) (nonce, sealed []byte, err error) {
+	nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return nonce, aead.Seal(nil, nonce, data, ad), nil
+}
+
+// Positions of the records in the index files, which are bound to the
+// archive like the records in it.
+const (
+	indexPosition  = -1
+	searchPosition = -2
+)
+
+// recordAD returns the associated data binding a record sealed in the
+// archive with the given header to the archive and the record's
+// position, so that records cannot be moved within an archive or
+// between archives encrypted with the same key. Archives encrypted before
+// records were bound have none.
+func recordAD(hdr *Header, pos int64) []byte {
+	if hdr == nil || hdr.Features&FeatureBoundRecords == 0 {
+		return nil
+	}
+	ad := append([]byte(nil), hdr.Id...)
+	return binary.BigEndian.AppendUint64(ad, uint64(pos))
+}
+
+// ad returns the associated data of a record at pos in the archive.
+func (db *DB) ad(pos int64) []byte {
+	return recordAD(db.header, pos)
+}
+
+// ReadKeyFile reads a 256 bit key, stored either as raw bytes or in
+// hexadecimal.
+func ReadKeyFile(name string) ([]byte, error) {
+	bs, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(bs) == chacha20poly1305.KeySize {
+		return bs, nil
+	}
+
+	key, err := hex.DecodeString(string(bytes.TrimSpace(bs)))
+	if err != nil || len(key) != chacha20poly1305.KeySize {
+		return nil, fmt.Errorf("key file %s: expected %d raw or hex encoded bytes", name, chacha20poly1305.KeySize)
+	}
+	return key, nil
+}
@@ -0,0 +1,148 @@
+package db
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testKey() []byte {
+	return bytes.Repeat([]byte{0x42}, 32)
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	for _, opts := range []Options{
+		{Key: testKey()},
+		{Key: testKey(), Compression: Codec_ZSTD},
+		{Passphrase: "correct horse"},
+	} {
+		name := filepath.Join(t.TempDir(), "test.imapchive")
+		d, err := Open(name, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := []byte("Subject: secret\r\n\r\nHello\r\n")
+		if err := d.WriteMessage(1, msg, []string{`\Inbox`}, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.WriteClose(); err != nil {
+			t.Fatal(err)
+		}
+
+		d, err = Open(name, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec, err := d.Message(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rec.MessageData, msg) {
+			t.Errorf("%+v: read %q, expected %q", opts, rec.MessageData, msg)
+		}
+
+		if _, err := Open(name, Options{}); err != ErrEncrypted {
+			t.Errorf("%+v: opened without key: %v", opts, err)
+		}
+		wrong := opts
+		wrong.Key, wrong.Passphrase = nil, ""
+		if opts.Key != nil {
+			wrong.Key = bytes.Repeat([]byte{0x43}, 32)
+		} else {
+			wrong.Passphrase = "wrong"
+		}
+		if _, err := Open(name, wrong); err != ErrWrongKey {
+			t.Errorf("%+v: opened with wrong key: %v", opts, err)
+		}
+	}
+}
+
+func TestSealedRecordsAreBound(t *testing.T) {
+	open := func() *DB {
+		d, err := Open(filepath.Join(t.TempDir(), "test.imapchive"), Options{Key: testKey()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	a, b := open(), open()
+
+	data := []byte("record data")
+	sealed, err := a.encode(data, a.ad(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		db   *DB
+		pos  int64
+		ok   bool
+	}{
+		{"same position", a, 100, true},
+		{"other position", a, 200, false},
+		{"index", a, indexPosition, false},
+		{"other archive", b, 100, false},
+	}
+	for _, tc := range cases {
+		dec, err := tc.db.decode(sealed, tc.db.ad(tc.pos))
+		if tc.ok && (err != nil || !bytes.Equal(dec, data)) {
+			t.Errorf("%s: got %q, %v", tc.name, dec, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("%s: decoded a record sealed elsewhere", tc.name)
+		}
+	}
+}
+
+func TestIndexHash(t *testing.T) {
+	for _, opts := range []Options{{}, {Key: testKey()}} {
+		name := filepath.Join(t.TempDir(), "test.imapchive")
+		d, err := Open(name, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.WriteMessage(1, []byte("Subject: secret\r\n\r\n"), nil, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.WriteClose(); err != nil {
+			t.Fatal(err)
+		}
+
+		bs, err := os.ReadFile(name + ".idx")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dec, err := d.decode(bs[32:], d.ad(indexPosition))
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.Close()
+
+		// Encrypted indexes do not reveal a hash of their contents.
+		plain, sealed := sha256.Sum256(dec), sha256.Sum256(bs[32:])
+		want := plain
+		if opts.Key != nil {
+			want = sealed
+		}
+		if !bytes.Equal(bs[:32], want[:]) {
+			t.Errorf("encrypted %v: index hash is not of the expected data", opts.Key != nil)
+		}
+
+		// A damaged index is not used.
+		bs[len(bs)-1] ^= 1
+		if err := os.WriteFile(name+".idx", bs, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		d, err = Open(name, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !d.Have(1) {
+			t.Errorf("encrypted %v: message missing after reindexing", opts.Key != nil)
+		}
+		d.Close()
+	}
+}
@@ -4,16 +4,21 @@ package db
 
 import (
 	"bytes"
-	"compress/gzip"
+	"crypto/cipher"
+	"crypto/ed25519"
 	"crypto/sha256"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"sort"
 	"sync"
 
+	"github.com/calmh/imapchive/fts"
+	"github.com/klauspost/compress/zstd"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -23,20 +28,116 @@ type DB struct {
 	labels  map[uint32][]string
 	offsets map[uint32]int64
 	dirty   int
+	version uint64 // changes with the messages and labels
 	fd      *os.File
+	start   int64 // offset of the first record after the preamble
 	buf     []byte
+
+	opts   Options
+	header *Header
+	codec  Codec
+	dict   uint32
+	dicts  map[uint32][]byte
+	enc    *zstd.Encoder
+	dec    *zstd.Decoder
+	aead   cipher.AEAD
+
+	chain    []byte // hash chain value after the last record
+	signing  bool   // whether to write checkpoints
+	unsigned int    // records written since the last checkpoint
+
+	search *fts.Builder // messages to add to the full-text index, if any
+	window *Window      // the last window recorded, if any
+
+	migrations map[string]*migration // by destination
+	scanState  *Scan                 // kept in the index only
+}
+
+// Options control how records are written to an archive.
+type Options struct {
+	// Compression is the codec used when creating a new archive. Existing
+	// archives keep their codec until recompressed, and records are read
+	// regardless of their codec.
+	Compression Codec
+
+	// Passphrase or Key, if set, encrypts a new archive and is required
+	// to open an encrypted one. A passphrase is stretched into a key using
+	// Argon2id; a key must be 256 bits.
+	Passphrase string
+	Key        []byte
+
+	// Source describes where the messages in a new archive come from,
+	// and is recorded in its header.
+	Source *Source
+
+	// SigningKey, if set, is used to sign periodic checkpoints of the
+	// hash chain. Only archives created or rewritten with a signing key
+	// can hold checkpoints.
+	SigningKey ed25519.PrivateKey
+
+	// ReadOnly opens an archive without writing to it or its index
+	// files. A missing or empty archive reads as having no messages, and
+	// writing fails with ErrReadOnly.
+	ReadOnly bool
 }
 
-func Open(name string) (*DB, error) {
-	fd, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0600)
+// ErrReadOnly is returned when writing to an archive opened read-only.
+var ErrReadOnly = errors.New("archive opened read-only")
+
+func Open(name string, opts Options) (*DB, error) {
+	flags := os.O_CREATE | os.O_RDWR
+	if opts.ReadOnly {
+		flags = os.O_RDONLY
+	}
+	fd, err := os.OpenFile(name, flags, 0600)
+	if opts.ReadOnly && os.IsNotExist(err) {
+		return &DB{
+			name:       name,
+			opts:       opts,
+			labels:     make(map[uint32][]string),
+			offsets:    make(map[uint32]int64),
+			migrations: make(map[string]*migration),
+		}, nil
+	}
 	if err != nil {
 		return nil, err
 	}
 	db := &DB{
-		name:    name,
-		labels:  make(map[uint32][]string),
-		offsets: make(map[uint32]int64),
-		fd:      fd,
+		name:  name,
+		fd:    fd,
+		opts:  opts,
+		codec: opts.Compression,
+	}
+
+	if err := db.load(); err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func (db *DB) load() error {
+	db.version++
+	db.labels = make(map[uint32][]string)
+	db.offsets = make(map[uint32]int64)
+	db.window = nil
+	db.migrations = make(map[string]*migration)
+	db.scanState = nil
+
+	if err := db.readPreamble(); err != nil {
+		return err
+	}
+	db.start, _ = db.fd.Seek(0, io.SeekCurrent)
+	preambleChain := db.chain
+
+	db.signing = false
+	if db.opts.SigningKey != nil {
+		if db.header != nil && db.header.Features&FeatureCheckpoints != 0 {
+			db.signing = true
+		} else {
+			log.Println("Archive was not created for signing; compact or recompress it with a signing key to enable checkpoints")
+		}
 	}
 
 	if err := db.readIndex(); err != nil {
@@ -45,31 +146,57 @@ func Open(name string) (*DB, error) {
 		}
 		db.labels = make(map[uint32][]string)
 		db.offsets = make(map[uint32]int64)
-		db.fd.Seek(0, io.SeekStart)
+		db.window = nil
+		db.migrations = make(map[string]*migration)
+		db.scanState = nil
+		db.chain = preambleChain
+		db.fd.Seek(db.start, io.SeekStart)
 	}
 
 	if err := db.scan(); err != nil {
-		fd.Close()
-		return nil, err
+		return err
+	}
+
+	if db.opts.ReadOnly {
+		_, err := db.fd.Seek(db.start, io.SeekStart)
+		return err
 	}
 
 	if db.dirty > 0 {
-		db.writeIndex()
+		// The archive is usable without an index, which is written
+		// again later.
+		if err := db.writeIndex(); err != nil {
+			log.Println("Writing index:", err)
+		}
 	}
 
-	db.fd.Seek(0, io.SeekStart)
-	return db, err
+	db.openSearch()
+
+	_, err := db.fd.Seek(db.start, io.SeekStart)
+	return err
 }
 
 func (db *DB) scan() error {
+	var run chunkRun
 	for {
 		offs, _ := db.fd.Seek(0, io.SeekCurrent)
-		rec, err := db.ReadRecord()
+		data, err := readPayload(db.fd, &db.buf)
 		if err == io.EOF {
 			break
 		} else if err != nil {
 			return err
 		}
+		db.chain = chainNext(db.chain, data)
+
+		rec, err := db.decodeRecord(data, db.ad(offs))
+		if err == errControlRecord {
+			if err := db.control(data, db.ad(offs)); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
 
 		if rec.Deleted {
 			db.offsets[rec.MessageId] = -1
@@ -77,13 +204,52 @@ func (db *DB) scan() error {
 			continue
 		}
 
-		db.offsets[rec.MessageId] = offs
+		if chunked(rec) {
+			// A chunked message starts at its first chunk and exists
+			// once the last one is read. Incomplete runs are ignored.
+			if err := run.add(rec, offs); err != nil || rec.More {
+				continue
+			}
+			offs = run.start
+		}
+
+		if len(rec.MessageHash) > 0 {
+			// Label updates carry no message data and must not move the
+			// offset away from the record that does.
+			db.offsets[rec.MessageId] = offs
+		}
 		db.labels[rec.MessageId] = rec.Labels
 		db.dirty++
 	}
 	return nil
 }
 
+// control applies a window or migration record read from the archive.
+func (db *DB) control(data, ad []byte) error {
+	var env Envelope
+	if bytes.HasPrefix(data, gzipMagic) || proto.Unmarshal(data, &env) != nil {
+		return nil
+	}
+	switch {
+	case env.Window != nil:
+		w, err := db.windowRecord(&env, ad)
+		if err != nil {
+			return err
+		}
+		db.window = w
+	case env.Migration != nil:
+		m, err := db.migrationRecord(&env, ad)
+		if err != nil {
+			return err
+		}
+		db.applyMigration(m)
+	default:
+		return nil
+	}
+	db.dirty++
+	return nil
+}
+
 func (db *DB) writeIndex() error {
 	fd, err := os.Create(db.name + ".idx.tmp")
 	if err != nil {
@@ -93,6 +259,10 @@ func (db *DB) writeIndex() error {
 	offs, _ := db.fd.Seek(0, io.SeekEnd)
 	idx := &Index{
 		FileOffset: offs,
+		ChainHash:  db.chain,
+		Window:     db.window,
+		Migrations: db.migrationStates(),
+		Scan:       db.scanState,
 	}
 	for msg, offs := range db.offsets {
 		idx.Records = append(idx.Records, &IndexRecord{
@@ -102,14 +272,23 @@ func (db *DB) writeIndex() error {
 		})
 	}
 
+	// The index starts with a hash of its contents, or in encrypted
+	// archives of the sealed contents, so as not to give away a
+	// fingerprint of the plaintext.
 	bs, _ := proto.Marshal(idx)
 	hash := sha256.Sum256(bs)
+	bs, err = db.encode(bs, db.ad(indexPosition))
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	if db.aead != nil {
+		hash = sha256.Sum256(bs)
+	}
 	if _, err := fd.Write(hash[:]); err != nil {
 		fd.Close()
 		return err
 	}
-
-	bs = compress(bs)
 	if _, err := fd.Write(bs); err != nil {
 		fd.Close()
 		return err
@@ -132,20 +311,38 @@ func (db *DB) readIndex() error {
 		return err
 	}
 
-	dec, err := decompress(bs[32:])
+	if len(bs) < 32 {
+		return errors.New("index truncated")
+	}
+
+	if db.aead != nil {
+		if hash := sha256.Sum256(bs[32:]); !bytes.Equal(hash[:], bs[:32]) {
+			return errors.New("index corrupt")
+		}
+	}
+	dec, err := db.decode(bs[32:], db.ad(indexPosition))
 	if err != nil {
 		return err
 	}
-
-	hash := sha256.Sum256(dec)
-	if !bytes.Equal(hash[:], bs[:32]) {
-		return errors.New("index corrupt")
+	if db.aead == nil {
+		if hash := sha256.Sum256(dec); !bytes.Equal(hash[:], bs[:32]) {
+			return errors.New("index corrupt")
+		}
 	}
 
 	var idx Index
 	if err := proto.Unmarshal(dec, &idx); err != nil {
 		return err
 	}
+	if idx.ChainHash == nil {
+		return errors.New("index predates hash chain")
+	}
+	db.chain = idx.ChainHash
+	db.window = idx.Window
+	for _, m := range idx.Migrations {
+		db.applyMigration(m)
+	}
+	db.scanState = idx.Scan
 
 	for _, rec := range idx.Records {
 		db.labels[rec.MessageId] = rec.Labels
@@ -159,30 +356,38 @@ func (db *DB) readIndex() error {
 }
 
 func (db *DB) Rewind() error {
-	_, err := db.fd.Seek(0, io.SeekStart)
+	_, err := db.fd.Seek(db.start, io.SeekStart)
 	return err
 }
 
+// ReadRecord reads the next record, with the chunks of a chunked message
+// joined into one.
 func (db *DB) ReadRecord() (*MessageRecord, error) {
 	db.mut.Lock()
 	defer db.mut.Unlock()
+	return db.readMessage(db.fd, &db.buf)
+}
 
-	if db.buf == nil {
-		db.buf = make([]byte, 65536)
-	}
-	if _, err := io.ReadFull(db.fd, db.buf[:4]); err != nil {
-		return nil, err
-	}
+// readRecord reads the next message record from r, skipping over any
+// control records. r is the archive file or a section of it.
+func (db *DB) readRecord(r io.ReadSeeker, buf *[]byte) (*MessageRecord, error) {
+	for {
+		offs := position(r)
+		data, err := readPayload(r, buf)
+		if err != nil {
+			return nil, err
+		}
 
-	size := int(binary.BigEndian.Uint32(db.buf))
-	if len(db.buf) < size {
-		db.buf = make([]byte, size)
-	}
-	if _, err := io.ReadFull(db.fd, db.buf[:size]); err != nil {
-		return nil, err
+		rec, err := db.decodeRecord(data, db.ad(offs))
+		if err == errControlRecord {
+			continue
+		}
+		return rec, err
 	}
+}
 
-	bs, err := decompress(db.buf[:size])
+func (db *DB) decodeRecord(data, ad []byte) (*MessageRecord, error) {
+	bs, err := db.decode(data, ad)
 	if err != nil {
 		return nil, err
 	}
@@ -195,16 +400,130 @@ func (db *DB) ReadRecord() (*MessageRecord, error) {
 	return &rec, nil
 }
 
+// position returns the offset in the archive file at which r, the file
+// or a section of it, will read next.
+func position(r io.Seeker) int64 {
+	offs, _ := r.Seek(0, io.SeekCurrent)
+	if sr, ok := r.(*io.SectionReader); ok {
+		_, base, _ := sr.Outer()
+		offs += base
+	}
+	return offs
+}
+
+// readPayload reads the next length-prefixed record from r. A length
+// beyond the end of the file is refused before anything is allocated for
+// it, as it can only come from a truncated or corrupt archive, or a file
+// that is not an archive at all.
+func readPayload(r io.Reader, buf *[]byte) ([]byte, error) {
+	if *buf == nil {
+		*buf = make([]byte, 65536)
+	}
+	if _, err := io.ReadFull(r, (*buf)[:4]); err != nil {
+		return nil, err
+	}
+
+	size := int(binary.BigEndian.Uint32(*buf))
+	if left, ok := remaining(r); ok && int64(size) > left {
+		return nil, fmt.Errorf("record of %d bytes with %d left in the file: %w", size, left, io.ErrUnexpectedEOF)
+	}
+	if len(*buf) < size {
+		*buf = make([]byte, size)
+	}
+	if _, err := io.ReadFull(r, (*buf)[:size]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return (*buf)[:size], nil
+}
+
+// remaining returns the number of bytes left to read in r, if r is a
+// file or a section of one.
+func remaining(r io.Reader) (int64, bool) {
+	var size int64
+	switch r := r.(type) {
+	case *io.SectionReader:
+		size = r.Size()
+	case *os.File:
+		fi, err := r.Stat()
+		if err != nil {
+			return 0, false
+		}
+		size = fi.Size()
+	default:
+		return 0, false
+	}
+	offs, err := r.(io.Seeker).Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, false
+	}
+	return size - offs, true
+}
+
 func (db *DB) Size() int {
 	defer db.mut.Unlock()
 	db.mut.Lock()
 	return len(db.offsets)
 }
 
+// Version returns a number that changes whenever the messages or labels
+// of the archive do, so that what is derived from them can be cached.
+func (db *DB) Version() uint64 {
+	defer db.mut.Unlock()
+	db.mut.Lock()
+	return db.version
+}
+
 func (db *DB) Have(msgid uint32) bool {
 	defer db.mut.Unlock()
 	db.mut.Lock()
-	return db.offsets[msgid] > 0
+	offs, ok := db.offsets[msgid]
+	return ok && offs >= 0
+}
+
+// MessageIDs returns the IDs of all live messages, in increasing order.
+func (db *DB) MessageIDs() []uint32 {
+	defer db.mut.Unlock()
+	db.mut.Lock()
+
+	ids := make([]uint32, 0, len(db.offsets))
+	for msgid, offs := range db.offsets {
+		if offs >= 0 {
+			ids = append(ids, msgid)
+		}
+	}
+	sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+	return ids
+}
+
+// Message returns the record holding the latest data of a live message,
+// with its current labels. A chunked message is read into memory as a
+// whole; see MessageReader.
+func (db *DB) Message(msgid uint32) (*MessageRecord, error) {
+	defer db.mut.Unlock()
+	db.mut.Lock()
+
+	offs, ok := db.offsets[msgid]
+	if !ok || offs < 0 {
+		return nil, fmt.Errorf("message %d: %w", msgid, os.ErrNotExist)
+	}
+
+	// Read at the offset without disturbing sequential reading.
+	fi, err := db.fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf []byte
+	rec, err := db.readMessage(io.NewSectionReader(db.fd, offs, fi.Size()-offs), &buf)
+	if err != nil {
+		return nil, fmt.Errorf("message %d: %w", msgid, err)
+	}
+	rec.Labels = db.labels[msgid]
+	return rec, nil
 }
 
 func (db *DB) Labels(msgid uint32) []string {
@@ -227,10 +546,15 @@ func (db *DB) SetLabels(msgid uint32, labels []string) error {
 	return db.writeRecord(rec)
 }
 
-func (db *DB) WriteMessage(msgid uint32, data []byte, labels []string) error {
+// WriteMessage stores a message with its labels and the ID of the
+// conversation it belongs to, if known.
+func (db *DB) WriteMessage(msgid uint32, data []byte, labels []string, threadID uint64) error {
 	defer db.mut.Unlock()
 	db.mut.Lock()
+	return db.writeMessage(msgid, data, labels, threadID)
+}
 
+func (db *DB) writeMessage(msgid uint32, data []byte, labels []string, threadID uint64) error {
 	offs, _ := db.fd.Seek(0, io.SeekEnd)
 	db.offsets[msgid] = offs
 	db.labels[msgid] = labels
@@ -242,9 +566,16 @@ func (db *DB) WriteMessage(msgid uint32, data []byte, labels []string) error {
 		MessageData: data,
 		MessageHash: hash[:],
 		Labels:      labels,
+		ThreadId:    threadID,
 	}
 
-	return db.writeRecord(rec)
+	if err := db.writeRecord(rec); err != nil {
+		return err
+	}
+	if db.search != nil {
+		db.search.Add(msgid, data)
+	}
+	return nil
 }
 
 func (db *DB) DeleteMessage(msgid uint32) error {
@@ -262,50 +593,111 @@ func (db *DB) DeleteMessage(msgid uint32) error {
 	return db.writeRecord(rec)
 }
 
+// indexInterval is the number of changes after which the index is
+// written, so that an interrupted run need not rescan the whole archive.
+const indexInterval = 1000
+
 func (db *DB) writeRecord(rec *MessageRecord) error {
-	bs, err := proto.Marshal(rec)
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	offs, err := db.fd.Seek(0, io.SeekEnd)
 	if err != nil {
 		return err
 	}
 
-	bs = compress(bs)
-
-	size := make([]byte, 4)
-	binary.BigEndian.PutUint32(size, uint32(len(bs)))
-	if _, err := db.fd.Write(size); err != nil {
+	rec.PrevHash = db.chain
+	bs, err := db.encodeRecord(rec, db.ad(offs))
+	if err != nil {
 		return err
 	}
-	if _, err := db.fd.Write(bs); err != nil {
+	db.chain, err = writeChained(db.fd, db.chain, bs)
+	if err != nil {
 		return err
 	}
 
 	db.dirty++
+	db.version++
+	db.unsigned++
+
+	if db.unsigned >= checkpointInterval {
+		if err := db.checkpoint(); err != nil {
+			return err
+		}
+	}
+	if chunked(rec) {
+		// The index must not be written in the middle of a run, before
+		// the message exists; see WriteMessageStream.
+		return nil
+	}
+	return db.maybeWriteIndex()
+}
+
+// maybeWriteIndex writes the index, and flushes the full-text index, once
+// enough has changed since the index was last written.
+func (db *DB) maybeWriteIndex() error {
+	if db.dirty < indexInterval {
+		return nil
+	}
+	if err := db.writeIndex(); err != nil {
+		return fmt.Errorf("write index: %w", err)
+	}
+	return db.flushSearch()
+}
 
-	if db.dirty >= 1000 {
-		db.writeIndex()
+func (db *DB) encodeRecord(rec *MessageRecord, ad []byte) ([]byte, error) {
+	bs, err := proto.Marshal(rec)
+	if err != nil {
+		return nil, err
 	}
+	return db.encode(bs, ad)
+}
 
+func writePayload(w io.Writer, bs []byte) error {
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(bs)))
+	if _, err := w.Write(size); err != nil {
+		return err
+	}
+	if _, err := w.Write(bs); err != nil {
+		return err
+	}
 	return nil
 }
 
-func (db *DB) WriteClose() error {
+// Close closes the archive file, after which the DB cannot be used. Use
+// WriteClose first to write the index and any final checkpoint.
+func (db *DB) Close() error {
 	defer db.mut.Unlock()
 	db.mut.Lock()
-	return nil
-}
 
-func compress(data []byte) []byte {
-	buf := new(bytes.Buffer)
-	gw := gzip.NewWriter(buf)
-	gw.Write(data)
-	gw.Close()
-	return buf.Bytes()
+	if db.dec != nil {
+		db.dec.Close()
+		db.dec = nil
+	}
+	if db.fd == nil {
+		// A missing archive opened read-only.
+		return nil
+	}
+	return db.fd.Close()
 }
 
-func decompress(data []byte) ([]byte, error) {
-	gr, err := gzip.NewReader(bytes.NewReader(data))
-	if err != nil {
-		return nil, err
+func (db *DB) WriteClose() error {
+	defer db.mut.Unlock()
+	db.mut.Lock()
+
+	if db.opts.ReadOnly {
+		return nil
+	}
+
+	if err := db.checkpoint(); err != nil {
+		return err
 	}
-	return ioutil.ReadAll(gr)
+	if err := db.flushSearch(); err != nil {
+		return err
+	}
+	if db.dirty > 0 {
+		return db.writeIndex()
+	}
+	return nil
 }
@@ -0,0 +1,123 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIndexWriteError(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.imapchive")
+	d, err := Open(name, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// The index cannot be written while its temporary file is blocked.
+	if err := os.Mkdir(name+".idx.tmp", 0o700); err != nil {
+		t.Fatal(err)
+	}
+	var writeErr error
+	for id := uint32(1); id <= indexInterval && writeErr == nil; id++ {
+		writeErr = d.WriteMessage(id, []byte("Subject: x\r\n\r\n"), nil, 0)
+	}
+	if writeErr == nil {
+		t.Error("failed periodic index write not reported")
+	}
+	if err := d.WriteClose(); err == nil {
+		t.Error("failed index write on close not reported")
+	}
+
+	// The archive still opens, and reads the same once the index can be
+	// written.
+	if err := os.Remove(name + ".idx.tmp"); err != nil {
+		t.Fatal(err)
+	}
+	d2, err := Open(name, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d2.Close()
+	if n := len(d2.MessageIDs()); n != indexInterval {
+		t.Errorf("%d messages, want %d", n, indexInterval)
+	}
+	if _, err := os.Stat(name + ".idx"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing.imapchive")
+	d, err := Open(existing, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.WriteMessage(1, []byte("Subject: x\r\n\r\n"), []string{"L"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetWindow(&Window{MaxSize: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.WriteClose(); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+	if err := os.Remove(existing + ".idx"); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(dir, "empty.imapchive")
+	if err := os.WriteFile(empty, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		file     string
+		messages int
+		window   bool
+	}{
+		{"missing", filepath.Join(dir, "missing.imapchive"), 0, false},
+		{"empty", empty, 0, false},
+		{"existing", existing, 1, true},
+	} {
+		before, beforeErr := os.ReadFile(tc.file)
+		d, err := Open(tc.file, Options{ReadOnly: true})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if n := len(d.MessageIDs()); n != tc.messages {
+			t.Errorf("%s: %d messages, want %d", tc.name, n, tc.messages)
+		}
+		if w := d.Window(); (w != nil) != tc.window {
+			t.Errorf("%s: window %v", tc.name, w)
+		}
+		for what, err := range map[string]error{
+			"write":      d.WriteMessage(2, []byte("Subject: y\r\n\r\n"), nil, 0),
+			"set labels": d.SetLabels(1, []string{"M"}),
+			"delete":     d.DeleteMessage(1),
+			"window":     d.SetWindow(&Window{}),
+			"scan state": d.SetScanState(&Scan{Highest: 2}),
+		} {
+			if !errors.Is(err, ErrReadOnly) {
+				t.Errorf("%s: %s: %v, want %v", tc.name, what, err, ErrReadOnly)
+			}
+		}
+		if err := d.WriteClose(); err != nil {
+			t.Errorf("%s: WriteClose: %v", tc.name, err)
+		}
+		d.Close()
+
+		// Nothing is created or changed.
+		after, err := os.ReadFile(tc.file)
+		if os.IsNotExist(beforeErr) != os.IsNotExist(err) || !bytes.Equal(after, before) {
+			t.Errorf("%s: archive changed: %v", tc.name, err)
+		}
+		if _, err := os.Stat(tc.file + ".idx"); !os.IsNotExist(err) {
+			t.Errorf("%s: index written: %v", tc.name, err)
+		}
+	}
+}
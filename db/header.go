@@ -0,0 +1,288 @@
+package db
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// fileMagic starts every archive that has a header. Archives without it
+// predate the header and are read as a bare sequence of records.
+var fileMagic = []byte("IMAPCHIV")
+
+// formatVersion is the archive format version written to new headers.
+// Headerless archives are version 1.
+const formatVersion = 2
+
+// Feature flags recorded in the archive header. An archive using a
+// feature that is not known to the reader is refused rather than
+// misread.
+const (
+	FeatureZstd = 1 << iota
+	FeatureDictionary
+	FeatureEncrypted
+	FeatureCheckpoints
+	FeatureChunked
+	FeatureWindows
+	FeatureBoundRecords
+	FeatureMigrations
+
+	knownFeatures = FeatureZstd | FeatureDictionary | FeatureEncrypted | FeatureCheckpoints | FeatureChunked | FeatureWindows | FeatureBoundRecords | FeatureMigrations
+)
+
+// ErrNotArchive is returned when opening a file that is not an archive.
+var ErrNotArchive = errors.New("not an imapchive archive")
+
+// Header returns the archive header, or nil for a legacy archive without
+// one.
+func (db *DB) Header() *Header {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+	return db.header
+}
+
+// readPreamble loads the header and dictionaries stored at the start of
+// the archive and leaves the file positioned at the first message record,
+// with the hash chain covering the preamble. A new archive gets a header
+// describing how it is written.
+func (db *DB) readPreamble() error {
+	db.header = nil
+	db.dicts = make(map[uint32][]byte)
+	db.chain = initialChain()
+	if _, err := db.fd.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	magic := make([]byte, len(fileMagic))
+	n, err := io.ReadFull(db.fd, magic)
+	if n == 0 && err == io.EOF {
+		if db.opts.ReadOnly {
+			return nil
+		}
+		return db.create()
+	}
+	versioned := err == nil && bytes.Equal(magic, fileMagic)
+	if !versioned {
+		if _, err := db.fd.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	for first := true; ; first = false {
+		offs, _ := db.fd.Seek(0, io.SeekCurrent)
+		data, err := readPayload(db.fd, &db.buf)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			if !versioned && first {
+				return ErrNotArchive
+			}
+			return err
+		}
+
+		var env Envelope
+		if bytes.HasPrefix(data, gzipMagic) || proto.Unmarshal(data, &env) != nil || (env.Dictionary == nil && env.Header == nil) {
+			if versioned && first {
+				return errors.New("archive header missing")
+			}
+			if !versioned && first {
+				// Without magic bytes, only a readable record tells an
+				// archive apart from any other file.
+				if _, err := db.decodeRecord(data, nil); err != nil {
+					return ErrNotArchive
+				}
+			}
+
+			// Without a current header, the first message record
+			// determines the codec used for the rest of the archive.
+			if db.header == nil || db.header.Version < formatVersion {
+				db.codec = env.Codec
+			}
+			if _, err := db.fd.Seek(offs, io.SeekStart); err != nil {
+				return err
+			}
+			break
+		}
+		db.chain = chainNext(db.chain, data)
+
+		if env.Header != nil {
+			if err := db.setHeader(env.Header); err != nil {
+				return err
+			}
+			continue
+		}
+
+		dict := env.Dictionary
+		if env.Nonce != nil {
+			data, err := db.open(&env, db.ad(offs))
+			if err != nil {
+				return err
+			}
+			dict = new(Dictionary)
+			if err := proto.Unmarshal(data, dict); err != nil {
+				return err
+			}
+		}
+		if err := db.addDictionary(dict.Data); err != nil {
+			return err
+		}
+	}
+
+	if versioned && db.header == nil {
+		return errors.New("archive header missing")
+	}
+	if db.header == nil && (db.opts.Passphrase != "" || db.opts.Key != nil) {
+		return ErrNotEncrypted
+	}
+	return nil
+}
+
+// create writes the preamble of a new, empty, archive.
+func (db *DB) create() error {
+	db.header = &Header{
+		Created: time.Now().Unix(),
+		Source:  db.opts.Source,
+	}
+
+	if db.opts.Passphrase != "" || db.opts.Key != nil {
+		enc, aead, err := newEncryption(db.opts)
+		if err != nil {
+			return err
+		}
+		db.header.Encryption = enc
+		db.aead = aead
+	}
+
+	hdr, chain, err := db.writePreamble(db.fd)
+	if err != nil {
+		return err
+	}
+	db.header = hdr
+	db.chain = chain
+	return nil
+}
+
+// setHeader applies the archive header, deriving the encryption key if
+// the archive is encrypted.
+func (db *DB) setHeader(hdr *Header) error {
+	if hdr.Version > formatVersion {
+		return fmt.Errorf("unsupported archive version %d", hdr.Version)
+	}
+	if unknown := hdr.Features &^ knownFeatures; unknown != 0 {
+		return fmt.Errorf("unsupported archive features %#x", unknown)
+	}
+	if hdr.Features&FeatureZstd != 0 {
+		db.codec = Codec_ZSTD
+	}
+
+	db.header = hdr
+	if hdr.Encryption == nil {
+		if hdr.Features&FeatureEncrypted != 0 {
+			return errors.New("encryption parameters missing from header")
+		}
+		if db.opts.Passphrase != "" || db.opts.Key != nil {
+			return ErrNotEncrypted
+		}
+		return nil
+	}
+
+	// After a rewrite the archive is reloaded with the key already
+	// derived; avoid the cost of deriving it again.
+	if db.aead != nil && checkKey(db.aead, hdr.Encryption) == nil {
+		return nil
+	}
+
+	aead, err := deriveKey(hdr.Encryption, db.opts)
+	if err != nil {
+		return err
+	}
+	if err := checkKey(aead, hdr.Encryption); err != nil {
+		return err
+	}
+	db.aead = aead
+	return nil
+}
+
+// features returns the feature flags describing how records are written.
+func (db *DB) features() uint64 {
+	var features uint64
+	if db.codec == Codec_ZSTD {
+		features |= FeatureZstd
+		if db.dicts[db.dict] != nil {
+			features |= FeatureDictionary
+		}
+	}
+	if db.aead != nil {
+		features |= FeatureEncrypted | FeatureBoundRecords
+	}
+	if db.opts.SigningKey != nil {
+		features |= FeatureCheckpoints
+	}
+	// Any archive written now may come to hold chunked messages, windows
+	// and migration progress, which older readers would misread.
+	features |= FeatureChunked | FeatureWindows | FeatureMigrations
+	return features
+}
+
+// writePreamble writes the magic bytes, a new header based on the current
+// one and the active dictionary, if any, and returns the header and the
+// resulting hash chain value. Legacy archives get a header when
+// rewritten. In encrypted archives the dictionary, being derived from
+// message contents, is itself encrypted.
+func (db *DB) writePreamble(w io.Writer) (*Header, []byte, error) {
+	hdr := &Header{
+		Created: time.Now().Unix(),
+	}
+	if db.header != nil {
+		hdr = proto.Clone(db.header).(*Header)
+	}
+	hdr.Version = formatVersion
+	hdr.Features = db.features()
+	hdr.Id = make([]byte, 16)
+	if _, err := rand.Read(hdr.Id); err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := w.Write(fileMagic); err != nil {
+		return nil, nil, err
+	}
+	bs, err := proto.Marshal(&Envelope{Header: hdr})
+	if err != nil {
+		return nil, nil, err
+	}
+	chain, err := writeChained(w, initialChain(), bs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dict := db.dicts[db.dict]
+	if dict == nil {
+		return hdr, chain, nil
+	}
+	pos := int64(len(fileMagic) + 4 + len(bs)) // following the header
+	env := &Envelope{
+		Dictionary: &Dictionary{Id: db.dict, Data: dict},
+	}
+	if db.aead != nil {
+		bs, err := proto.Marshal(env.Dictionary)
+		if err != nil {
+			return nil, nil, err
+		}
+		env.Nonce, env.Data, err = seal(db.aead, bs, recordAD(hdr, pos))
+		if err != nil {
+			return nil, nil, err
+		}
+		env.Dictionary = &Dictionary{Id: db.dict}
+	}
+	bs, err = proto.Marshal(env)
+	if err != nil {
+		return nil, nil, err
+	}
+	chain, err = writeChained(w, chain, bs)
+	return hdr, chain, err
+}
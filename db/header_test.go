@@ -0,0 +1,208 @@
+package db
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// writeFile writes data to a new file and returns its name.
+func writeFile(t *testing.T, data []byte) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "test.imapchive")
+	if err := os.WriteFile(name, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func testSigningKey(t *testing.T) ed25519.PrivateKey {
+	return ed25519.NewKeyFromSeed(bytes.Repeat([]byte{7}, ed25519.SeedSize))
+}
+
+func hashOf(data string) []byte {
+	hash := sha256.Sum256([]byte(data))
+	return hash[:]
+}
+
+// headerFile returns an archive holding only the given header.
+func headerFile(t *testing.T, hdr *Header) []byte {
+	t.Helper()
+	bs, err := proto.Marshal(&Envelope{Header: hdr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	buf.Write(fileMagic)
+	if err := writePayload(&buf, bs); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestOpenNotArchive(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+		err  string // the start of the error, if not ErrNotArchive
+	}{
+		{name: "text", data: []byte("From alice@example.com Sat Jan  5 10:00:00 2019\nSubject: hi\n\nbody\n")},
+		{name: "huge length", data: []byte("\xff\xff\xff\xf0garbage")},
+		{name: "short length", data: []byte{0, 0}},
+		{name: "length only", data: []byte{0, 0, 0, 4}},
+		{name: "not a record", data: []byte("\x00\x00\x00\x04abcd")},
+		{name: "magic only", data: fileMagic, err: "archive header missing"},
+		{name: "magic and huge length", data: append(append([]byte{}, fileMagic...), 0xff, 0xff, 0xff, 0xf0), err: "record of"},
+		{name: "future version", data: headerFile(t, &Header{Version: formatVersion + 1}), err: "unsupported archive version"},
+		{name: "unknown feature", data: headerFile(t, &Header{Version: formatVersion, Features: 1 << 40}), err: "unsupported archive features"},
+		{name: "encryption missing", data: headerFile(t, &Header{Version: formatVersion, Features: FeatureEncrypted}), err: "encryption parameters missing"},
+	}
+	for _, tc := range cases {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		d, err := Open(writeFile(t, tc.data), Options{})
+		runtime.ReadMemStats(&after)
+
+		switch {
+		case err == nil:
+			d.Close()
+			t.Errorf("%s: opened", tc.name)
+		case tc.err == "" && err != ErrNotArchive:
+			t.Errorf("%s: %v, want %v", tc.name, err, ErrNotArchive)
+		case tc.err != "" && !strings.HasPrefix(err.Error(), tc.err):
+			t.Errorf("%s: %v, want %q", tc.name, err, tc.err)
+		}
+		// The length of a record is not trusted beyond the file size.
+		if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 16<<20 {
+			t.Errorf("%s: allocated %d bytes", tc.name, alloc)
+		}
+	}
+}
+
+func TestTruncatedRecord(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.imapchive")
+	d, err := Open(name, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.WriteMessage(1, []byte("Subject: one\r\n\r\n"), nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.WriteMessage(2, bytes.Repeat([]byte("x"), 1000), nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(name, fi.Size()-10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(name, Options{}); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("opened truncated archive: %v", err)
+	}
+}
+
+func TestHeader(t *testing.T) {
+	cases := []struct {
+		name     string
+		opts     Options
+		features uint64
+	}{
+		{name: "gzip"},
+		{name: "zstd", opts: Options{Compression: Codec_ZSTD}, features: FeatureZstd},
+		{name: "encrypted", opts: Options{Key: testKey()}, features: FeatureEncrypted | FeatureBoundRecords},
+		{name: "signed", opts: Options{SigningKey: testSigningKey(t)}, features: FeatureCheckpoints},
+	}
+	for _, tc := range cases {
+		src := &Source{Server: "imap.example.com", Account: "alice", Mailbox: "INBOX"}
+		opts := tc.opts
+		opts.Source = src
+		name := filepath.Join(t.TempDir(), "test.imapchive")
+		d, err := Open(name, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.Close()
+
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(data, fileMagic) {
+			t.Errorf("%s: no magic bytes", tc.name)
+		}
+
+		// The source and features are recorded, whatever options the
+		// archive is opened with later.
+		ro := tc.opts
+		ro.Compression = Codec_GZIP
+		d, err = Open(name, ro)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr := d.Header()
+		want := tc.features | FeatureChunked | FeatureWindows | FeatureMigrations
+		if hdr.Version != formatVersion || hdr.Features != want || !proto.Equal(hdr.Source, src) || len(hdr.Id) != 16 || hdr.Created == 0 {
+			t.Errorf("%s: header %v, want features %#x", tc.name, hdr, want)
+		}
+		if tc.features&FeatureZstd != 0 && d.codec != Codec_ZSTD {
+			t.Errorf("%s: codec %v", tc.name, d.codec)
+		}
+		d.Close()
+	}
+}
+
+func TestLegacyArchive(t *testing.T) {
+	// Archives predating the header are a bare sequence of gzip records.
+	var buf bytes.Buffer
+	for i, data := range []string{"Subject: one\r\n\r\n", "Subject: two\r\n\r\n"} {
+		bs, err := proto.Marshal(&MessageRecord{MessageId: uint32(i + 1), MessageData: []byte(data), MessageHash: hashOf(data)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writePayload(&buf, compress(bs)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := writeFile(t, buf.Bytes())
+
+	d, err := Open(name, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Header() != nil {
+		t.Errorf("legacy archive has header %v", d.Header())
+	}
+	if rec, err := d.Message(2); err != nil || string(rec.MessageData) != "Subject: two\r\n\r\n" {
+		t.Errorf("message 2: %v", err)
+	}
+
+	// Messages appended remain readable by old versions.
+	if err := d.WriteMessage(3, []byte("Subject: three\r\n\r\n"), nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data[4:6], gzipMagic) || !bytes.Equal(data[len(buf.Bytes())+4:][:2], gzipMagic) {
+		t.Error("appended record is not bare gzip")
+	}
+
+	if _, err := Open(name, Options{Key: testKey()}); err != ErrNotEncrypted {
+		t.Errorf("opened legacy archive with a key: %v", err)
+	}
+}
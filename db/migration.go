@@ -0,0 +1,151 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrNoMigrations is returned when recording migration progress in an
+// archive created before it was supported. Compacting or recompressing
+// the archive adds support.
+var ErrNoMigrations = errors.New("archive cannot record migrations; compact or recompress it first")
+
+// migration is the progress in copying the archive to a destination.
+type migration struct {
+	appending map[uint32]bool // about to be appended, perhaps interrupted
+	appended  map[uint32]bool
+}
+
+// Migration returns the messages appended to the destination, and those
+// whose appending may have been interrupted, as recorded with
+// MarkAppending and MarkAppended.
+func (db *DB) Migration(destination string) (appended, appending map[uint32]bool) {
+	defer db.mut.Unlock()
+	db.mut.Lock()
+
+	appended, appending = make(map[uint32]bool), make(map[uint32]bool)
+	if m := db.migrations[destination]; m != nil {
+		for id := range m.appended {
+			appended[id] = true
+		}
+		for id := range m.appending {
+			appending[id] = true
+		}
+	}
+	return appended, appending
+}
+
+// MarkAppending records that a message is about to be appended to the
+// destination. The archive is synced to disk before returning, so that an
+// interruption never leaves the message appended without a record of it.
+func (db *DB) MarkAppending(destination string, msgid uint32) error {
+	defer db.mut.Unlock()
+	db.mut.Lock()
+
+	if err := db.recordMigration(&Migration{Destination: destination, Appending: []uint32{msgid}}); err != nil {
+		return err
+	}
+	return db.fd.Sync()
+}
+
+// MarkAppended records that a message was appended to the destination.
+func (db *DB) MarkAppended(destination string, msgid uint32) error {
+	defer db.mut.Unlock()
+	db.mut.Lock()
+	return db.recordMigration(&Migration{Destination: destination, Appended: []uint32{msgid}})
+}
+
+func (db *DB) recordMigration(m *Migration) error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if db.header == nil || db.header.Features&FeatureMigrations == 0 {
+		return ErrNoMigrations
+	}
+	offs, err := db.fd.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	chain, err := db.writeMigration(db.fd, db.chain, m, db.ad(offs))
+	if err != nil {
+		return err
+	}
+	db.chain = chain
+	db.applyMigration(m)
+	db.dirty++
+	db.unsigned++
+	return nil
+}
+
+// applyMigration applies a migration record, or the state kept in the
+// index.
+func (db *DB) applyMigration(rec *Migration) {
+	m := db.migrations[rec.Destination]
+	if m == nil {
+		m = &migration{appending: make(map[uint32]bool), appended: make(map[uint32]bool)}
+		db.migrations[rec.Destination] = m
+	}
+	for _, id := range rec.Appending {
+		m.appending[id] = true
+	}
+	for _, id := range rec.Appended {
+		delete(m.appending, id)
+		m.appended[id] = true
+	}
+}
+
+// migrationStates returns the state of each migration, for the index or
+// a rewritten archive.
+func (db *DB) migrationStates() []*Migration {
+	var res []*Migration
+	for dest, m := range db.migrations {
+		rec := &Migration{Destination: dest}
+		for id := range m.appending {
+			rec.Appending = append(rec.Appending, id)
+		}
+		for id := range m.appended {
+			rec.Appended = append(rec.Appended, id)
+		}
+		sort.Slice(rec.Appending, func(a, b int) bool { return rec.Appending[a] < rec.Appending[b] })
+		sort.Slice(rec.Appended, func(a, b int) bool { return rec.Appended[a] < rec.Appended[b] })
+		res = append(res, rec)
+	}
+	sort.Slice(res, func(a, b int) bool { return res[a].Destination < res[b].Destination })
+	return res
+}
+
+// writeMigration writes a migration record and returns the new chain
+// value. It is encrypted like a window.
+func (db *DB) writeMigration(w io.Writer, chain []byte, m *Migration, ad []byte) ([]byte, error) {
+	env := &Envelope{Migration: m}
+	if db.aead != nil {
+		env = &Envelope{Migration: &Migration{}}
+		var err error
+		env.Nonce, env.Data, err = db.sealMessage(m, ad)
+		if err != nil {
+			return nil, err
+		}
+	}
+	bs, err := proto.Marshal(env)
+	if err != nil {
+		return nil, err
+	}
+	return writeChained(w, chain, bs)
+}
+
+// migrationRecord returns the migration progress held by a control
+// record.
+func (db *DB) migrationRecord(env *Envelope, ad []byte) (*Migration, error) {
+	if env.Nonce == nil {
+		return env.Migration, nil
+	}
+	m := new(Migration)
+	if err := db.openMessage(env, ad, m); err != nil {
+		return nil, fmt.Errorf("migration: %w", err)
+	}
+	return m, nil
+}
@@ -0,0 +1,287 @@
+package db
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Recompress rewrites every record in the archive using the given codec,
+// optionally with a zstd dictionary trained on the archived messages. The
+// history of each message is preserved. Returns the archive size before
+// and after.
+func (db *DB) Recompress(codec Codec, trainDictionary bool) (int64, int64, error) {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+
+	if trainDictionary && codec != Codec_ZSTD {
+		return 0, 0, errors.New("dictionaries require zstd compression")
+	}
+
+	size, err := db.fd.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	db.codec = codec
+	db.dict = 0
+	db.enc = nil
+
+	if trainDictionary {
+		samples, err := db.sampleMessages(size, 1000)
+		if err != nil {
+			return 0, 0, err
+		}
+		dict, err := TrainDictionary(samples)
+		if err != nil {
+			return 0, 0, fmt.Errorf("train dictionary: %w", err)
+		}
+		if err := db.addDictionary(dict); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return db.rewrite(func(emit func(*MessageRecord) error) error {
+		sr := io.NewSectionReader(db.fd, db.start, size-db.start)
+		var buf []byte
+		for {
+			rec, err := db.readRecord(sr, &buf)
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if err := emit(rec); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// sampleMessages returns the starts of up to n message bodies picked
+// uniformly from the first size bytes of the archive, as used by
+// TrainDictionary.
+func (db *DB) sampleMessages(size int64, n int) ([][]byte, error) {
+	var samples [][]byte
+	sr := io.NewSectionReader(db.fd, db.start, size-db.start)
+	var buf []byte
+	seen := 0
+	for {
+		rec, err := db.readRecord(sr, &buf)
+		if err == io.EOF {
+			return samples, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if len(rec.MessageData) == 0 || chunked(rec) {
+			continue
+		}
+
+		// Copied, so that the rest of the message can be freed.
+		sample := bytes.Clone(rec.MessageData[:min(len(rec.MessageData), maxSample)])
+		seen++
+		if len(samples) < n {
+			samples = append(samples, sample)
+		} else if i := rand.Intn(seen); i < n {
+			samples[i] = sample
+		}
+	}
+}
+
+// rewrite replaces the archive with the records produced by fn, encoded
+// with the current codec and dictionary on a new hash chain, ending with
+// a checkpoint if a signing key is set. The new archive is read back and
+// compared record by record before it atomically replaces the old one,
+// after which the index is rebuilt. Returns the archive size before and
+// after. The caller must hold the lock.
+func (db *DB) rewrite(fn func(emit func(*MessageRecord) error) error) (int64, int64, error) {
+	before, err := db.fd.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	tmpName := db.name + ".tmp"
+	fd, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer os.Remove(tmpName)
+
+	hdr, chain, err := db.writePreamble(fd)
+	if err != nil {
+		fd.Close()
+		return 0, 0, err
+	}
+	if db.window != nil {
+		offs, err := fd.Seek(0, io.SeekCurrent)
+		if err == nil {
+			chain, err = db.writeWindow(fd, chain, db.window, recordAD(hdr, offs))
+		}
+		if err != nil {
+			fd.Close()
+			return 0, 0, err
+		}
+	}
+	for _, m := range db.migrationStates() {
+		offs, err := fd.Seek(0, io.SeekCurrent)
+		if err == nil {
+			chain, err = db.writeMigration(fd, chain, m, recordAD(hdr, offs))
+		}
+		if err != nil {
+			fd.Close()
+			return 0, 0, err
+		}
+	}
+
+	var hashes [][]byte
+	emit := func(rec *MessageRecord) error {
+		offs, err := fd.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		rec.PrevHash = chain
+		bs, err := proto.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(bs)
+		hashes = append(hashes, hash[:])
+
+		bs, err = db.encodeRecord(rec, recordAD(hdr, offs))
+		if err != nil {
+			return err
+		}
+		chain, err = writeChained(fd, chain, bs)
+		return err
+	}
+	if err := fn(emit); err != nil {
+		fd.Close()
+		return 0, 0, err
+	}
+
+	if db.opts.SigningKey != nil {
+		if _, err := db.writeCheckpoint(fd, chain); err != nil {
+			fd.Close()
+			return 0, 0, err
+		}
+	}
+
+	if err := fd.Sync(); err != nil {
+		fd.Close()
+		return 0, 0, err
+	}
+	if err := fd.Close(); err != nil {
+		return 0, 0, err
+	}
+
+	// The new archive is read with its own header, which is kept once it
+	// replaces the old one.
+	oldHeader := db.header
+	db.header = hdr
+	if err := db.verifyRewrite(tmpName, hashes); err != nil {
+		db.header = oldHeader
+		return 0, 0, fmt.Errorf("verify new archive: %w", err)
+	}
+
+	// Swap in the new archive and rebuild the indexes from it.
+
+	hadSearch := db.search != nil
+	db.fd.Close()
+	renameErr := os.Rename(tmpName, db.name)
+	if renameErr == nil {
+		for _, suffix := range []string{".idx", searchSuffix} {
+			if err := os.Remove(db.name + suffix); err != nil && !os.IsNotExist(err) {
+				return 0, 0, err
+			}
+		}
+	}
+
+	db.fd, err = os.OpenFile(db.name, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return 0, 0, err
+	}
+	if renameErr != nil {
+		db.header = oldHeader
+		return 0, 0, renameErr
+	}
+	scanState := db.scanState
+	if err := db.load(); err != nil {
+		return 0, 0, err
+	}
+	if scanState != nil {
+		// The scan state is not in the archive, so it is carried over to
+		// the new index.
+		db.scanState = scanState
+		if err := db.writeIndex(); err != nil {
+			return 0, 0, err
+		}
+	}
+	if hadSearch {
+		if err := db.updateSearch(); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	after, err := db.fd.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, 0, err
+	}
+	_, err = db.fd.Seek(db.start, io.SeekStart)
+	return before, after, err
+}
+
+// verifyRewrite checks that the archive at name holds exactly the records
+// with the given hashes, in order, and that all message data is intact.
+func (db *DB) verifyRewrite(name string, hashes [][]byte) error {
+	fd, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	// Control records are skipped when reading; only the magic bytes need
+	// to be passed over.
+	if _, err := fd.Seek(int64(len(fileMagic)), io.SeekStart); err != nil {
+		return err
+	}
+
+	var buf []byte
+	run := chunkRun{verify: true}
+	for i := 0; ; i++ {
+		rec, err := db.readRecord(fd, &buf)
+		if err == io.EOF {
+			if i != len(hashes) {
+				return fmt.Errorf("expected %d records, found %d", len(hashes), i)
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if i >= len(hashes) {
+			return fmt.Errorf("unexpected record for message %d", rec.MessageId)
+		}
+		bs, err := proto.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		if hash := sha256.Sum256(bs); !bytes.Equal(hash[:], hashes[i]) {
+			return fmt.Errorf("record %d (message %d) differs", i, rec.MessageId)
+		}
+		if chunked(rec) {
+			if err := run.add(rec, 0); err != nil {
+				return err
+			}
+		} else if len(rec.MessageHash) > 0 {
+			if hash := sha256.Sum256(rec.MessageData); !bytes.Equal(hash[:], rec.MessageHash) {
+				return fmt.Errorf("message %d: hash mismatch", rec.MessageId)
+			}
+		}
+	}
+}
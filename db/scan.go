@@ -0,0 +1,29 @@
+package db
+
+import "google.golang.org/protobuf/proto"
+
+// ScanState returns how far the mailbox was scanned, as last set with
+// SetScanState, or nil if that is not known.
+func (db *DB) ScanState() *Scan {
+	defer db.mut.Unlock()
+	db.mut.Lock()
+	if db.scanState == nil {
+		return nil
+	}
+	return proto.Clone(db.scanState).(*Scan)
+}
+
+// SetScanState records how far the mailbox was scanned. The state is kept
+// in the index, which is written when the archive is closed; it is lost,
+// and the mailbox scanned again from the start, if the index is rebuilt.
+func (db *DB) SetScanState(scan *Scan) error {
+	defer db.mut.Unlock()
+	db.mut.Lock()
+
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	db.scanState = proto.Clone(scan).(*Scan)
+	db.dirty++
+	return nil
+}
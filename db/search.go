@@ -0,0 +1,217 @@
+package db
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+
+	"github.com/calmh/imapchive/fts"
+	"google.golang.org/protobuf/proto"
+)
+
+// The full-text index is kept in a sidecar file next to the archive, as a
+// sequence of segments encoded like archive records. Each segment covers
+// the messages written since the previous one, and records the archive
+// offset it is current up to. Once the sidecar exists, messages are
+// indexed as they are written.
+
+const searchSuffix = ".fts"
+
+// searchBatch is the number of messages per segment when catching up.
+const searchBatch = 1000
+
+// SearchIndex brings the full-text index up to date with the archive,
+// creating it if necessary, and returns it. An archive opened read-only
+// keeps its index as it is; the messages it does not cover are indexed in
+// memory, on every call.
+func (db *DB) SearchIndex() (*fts.Index, error) {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+
+	if db.opts.ReadOnly {
+		return db.memorySearch()
+	}
+	if err := db.updateSearch(); err != nil {
+		return nil, err
+	}
+	return db.readSearch()
+}
+
+// openSearch enables incremental indexing if the archive has a full-text
+// index, indexing any messages it is missing.
+func (db *DB) openSearch() {
+	db.search = nil
+	if _, err := os.Stat(db.name + searchSuffix); os.IsNotExist(err) {
+		return
+	}
+	if err := db.updateSearch(); err != nil {
+		log.Println("Updating search index:", err, "(disabling)")
+		db.search = nil
+	}
+}
+
+// updateSearch indexes the messages written since the last segment. An
+// unreadable index is rebuilt from scratch.
+func (db *DB) updateSearch() error {
+	idx, err := db.readSearch()
+	if err != nil {
+		log.Println("Reading search index:", err, "(rebuilding)")
+		if err := os.Remove(db.name + searchSuffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		idx = fts.NewIndex()
+	}
+
+	size, err := db.fd.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	start := idx.Offset()
+	if start < db.start {
+		start = db.start
+	}
+
+	db.search = fts.NewBuilder()
+	if err := db.indexRecords(db.search, start, size, db.writeSearch); err != nil {
+		return err
+	}
+
+	if db.search.Len() == 0 && idx.Offset() == size {
+		return nil
+	}
+	// Write a segment even if there were no new messages, so that the
+	// index exists and is known to be current.
+	return db.writeSearch(size)
+}
+
+// memorySearch returns the full-text index without writing it: the index
+// file as far as it can be read, and the rest of the archive indexed in
+// memory.
+func (db *DB) memorySearch() (*fts.Index, error) {
+	idx, err := db.readSearch()
+	if err != nil {
+		log.Println("Reading search index:", err, "(indexing in memory)")
+		idx = fts.NewIndex()
+	}
+	if db.fd == nil {
+		// A missing archive has no messages.
+		return idx, nil
+	}
+
+	size, err := db.fd.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	b := fts.NewBuilder()
+	if err := db.indexRecords(b, max(idx.Offset(), db.start), size, nil); err != nil {
+		return nil, err
+	}
+	if b.Len() > 0 {
+		idx.Add(b.Segment(size))
+	}
+	return idx, nil
+}
+
+// indexRecords adds the messages in the archive from start to end to the
+// builder. If flush is set, it is called with the offset reached whenever
+// searchBatch messages have been added.
+func (db *DB) indexRecords(b *fts.Builder, start, end int64, flush func(offset int64) error) error {
+	sr := io.NewSectionReader(db.fd, start, end-start)
+	var buf []byte
+	for {
+		offs, _ := sr.Seek(0, io.SeekCurrent)
+		rec, err := db.readRecord(sr, &buf)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch {
+		case rec.More && rec.Chunk == 0:
+			// A chunked message is indexed as a whole, read a chunk
+			// at a time from its first chunk; the rest are skipped.
+			mr, err := db.readerAt(rec.MessageId, start+offs, false)
+			if err != nil {
+				return err
+			}
+			b.AddReader(rec.MessageId, mr)
+		case len(rec.MessageData) > 0 && !chunked(rec):
+			b.Add(rec.MessageId, rec.MessageData)
+		}
+		if flush != nil && b.Len() >= searchBatch {
+			offs, _ := sr.Seek(0, io.SeekCurrent)
+			if err := flush(start + offs); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// flushSearch writes the messages indexed since the last segment.
+func (db *DB) flushSearch() error {
+	if db.search == nil || db.search.Len() == 0 {
+		return nil
+	}
+	size, err := db.fd.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	return db.writeSearch(size)
+}
+
+func (db *DB) writeSearch(offset int64) error {
+	bs, err := proto.Marshal(db.search.Segment(offset))
+	if err != nil {
+		return err
+	}
+	bs, err = db.encode(bs, db.ad(searchPosition))
+	if err != nil {
+		return err
+	}
+
+	fd, err := os.OpenFile(db.name+searchSuffix, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if err := writePayload(fd, bs); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+func (db *DB) readSearch() (*fts.Index, error) {
+	idx := fts.NewIndex()
+
+	fd, err := os.Open(db.name + searchSuffix)
+	if os.IsNotExist(err) {
+		return idx, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	var buf []byte
+	for {
+		data, err := readPayload(fd, &buf)
+		if err == io.EOF {
+			return idx, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		bs, err := db.decode(data, db.ad(searchPosition))
+		if err != nil {
+			return nil, err
+		}
+		var seg fts.Segment
+		if err := proto.Unmarshal(bs, &seg); err != nil {
+			return nil, err
+		}
+		if seg.ArchiveOffset < idx.Offset() {
+			return nil, errors.New("segments out of order")
+		}
+		idx.Add(&seg)
+	}
+}
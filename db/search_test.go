@@ -0,0 +1,99 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/calmh/imapchive/fts"
+)
+
+// largeMessage returns a message spanning several chunks: a large
+// attachment, followed by a text part holding the word.
+func largeMessage(word string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("Subject: large\r\nFrom: a@example.com\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: application/octet-stream\r\n" +
+		"Content-Disposition: attachment\r\n\r\n")
+	for buf.Len() < 3*chunkSize {
+		buf.WriteString("QUJDREVGR0hJSktMTU5PUFFSU1RVVldYWVphYmNkZWZnaGlqa2xtbm9wcXJzdHV2d3h5\r\n")
+	}
+	fmt.Fprintf(&buf, "--b\r\nContent-Type: text/plain\r\n\r\n%s\r\n--b--\r\n", word)
+	return buf.Bytes()
+}
+
+func TestSearchChunkedMessage(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		indexed   bool // the index exists when the message is written
+		readOnly  bool // search the archive opened read-only
+		encrypted bool
+	}{
+		{name: "catch up"},
+		{name: "incremental", indexed: true},
+		{name: "read-only", readOnly: true},
+		{name: "encrypted", indexed: true, encrypted: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var opts Options
+			if tc.encrypted {
+				opts.Key = testKey()
+			}
+			name := filepath.Join(t.TempDir(), "test.imapchive")
+			d, err := Open(name, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.indexed {
+				if _, err := d.SearchIndex(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := d.WriteMessage(1, []byte("Subject: small\r\n\r\nfirst\r\n"), nil, 0); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.WriteMessageStream(2, bytes.NewReader(largeMessage("needle")), nil, 0); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.WriteMessage(3, []byte("Subject: after\r\n\r\nlast\r\n"), nil, 0); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.WriteClose(); err != nil {
+				t.Fatal(err)
+			}
+
+			ro := opts
+			ro.ReadOnly = tc.readOnly
+			d, err = Open(name, ro)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+			idx, err := d.SearchIndex()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for word, want := range map[string][]uint32{
+				"needle": {2},
+				"large":  {2},
+				"first":  {1},
+				"last":   {3},
+			} {
+				got := idx.Search(fts.Phrase(word))
+				if fmt.Sprint(got) != fmt.Sprint(want) {
+					t.Errorf("search %q: got %v, want %v", word, got, want)
+				}
+			}
+
+			_, err = os.Stat(name + searchSuffix)
+			if tc.readOnly && !os.IsNotExist(err) {
+				t.Errorf("read-only search wrote the index: %v", err)
+			} else if !tc.readOnly && err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
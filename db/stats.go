@@ -0,0 +1,227 @@
+package db
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/mail"
+	"sort"
+	"strings"
+
+	"github.com/calmh/imapchive/fts"
+)
+
+// Stats describes the contents of an archive.
+type Stats struct {
+	Messages int `json:"messages"` // live messages
+	Deleted  int `json:"deleted"`  // messages whose latest record is a deletion
+
+	MessageRecords  int `json:"message_records"`  // records holding message data
+	LabelRecords    int `json:"label_records"`    // records holding only a label update
+	DeletionRecords int `json:"deletion_records"` // records marking a message deleted
+
+	FileBytes       int64 `json:"file_bytes"`       // size of the archive file
+	RawBytes        int64 `json:"raw_bytes"`        // message data of live messages
+	StoredBytes     int64 `json:"stored_bytes"`     // records holding live message data, as stored
+	SupersededBytes int64 `json:"superseded_bytes"` // records holding older or deleted message data
+	LabelBytes      int64 `json:"label_bytes"`      // label update records
+	OverheadBytes   int64 `json:"overhead_bytes"`   // everything else: header, deletions, checkpoints
+
+	Labels     map[string]int `json:"labels"` // live messages per label
+	Years      map[int]int    `json:"years"`  // live messages per year of their date
+	TopSenders []SenderCount  `json:"top_senders"`
+	Largest    []MessageSize  `json:"largest"`
+	Duplicates []Duplicate    `json:"duplicates"` // live messages with identical data
+}
+
+// SenderCount is the number of live messages from one address.
+type SenderCount struct {
+	Sender   string `json:"sender"`
+	Messages int    `json:"messages"`
+}
+
+// MessageSize is the size of a live message.
+type MessageSize struct {
+	MessageID uint32 `json:"message_id"`
+	Bytes     int    `json:"bytes"`
+	Subject   string `json:"subject"`
+}
+
+// Duplicate is a set of live messages with the same data.
+type Duplicate struct {
+	Hash       string   `json:"hash"`
+	MessageIDs []uint32 `json:"message_ids"`
+}
+
+// Stats reads the whole archive and describes its contents. Senders and
+// largest messages are limited to the top entries.
+func (db *DB) Stats(top int) (*Stats, error) {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+
+	size, err := db.fd.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	type message struct {
+		stored  int64
+		raw     int
+		hash    []byte
+		labels  []string
+		year    int
+		sender  string
+		subject string
+	}
+
+	res := &Stats{
+		FileBytes:  size,
+		Labels:     make(map[string]int),
+		Years:      make(map[int]int),
+		TopSenders: []SenderCount{},
+		Largest:    []MessageSize{},
+		Duplicates: []Duplicate{},
+	}
+	msgs := make(map[uint32]*message)
+	deleted := make(map[uint32]bool)
+
+	sr := io.NewSectionReader(db.fd, db.start, size-db.start)
+	var buf []byte
+	var run chunkRun
+	var runStored int64
+	var runHead []byte
+	for {
+		offs, _ := sr.Seek(0, io.SeekCurrent)
+		offs += db.start
+		data, err := readPayload(sr, &buf)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("read record at %d: %w", offs, err)
+		}
+		stored := int64(4 + len(data))
+
+		rec, err := db.decodeRecord(data, db.ad(offs))
+		if err == errControlRecord {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("decode record at %d: %w", offs, err)
+		}
+
+		// A chunked message counts once its last chunk is read, with the
+		// headers taken from the first.
+		raw, head := len(rec.MessageData), rec.MessageData
+		if chunked(rec) {
+			if rec.Chunk == 0 {
+				runStored, runHead = 0, rec.MessageData
+			}
+			runStored += stored
+			if err := run.add(rec, offs); err != nil || rec.More {
+				continue
+			}
+			stored, raw, head = runStored, int(run.size), runHead
+		}
+
+		switch {
+		case rec.Deleted:
+			res.DeletionRecords++
+			if m := msgs[rec.MessageId]; m != nil {
+				res.SupersededBytes += m.stored
+				delete(msgs, rec.MessageId)
+			}
+			deleted[rec.MessageId] = true
+
+		case len(rec.MessageHash) > 0:
+			res.MessageRecords++
+			if m := msgs[rec.MessageId]; m != nil {
+				res.SupersededBytes += m.stored
+			}
+			m := &message{
+				stored: stored,
+				raw:    raw,
+				hash:   rec.MessageHash,
+				labels: rec.Labels,
+			}
+			if mm, err := mail.ReadMessage(bytes.NewReader(head)); err == nil {
+				if date, err := mm.Header.Date(); err == nil {
+					m.year = date.Year()
+				}
+				m.sender = strings.ToLower(fts.DecodeHeader(mm.Header.Get("From")))
+				if addr, err := mail.ParseAddress(m.sender); err == nil {
+					m.sender = addr.Address
+				}
+				m.subject = fts.DecodeHeader(mm.Header.Get("Subject"))
+			}
+			msgs[rec.MessageId] = m
+			delete(deleted, rec.MessageId)
+
+		default:
+			res.LabelRecords++
+			res.LabelBytes += stored
+			if m := msgs[rec.MessageId]; m != nil {
+				m.labels = rec.Labels
+			}
+		}
+	}
+
+	res.Messages = len(msgs)
+	res.Deleted = len(deleted)
+
+	senders := make(map[string]int)
+	hashes := make(map[string][]uint32)
+	for id, m := range msgs {
+		res.RawBytes += int64(m.raw)
+		res.StoredBytes += m.stored
+		for _, l := range m.labels {
+			res.Labels[l]++
+		}
+		if m.year != 0 {
+			res.Years[m.year]++
+		}
+		if m.sender != "" {
+			senders[m.sender]++
+		}
+		h := hex.EncodeToString(m.hash)
+		hashes[h] = append(hashes[h], id)
+		res.Largest = append(res.Largest, MessageSize{MessageID: id, Bytes: m.raw, Subject: m.subject})
+	}
+	res.OverheadBytes = size - res.StoredBytes - res.SupersededBytes - res.LabelBytes
+
+	for s, n := range senders {
+		res.TopSenders = append(res.TopSenders, SenderCount{Sender: s, Messages: n})
+	}
+	sort.Slice(res.TopSenders, func(a, b int) bool {
+		sa, sb := res.TopSenders[a], res.TopSenders[b]
+		if sa.Messages != sb.Messages {
+			return sa.Messages > sb.Messages
+		}
+		return sa.Sender < sb.Sender
+	})
+	if len(res.TopSenders) > top {
+		res.TopSenders = res.TopSenders[:top]
+	}
+
+	sort.Slice(res.Largest, func(a, b int) bool {
+		la, lb := res.Largest[a], res.Largest[b]
+		if la.Bytes != lb.Bytes {
+			return la.Bytes > lb.Bytes
+		}
+		return la.MessageID < lb.MessageID
+	})
+	if len(res.Largest) > top {
+		res.Largest = res.Largest[:top]
+	}
+
+	for h, ids := range hashes {
+		if len(ids) > 1 {
+			sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+			res.Duplicates = append(res.Duplicates, Duplicate{Hash: h, MessageIDs: ids})
+		}
+	}
+	sort.Slice(res.Duplicates, func(a, b int) bool {
+		return res.Duplicates[a].MessageIDs[0] < res.Duplicates[b].MessageIDs[0]
+	})
+
+	return res, nil
+}
@@ -0,0 +1,90 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	d, err := Open(filepath.Join(t.TempDir(), "test.imapchive"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	message := func(from, date, subject string) []byte {
+		return []byte(fmt.Sprintf("From: %s\r\nDate: %s\r\nSubject: %s\r\n\r\nHello\r\n", from, date, subject))
+	}
+	for _, m := range []struct {
+		id     uint32
+		data   []byte
+		labels []string
+	}{
+		{1, message("Alice <Alice@example.com>", "Mon, 02 Jan 2017 15:04:05 +0000", "one"), []string{"Inbox"}},
+		{2, message("alice@example.com", "Tue, 03 Jan 2017 15:04:05 +0000", "two"), []string{"Inbox", "Work"}},
+		{3, message("bob@example.com", "Wed, 04 Jan 2019 15:04:05 +0000", "three"), nil},
+		{4, message("bob@example.com", "Wed, 04 Jan 2019 15:04:05 +0000", "three"), nil}, // a duplicate of 3
+		{5, message("carol@example.com", "Thu, 05 Jan 2017 15:04:05 +0000", "deleted"), nil},
+		{1, message("Alice <Alice@example.com>", "Mon, 02 Jan 2017 15:04:05 +0000", "one, again"), []string{"Inbox"}},
+	} {
+		if err := d.WriteMessage(m.id, m.data, m.labels, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	large := append(message("dave@example.com", "Fri, 06 Jan 2023 15:04:05 +0000", "large"), testData(2*chunkSize)...)
+	if err := d.WriteMessageStream(6, bytes.NewReader(large), []string{"Work"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetLabels(3, []string{"Work"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DeleteMessage(5); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := d.Stats(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		what      string
+		got, want any
+	}{
+		{"messages", s.Messages, 5},
+		{"deleted", s.Deleted, 1},
+		{"message records", s.MessageRecords, 7},
+		{"label records", s.LabelRecords, 1},
+		{"deletion records", s.DeletionRecords, 1},
+		{"labels", fmt.Sprint(s.Labels), "map[Inbox:2 Work:3]"},
+		{"years", fmt.Sprint(s.Years), "map[2017:2 2019:2 2023:1]"},
+		{"top senders", fmt.Sprint(s.TopSenders), "[{alice@example.com 2} {bob@example.com 2}]"},
+		{"largest", fmt.Sprintf("%d %d", s.Largest[0].MessageID, s.Largest[0].Bytes), fmt.Sprintf("6 %d", len(large))},
+		{"largest count", len(s.Largest), 2},
+		{"duplicates", fmt.Sprint(s.Duplicates[0].MessageIDs), "[3 4]"},
+		{"duplicate count", len(s.Duplicates), 1},
+	} {
+		if fmt.Sprint(c.got) != fmt.Sprint(c.want) {
+			t.Errorf("%s: %v, want %v", c.what, c.got, c.want)
+		}
+	}
+
+	var raw int64
+	for _, id := range d.MessageIDs() {
+		rec, err := d.Message(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw += int64(len(rec.MessageData))
+	}
+	if s.RawBytes != raw {
+		t.Errorf("raw bytes %d, want %d", s.RawBytes, raw)
+	}
+	if s.SupersededBytes <= 0 || s.LabelBytes <= 0 || s.OverheadBytes <= 0 {
+		t.Errorf("superseded %d, label %d, overhead %d bytes", s.SupersededBytes, s.LabelBytes, s.OverheadBytes)
+	}
+	if sum := s.StoredBytes + s.SupersededBytes + s.LabelBytes + s.OverheadBytes; sum != s.FileBytes {
+		t.Errorf("bytes add up to %d, file is %d", sum, s.FileBytes)
+	}
+}
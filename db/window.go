@@ -0,0 +1,84 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrNoWindows is returned when recording a window in an archive created
+// before windows were supported. Compacting or recompressing the archive
+// adds support.
+var ErrNoWindows = errors.New("archive cannot record windows; compact or recompress it first")
+
+// IsZero reports whether the window does not restrict anything.
+func (w *Window) IsZero() bool {
+	return w == nil || w.Since == 0 && w.Before == 0 && w.MaxSize == 0
+}
+
+// Window returns the window last recorded in the archive, or nil.
+func (db *DB) Window() *Window {
+	defer db.mut.Unlock()
+	db.mut.Lock()
+	return db.window
+}
+
+// SetWindow records the window applied when fetching into the archive.
+func (db *DB) SetWindow(w *Window) error {
+	defer db.mut.Unlock()
+	db.mut.Lock()
+
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if db.header == nil || db.header.Features&FeatureWindows == 0 {
+		return ErrNoWindows
+	}
+	offs, err := db.fd.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	chain, err := db.writeWindow(db.fd, db.chain, w, db.ad(offs))
+	if err != nil {
+		return err
+	}
+	db.chain = chain
+	db.window = w
+	db.dirty++
+	db.unsigned++
+	return nil
+}
+
+// writeWindow writes a window record and returns the new chain value. In
+// encrypted archives the window is encrypted with the associated data ad,
+// leaving an empty window in the clear to mark the record.
+func (db *DB) writeWindow(w io.Writer, chain []byte, win *Window, ad []byte) ([]byte, error) {
+	env := &Envelope{Window: win}
+	if db.aead != nil {
+		env = &Envelope{Window: &Window{}}
+		var err error
+		env.Nonce, env.Data, err = db.sealMessage(win, ad)
+		if err != nil {
+			return nil, err
+		}
+	}
+	bs, err := proto.Marshal(env)
+	if err != nil {
+		return nil, err
+	}
+	return writeChained(w, chain, bs)
+}
+
+// windowRecord returns the window held by a control record.
+func (db *DB) windowRecord(env *Envelope, ad []byte) (*Window, error) {
+	if env.Nonce == nil {
+		return env.Window, nil
+	}
+	win := new(Window)
+	if err := db.openMessage(env, ad, win); err != nil {
+		return nil, fmt.Errorf("window: %w", err)
+	}
+	return win, nil
+}
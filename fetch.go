@@ -0,0 +1,940 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/calmh/imapchive/db"
+	"github.com/calmh/imapchive/query"
+	"github.com/mxk/go-imap/imap"
+	"google.golang.org/protobuf/proto"
+)
+
+var progress struct {
+	toScan  int64
+	scanned int64
+	fetched int64
+	labels  int64
+	failed  int64
+}
+
+// fetchResult summarises the fetching of a mailbox.
+type fetchResult struct {
+	Mailbox string
+	Scanned int64
+	Fetched int64
+	Labels  int64    // messages with updated labels
+	Failed  []uint32 // messages that could not be fetched
+	ScanErr error    // set if scanning for new messages stopped early
+	Err     error    // set if the archive could not be opened, written or closed
+
+	Duration     time.Duration
+	ArchiveBytes int64 // size of the archive afterwards
+
+	mut     sync.Mutex
+	metrics *mailboxMetrics
+}
+
+func (r *fetchResult) fail(uid uint32) {
+	r.mut.Lock()
+	r.Failed = append(r.Failed, uid)
+	r.mut.Unlock()
+	atomic.AddInt64(&progress.failed, 1)
+	r.metrics.errors.Inc()
+	r.metrics.queue.Dec()
+}
+
+// Complete reports whether all new messages were fetched.
+func (r *fetchResult) Complete() bool {
+	return r.Err == nil && r.ScanErr == nil && len(r.Failed) == 0
+}
+
+// Status is "complete" if all new messages were fetched, "failed" if the
+// mailbox or its archive could not be read at all, and otherwise
+// "partial".
+func (r *fetchResult) Status() string {
+	switch {
+	case r.Complete():
+		return statusComplete
+	case r.Err != nil, r.ScanErr != nil && r.Scanned == 0:
+		return statusFailed
+	default:
+		return statusPartial
+	}
+}
+
+func (r *fetchResult) String() string {
+	s := fmt.Sprintf("%s: %d scanned, %d fetched, %d label updates", r.Mailbox, r.Scanned, r.Fetched, r.Labels)
+	if len(r.Failed) > 0 {
+		s += fmt.Sprintf(", %d failed (UIDs %s)", len(r.Failed), uidList(r.Failed, 10))
+	}
+	if r.ScanErr != nil {
+		s += fmt.Sprintf(", scan incomplete: %v", r.ScanErr)
+	}
+	if r.Err != nil {
+		s += fmt.Sprintf(", %v", r.Err)
+	}
+	return s
+}
+
+// uidList formats up to max UIDs for display.
+func uidList(uids []uint32, max int) string {
+	var parts []string
+	for i, uid := range uids {
+		if i == max {
+			parts = append(parts, fmt.Sprintf("and %d more", len(uids)-max))
+			break
+		}
+		parts = append(parts, fmt.Sprint(uid))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// fetcher fetches new messages from a mailbox into an archive.
+type fetcher struct {
+	acc     *account
+	mailbox string
+	dir     string // holding the archive
+	db      *db.DB
+	res     *fetchResult
+	workers int32 // workers still running
+	metrics *mailboxMetrics
+	dryRun  bool       // only count what would change
+	window  *db.Window // restricts the new messages, if set
+	highest uint32     // the highest UID scanned
+	// uidValidity is the UIDVALIDITY of the mailbox, which the scanned
+	// UIDs belong to.
+	uidValidity uint32
+}
+
+// errNoMessage is the error for a message the server returns no data for,
+// which happens when it has been removed since the scan.
+var errNoMessage = errors.New("no such message")
+
+// fetchMailbox fetches new messages and label changes from a mailbox into
+// its archive in dir. Connection problems are retried; messages that
+// cannot be fetched are left for the next run and listed in the result.
+func fetchMailbox(acc *account, mailbox, dir string, opts db.Options) (*fetchResult, error) {
+	start := time.Now()
+	log.Println("Opening archive")
+	dbName := archiveFile(dir, mailbox)
+	opts.Source = &db.Source{
+		Server:  acc.Server,
+		Account: acc.Email,
+		Mailbox: mailbox,
+	}
+	db, err := db.Open(dbName, opts)
+	if err != nil {
+		return nil, fmt.Errorf("open archive: %w", err)
+	}
+	defer db.Close()
+
+	resetProgress()
+
+	m := newMailboxMetrics(acc, mailbox)
+	m.queue.Set(0)
+	f := &fetcher{
+		acc:     acc,
+		mailbox: mailbox,
+		dir:     dir,
+		db:      db,
+		res:     &fetchResult{Mailbox: mailbox, metrics: m},
+		workers: int32(acc.Concurrency),
+		metrics: m,
+	}
+	archiveSize := func() {
+		if fi, err := os.Stat(dbName); err == nil {
+			f.res.ArchiveBytes = fi.Size()
+			m.archiveSize.Set(float64(fi.Size()))
+		}
+	}
+	archiveSize()
+	f.useWindow()
+
+	log.Printf("Have %d messages", db.Size())
+	uids := f.findNewUIDs()
+
+	var wg sync.WaitGroup
+	for i := 1; i <= acc.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			f.fetchAndStore(uids)
+			wg.Done()
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(10 * time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				log.Printf("%d of %d scanned, %d fetched, %d labelupdated, %d failed",
+					atomic.LoadInt64(&progress.scanned), atomic.LoadInt64(&progress.toScan),
+					atomic.LoadInt64(&progress.fetched), atomic.LoadInt64(&progress.labels),
+					atomic.LoadInt64(&progress.failed))
+				archiveSize()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(done)
+
+	f.res.Scanned = atomic.LoadInt64(&progress.scanned)
+	f.res.Fetched = atomic.LoadInt64(&progress.fetched)
+	f.res.Labels = atomic.LoadInt64(&progress.labels)
+	sort.Slice(f.res.Failed, func(a, b int) bool { return f.res.Failed[a] < f.res.Failed[b] })
+
+	// Record how far the mailbox was scanned, so that the next run
+	// searches only above it and retries the messages that failed.
+	if f.res.ScanErr == nil && f.res.Err == nil {
+		if err := db.SetScanState(f.scanState()); err != nil {
+			log.Println("Recording scan:", err)
+		}
+	}
+
+	// Record the window, so that later runs apply it too, once everything
+	// in it has been fetched.
+	if f.res.Complete() && !sameWindow(f.window, db.Window()) {
+		if err := db.SetWindow(f.window); err != nil {
+			log.Println("Recording window:", err)
+		}
+	}
+
+	err = db.WriteClose()
+	archiveSize()
+	f.res.Duration = time.Since(start)
+	if err != nil {
+		if f.res.Err != nil {
+			// Keep the reason the fetch was aborted.
+			return f.res, fmt.Errorf("%w; close archive: %w", f.res.Err, err)
+		}
+		return f.res, fmt.Errorf("close archive: %w", err)
+	}
+	m.queue.Set(0)
+	if f.res.Complete() {
+		m.lastSuccess.SetToCurrentTime()
+	}
+	recordHealth(acc, f.res)
+	return f.res, nil
+}
+
+func resetProgress() {
+	atomic.StoreInt64(&progress.toScan, 0)
+	atomic.StoreInt64(&progress.scanned, 0)
+	atomic.StoreInt64(&progress.fetched, 0)
+	atomic.StoreInt64(&progress.labels, 0)
+	atomic.StoreInt64(&progress.failed, 0)
+}
+
+// dryRunResult is what fetching a mailbox would do.
+type dryRunResult struct {
+	Mailbox string
+	Scanned int64
+	New     int64 // messages that would be fetched
+	Bytes   int64 // their total size, as reported by the server
+	Labels  int64 // messages whose labels would be updated
+	ScanErr error // set if scanning for new messages stopped early
+}
+
+func (r *dryRunResult) String() string {
+	s := fmt.Sprintf("%s: %d scanned, would fetch %d messages (%d bytes) and update labels of %d",
+		r.Mailbox, r.Scanned, r.New, r.Bytes, r.Labels)
+	if r.ScanErr != nil {
+		s += fmt.Sprintf(", scan incomplete: %v", r.ScanErr)
+	}
+	return s
+}
+
+// dryRunMailbox scans a mailbox like fetchMailbox, without fetching
+// messages or writing anything to the archive.
+func dryRunMailbox(acc *account, mailbox, dir string, opts db.Options) (*dryRunResult, error) {
+	log.Println("Opening archive")
+	opts.ReadOnly = true
+	db, err := db.Open(archiveFile(dir, mailbox), opts)
+	if err != nil {
+		return nil, fmt.Errorf("open archive: %w", err)
+	}
+	defer db.Close()
+
+	resetProgress()
+
+	m := newMailboxMetrics(acc, mailbox)
+	f := &fetcher{
+		acc:     acc,
+		mailbox: mailbox,
+		dir:     dir,
+		db:      db,
+		res:     &fetchResult{Mailbox: mailbox, metrics: m},
+		metrics: m,
+		dryRun:  true,
+	}
+	f.useWindow()
+
+	log.Printf("Have %d messages", db.Size())
+	res := &dryRunResult{Mailbox: mailbox}
+	for msg := range f.findNewUIDs() {
+		m.queue.Dec()
+		res.New++
+		res.Bytes += int64(msg.Size)
+	}
+	res.Scanned = atomic.LoadInt64(&progress.scanned)
+	res.Labels = atomic.LoadInt64(&progress.labels)
+	res.ScanErr = f.res.ScanErr
+	return res, nil
+}
+
+// useWindow sets the window to apply: the account's, or else the one
+// recorded in the archive.
+func (f *fetcher) useWindow() {
+	f.window = f.acc.window
+	if f.window == nil {
+		f.window = f.db.Window()
+	}
+	if !f.window.IsZero() {
+		log.Printf("Fetching only messages %s", formatWindow(f.window))
+	}
+}
+
+// sameWindow reports whether two windows restrict the same messages.
+func sameWindow(a, b *db.Window) bool {
+	return a.IsZero() && b.IsZero() || proto.Equal(a, b)
+}
+
+// parseWindow returns the window for the --since, --before and --max-size
+// options, with dates as YYYY-MM-DD. Empty strings do not restrict.
+func parseWindow(since, before, maxSize string) (*db.Window, error) {
+	w := new(db.Window)
+	for _, d := range []struct {
+		s string
+		v *int64
+	}{{since, &w.Since}, {before, &w.Before}} {
+		if d.s == "" {
+			continue
+		}
+		t, err := time.Parse(time.DateOnly, d.s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid date %q", d.s)
+		}
+		*d.v = t.Unix()
+	}
+	if maxSize != "" {
+		n, err := query.ParseSize(maxSize)
+		if err != nil || n <= 0 || n > math.MaxUint32 {
+			return nil, fmt.Errorf("invalid size %q", maxSize)
+		}
+		w.MaxSize = uint32(n)
+	}
+	return w, nil
+}
+
+// formatWindow describes a window for logging.
+func formatWindow(w *db.Window) string {
+	var parts []string
+	if w.Since != 0 {
+		parts = append(parts, "since "+time.Unix(w.Since, 0).UTC().Format(time.DateOnly))
+	}
+	if w.Before != 0 {
+		parts = append(parts, "before "+time.Unix(w.Before, 0).UTC().Format(time.DateOnly))
+	}
+	if w.MaxSize != 0 {
+		parts = append(parts, fmt.Sprintf("of up to %d bytes", w.MaxSize))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// archiveFile returns the name of the archive for a mailbox in dir.
+func archiveFile(dir, mailbox string) string {
+	return filepath.Join(dir, strings.Replace(mailbox, "/", "_", -1)+extension)
+}
+
+func (f *fetcher) connect() (*IMAPClient, error) {
+	return connect(f.acc, f.mailbox, f.acc.Retries)
+}
+
+// connect connects to the server and selects the mailbox, if given,
+// retrying with backoff. The server refusing the login or the mailbox, or
+// not opening it read-only in safe mode, is not retried.
+func connect(acc *account, mailbox string, retries int) (*IMAPClient, error) {
+	for attempt := 0; ; attempt++ {
+		client, err := Client(acc, mailbox)
+		if err == nil {
+			return client, nil
+		}
+		var re imap.ResponseError
+		if attempt >= retries || errors.As(err, &re) || errors.Is(err, errNotReadOnly) {
+			return nil, err
+		}
+		delay := backoff(attempt)
+		log.Printf("Failed to connect to server, retrying in %v: %v", delay, err)
+		time.Sleep(delay)
+	}
+}
+
+// backoff returns the time to wait before retry number attempt: doubling
+// from one second up to a minute, with some jitter to keep parallel
+// workers from retrying in lockstep.
+func backoff(attempt int) time.Duration {
+	d := time.Minute
+	if attempt < 6 {
+		d = time.Second << attempt
+	}
+	return d + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// connectionLost reports whether the error means the connection must be
+// reestablished, as opposed to the server refusing the command.
+func connectionLost(client *IMAPClient, err error) bool {
+	var re imap.ResponseError
+	return client.State() == imap.Closed || !errors.As(err, &re)
+}
+
+// scanFrom returns where scanning the mailbox resumes, given the state
+// recorded by earlier runs: the highest UID scanned and the UIDs that
+// failed. Without a record, with --rescan, or when the mailbox has a
+// different UIDVALIDITY, and so the recorded UIDs may be those of other
+// messages, it is the start of the mailbox. Rewindow is set when the
+// UIDs up to highest were scanned within another window than the given
+// one, and must be searched again.
+func scanFrom(scan *db.Scan, uidValidity uint32, window *db.Window, rescan bool) (highest uint32, failed []uint32, rewindow bool) {
+	if scan == nil || rescan || scan.UidValidity != uidValidity {
+		return 0, nil, false
+	}
+	return scan.Highest, scan.Failed, scan.Highest > 0 && !sameWindow(window, scan.Window)
+}
+
+// scanState returns the scan state to record for the next run.
+func (f *fetcher) scanState() *db.Scan {
+	return &db.Scan{Highest: f.highest, Failed: f.res.Failed, UidValidity: f.uidValidity, Window: f.window}
+}
+
+// findNewUIDs scans the mailbox and returns the messages to fetch. Three
+// searches with UID SEARCH find them: new messages, above the highest UID
+// scanned by earlier runs; messages that failed in earlier runs; and,
+// when earlier runs scanned within another window, the messages below
+// that UID that are within this one. Without a record of earlier runs, or with
+// --rescan, the whole mailbox is searched. The sizes of the messages not
+// yet archived are then fetched with UID FETCH. With Gmail labels, the
+// labels of archived messages are fetched as well and updated in the
+// archive.
+func (f *fetcher) findNewUIDs() chan msg {
+	const step = 1000
+	out := make(chan msg, step)
+	go func() {
+		defer close(out)
+
+		client, err := f.connect()
+		if err != nil {
+			f.scanFailed(err)
+			return
+		}
+		defer func() { client.Logout(time.Second) }()
+
+		// try runs a command, retrying and reconnecting as needed. It
+		// returns false when giving up.
+		failures := 0
+		try := func(fn func() error) bool {
+			for {
+				err := fn()
+				if err == nil {
+					failures = 0
+					return true
+				}
+				f.acc.limits.throttled(err)
+				if failures >= f.acc.Retries {
+					f.scanFailed(err)
+					return false
+				}
+				delay := backoff(failures)
+				failures++
+				f.metrics.retries.Inc()
+				log.Printf("Failed to search for messages, retrying in %v: %v", delay, err)
+				time.Sleep(delay)
+				if connectionLost(client, err) {
+					client.Logout(0)
+					if client, err = f.connect(); err != nil {
+						f.scanFailed(err)
+						return false
+					}
+				}
+			}
+		}
+		search := func(set *imap.SeqSet) ([]uint32, bool) {
+			var uids []uint32
+			ok := try(func() (err error) { uids, err = client.Search(set, f.window); return })
+			return uids, ok
+		}
+
+		f.uidValidity = client.Mailbox.UIDValidity
+		state := f.db.ScanState()
+		if state != nil && state.UidValidity != 0 && state.UidValidity != f.uidValidity {
+			log.Printf("UIDVALIDITY changed from %d to %d, scanning the whole mailbox. Archived messages are kept by UID, so new messages that reuse the UID of one are not fetched; archive into a new directory for a complete copy.",
+				state.UidValidity, f.uidValidity)
+		}
+		highest, failed, rewindow := scanFrom(state, f.uidValidity, f.window, f.acc.rescan)
+
+		above := &imap.SeqSet{}
+		above.AddRange(highest+1, 0)
+		uids, ok := search(above)
+		if !ok {
+			return
+		}
+		f.highest = highest
+		var fresh []uint32
+		for _, uid := range uids {
+			if uid > highest {
+				fresh = append(fresh, uid)
+				f.highest = max(f.highest, uid)
+			}
+		}
+
+		var retry, extended []uint32
+		if len(failed) > 0 {
+			set := &imap.SeqSet{}
+			set.AddNum(failed...)
+			if retry, ok = search(set); !ok {
+				return
+			}
+		}
+		if rewindow {
+			set := &imap.SeqSet{}
+			set.AddRange(1, highest)
+			if extended, ok = search(set); !ok {
+				return
+			}
+		}
+
+		todo := make(map[uint32]bool)
+		missing := func(uids []uint32) int {
+			n := 0
+			for _, uid := range uids {
+				if !f.db.Have(uid) && !todo[uid] {
+					todo[uid] = true
+					n++
+				}
+			}
+			return n
+		}
+		log.Printf("Found %d new messages above UID %d, %d failed earlier and %d within the changed window",
+			missing(fresh), highest, missing(retry), missing(extended))
+
+		gmail := client.Gmail()
+		var scan []uint32
+		for uid := range todo {
+			scan = append(scan, uid)
+		}
+		if gmail {
+			scan = append(scan, f.db.MessageIDs()...)
+		}
+		sort.Slice(scan, func(a, b int) bool { return scan[a] < scan[b] })
+		atomic.StoreInt64(&progress.toScan, int64(len(scan)))
+
+		for len(scan) > 0 && !f.aborted() {
+			n := min(step, len(scan))
+			var msgs []msg
+			if !try(func() (err error) { msgs, err = client.FetchInfo(scan[:n], gmail); return }) {
+				return
+			}
+			scan = scan[n:]
+			atomic.AddInt64(&progress.scanned, int64(len(msgs)))
+			f.metrics.scanned.Add(float64(len(msgs)))
+
+			for _, msg := range msgs {
+				if !f.db.Have(msg.UID) {
+					f.metrics.queue.Inc()
+					out <- msg
+				} else if !sliceEquals(f.db.Labels(msg.UID), msg.Labels) {
+					if !f.dryRun {
+						f.db.SetLabels(msg.UID, msg.Labels)
+					}
+					atomic.AddInt64(&progress.labels, 1)
+					f.metrics.labels.Inc()
+				}
+			}
+		}
+	}()
+
+	return out
+}
+
+// scanFailed records that scanning stopped early.
+func (f *fetcher) scanFailed(err error) {
+	f.res.ScanErr = err
+	f.metrics.errors.Inc()
+}
+
+func sliceEquals(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// maxBatchMessages limits the number of messages in a batch, whatever
+// their size.
+const maxBatchMessages = 500
+
+// largeMessageSize is the size above which a message is fetched in parts
+// and stored in chunks, rather than in a batch.
+const largeMessageSize = 16 << 20
+
+// worker fetches messages over one connection, keeping several batches
+// in flight.
+type worker struct {
+	*fetcher
+	msgids   chan msg
+	client   *IMAPClient
+	inflight []*batch
+	retry    []msg // messages to fetch again
+	large    []msg // large messages to fetch in parts
+	attempts map[uint32]int
+	closed   bool // msgids is closed
+}
+
+// batch is a UID FETCH of several messages.
+type batch struct {
+	cmd     *imap.Command
+	pending map[uint32]msg // messages not yet received
+}
+
+// fetchAndStore fetches the messages and writes them to the archive, in
+// batches of up to batchBytes, with up to pipeline batches in flight at
+// once. Messages are written as they arrive. Messages that fail are
+// retried, reconnecting as needed. A worker that cannot reconnect stops;
+// the last one to stop marks the remaining messages as failed, so that
+// the scan does not block.
+func (f *fetcher) fetchAndStore(msgids chan msg) {
+	w := &worker{
+		fetcher:  f,
+		msgids:   msgids,
+		attempts: make(map[uint32]int),
+	}
+	defer func() {
+		if w.client != nil {
+			w.client.Logout(time.Second)
+		}
+	}()
+
+	failures := 0
+	for {
+		if f.aborted() {
+			w.failAll()
+			f.stop(msgids)
+			return
+		}
+		if w.client == nil {
+			var err error
+			if w.client, err = f.connect(); err != nil {
+				log.Println("Giving up on connecting to server:", err)
+				w.failAll()
+				f.stop(msgids)
+				return
+			}
+		}
+
+		err := w.send()
+		if err == nil && len(w.inflight) == 0 && len(w.large) > 0 {
+			// Large messages are fetched on their own, with nothing
+			// else in flight.
+			err = w.fetchLarge()
+			if err == nil {
+				failures = 0
+				continue
+			}
+		} else if err == nil {
+			if len(w.inflight) == 0 {
+				return
+			}
+			err = w.client.Recv(-1)
+		}
+		if w.collect() {
+			failures = 0
+		}
+		if err == nil || f.aborted() {
+			continue
+		}
+
+		// Everything in flight is lost with the connection. Only the
+		// batch being received counts as an attempt; the rest were
+		// never started.
+		var retry []msg
+		for i, b := range w.inflight {
+			for _, m := range b.pending {
+				if i == 0 {
+					w.requeue(m, err)
+				} else {
+					retry = append(retry, m)
+				}
+			}
+		}
+		w.retry = append(retry, w.retry...)
+		w.inflight = nil
+		f.acc.limits.throttled(err)
+		delay := backoff(failures)
+		failures++
+		f.metrics.retries.Inc()
+		log.Printf("Failed to get mail, reconnecting in %v: %v", delay, err)
+		w.client.Logout(0)
+		w.client = nil
+		time.Sleep(delay)
+	}
+}
+
+// send fills the pipeline with new batches.
+func (w *worker) send() error {
+	for len(w.inflight) < w.acc.Pipeline {
+		msgs := w.next(len(w.inflight) == 0 && len(w.large) == 0)
+		if len(msgs) == 0 {
+			return nil
+		}
+		cmd, err := w.client.FetchMessages(msgs)
+		if err != nil {
+			w.retry = append(w.retry, msgs...)
+			return err
+		}
+		b := &batch{cmd: cmd, pending: make(map[uint32]msg, len(msgs))}
+		for _, m := range msgs {
+			b.pending[m.UID] = m
+		}
+		w.inflight = append(w.inflight, b)
+	}
+	return nil
+}
+
+// next returns the messages for the next batch: those to retry first,
+// then new ones, up to the byte budget. Only the first message is waited
+// for, and only if wait is set. Large messages are set aside, to be
+// fetched on their own.
+func (w *worker) next(wait bool) []msg {
+	var msgs []msg
+	var size int64
+	for len(msgs) < maxBatchMessages && (len(msgs) == 0 || size < w.acc.batchBytes) {
+		var m msg
+		if len(w.retry) > 0 {
+			m, w.retry = w.retry[0], w.retry[1:]
+		} else if w.closed {
+			break
+		} else if wait && len(msgs) == 0 && len(w.large) == 0 {
+			var ok bool
+			if m, ok = <-w.msgids; !ok {
+				w.closed = true
+				break
+			}
+		} else {
+			var ok bool
+			select {
+			case m, ok = <-w.msgids:
+				if !ok {
+					w.closed = true
+				}
+			default:
+			}
+			if !ok {
+				break
+			}
+		}
+		if m.Size > largeMessageSize {
+			w.large = append(w.large, m)
+			continue
+		}
+		msgs = append(msgs, m)
+		size += int64(m.Size)
+	}
+	return msgs
+}
+
+// fetchLarge fetches the first of the large messages in parts into a
+// temporary file next to the archive, and streams it from there into the
+// archive, so that it is never held in memory as a whole. An error is
+// returned only if the connection was lost; failing to store the message
+// aborts the fetch.
+func (w *worker) fetchLarge() error {
+	m := w.large[0]
+	w.large = w.large[1:]
+
+	tmp, err := os.CreateTemp(w.dir, ".imapchive-*.tmp")
+	if err != nil {
+		w.abort(m, err)
+		return nil
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	err = w.client.FetchParts(m.UID, tmp)
+	var pe *os.PathError
+	switch {
+	case errors.As(err, &pe):
+		w.abort(m, err)
+		return nil
+	case errors.Is(err, errNoMessage):
+		log.Printf("Failed to get mail %d, skipping: %v", m.UID, err)
+		w.res.fail(m.UID)
+		return nil
+	case err != nil:
+		w.acc.limits.throttled(err)
+		w.requeue(m, err)
+		if connectionLost(w.client, err) {
+			return err
+		}
+		return nil
+	}
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		err = w.db.WriteMessageStream(m.UID, bufio.NewReader(tmp), m.Labels, m.ThreadID)
+	}
+	if err != nil {
+		w.abort(m, err)
+		return nil
+	}
+	w.stored(m.UID, size)
+	return nil
+}
+
+// collect writes the messages received so far to the archive and handles
+// completed batches. It reports whether any message was written.
+func (w *worker) collect() bool {
+	written := false
+	running := w.inflight[:0]
+	for _, b := range w.inflight {
+		for _, rsp := range b.cmd.Data {
+			uid, body, ok := messageBody(rsp)
+			if !ok {
+				continue
+			}
+			// Responses are matched by UID, as with several commands in
+			// flight they may be attributed to another one.
+			for _, ob := range w.inflight {
+				if m, ok := ob.pending[uid]; ok {
+					delete(ob.pending, uid)
+					if err := w.db.WriteMessage(uid, body, m.Labels, m.ThreadID); err != nil {
+						// The rest of the messages held are failed by
+						// the caller.
+						w.abort(m, err)
+						return written
+					}
+					w.stored(uid, int64(len(body)))
+					written = true
+					break
+				}
+			}
+		}
+		b.cmd.Data = nil
+
+		if b.cmd.InProgress() {
+			running = append(running, b)
+			continue
+		}
+		_, err := b.cmd.Result(imap.OK)
+		if errors.Is(err, imap.ErrAborted) {
+			// The connection was lost; handled by the caller.
+			running = append(running, b)
+			continue
+		}
+		w.acc.limits.throttled(err)
+		for _, m := range b.pending {
+			if err != nil {
+				w.requeue(m, err)
+			} else {
+				// The server had nothing for the message, which means
+				// it has been removed since the scan.
+				log.Printf("Failed to get mail %d, skipping: %v", m.UID, errNoMessage)
+				w.res.fail(m.UID)
+			}
+		}
+	}
+	w.inflight = running
+	return written
+}
+
+// abort fails the message and stops fetching the mailbox, after an error
+// writing to the disk, which retrying would not help with.
+func (w *worker) abort(m msg, err error) {
+	log.Println("Failed to store message, aborting:", err)
+	w.res.fail(m.UID)
+	w.res.mut.Lock()
+	if w.res.Err == nil {
+		w.res.Err = fmt.Errorf("store message %d: %w", m.UID, err)
+	}
+	w.res.mut.Unlock()
+}
+
+// aborted reports whether fetching the mailbox was aborted.
+func (f *fetcher) aborted() bool {
+	f.res.mut.Lock()
+	defer f.res.mut.Unlock()
+	return f.res.Err != nil
+}
+
+// stored counts a message written to the archive.
+func (w *worker) stored(uid uint32, size int64) {
+	atomic.AddInt64(&progress.fetched, 1)
+	w.metrics.fetched.Inc()
+	w.metrics.bytes.Add(float64(size))
+	w.metrics.queue.Dec()
+}
+
+// requeue schedules the message to be fetched again, unless it has been
+// retried enough.
+func (w *worker) requeue(m msg, err error) {
+	w.attempts[m.UID]++
+	if w.attempts[m.UID] > w.acc.Retries {
+		log.Printf("Failed to get mail %d, skipping: %v", m.UID, err)
+		w.res.fail(m.UID)
+		return
+	}
+	w.metrics.retries.Inc()
+	w.retry = append(w.retry, m)
+}
+
+// failAll marks every message the worker holds as failed: those in
+// flight, to retry and set aside as large.
+func (w *worker) failAll() {
+	for _, b := range w.inflight {
+		for _, m := range b.pending {
+			w.res.fail(m.UID)
+		}
+	}
+	for _, m := range w.retry {
+		w.res.fail(m.UID)
+	}
+	for _, m := range w.large {
+		w.res.fail(m.UID)
+	}
+	w.inflight, w.retry, w.large = nil, nil, nil
+}
+
+// stop is called when a worker gives up. If it was the last one, the rest
+// of the messages are drained and marked as failed.
+func (f *fetcher) stop(msgids chan msg) {
+	if atomic.AddInt32(&f.workers, -1) > 0 {
+		return
+	}
+	for msgid := range msgids {
+		f.res.fail(msgid.UID)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/calmh/imapchive/db"
+)
+
+func TestScanFrom(t *testing.T) {
+	window := &db.Window{Since: 1546300800}
+	scanned := &db.Scan{Highest: 500, Failed: []uint32{42, 97}, UidValidity: 7, Window: window}
+	cases := []struct {
+		name        string
+		scan        *db.Scan
+		uidValidity uint32
+		window      *db.Window
+		rescan      bool
+		highest     uint32
+		failed      string
+		rewindow    bool
+	}{
+		{name: "resumed", scan: scanned, uidValidity: 7, window: window, highest: 500, failed: "[42 97]"},
+		{name: "no record", uidValidity: 7, failed: "[]"},
+		{name: "rescan", scan: scanned, uidValidity: 7, window: window, rescan: true, failed: "[]"},
+		{name: "UIDVALIDITY changed", scan: scanned, uidValidity: 8, window: window, failed: "[]"},
+		{name: "UIDVALIDITY not recorded", scan: &db.Scan{Highest: 500}, uidValidity: 7, failed: "[]"},
+		// A run with a window given on the command line advances the
+		// scan without changing the window recorded in the archive; the
+		// next run searches what that window left out.
+		{name: "window changed", scan: scanned, uidValidity: 7, highest: 500, failed: "[42 97]", rewindow: true},
+		{name: "window given", scan: &db.Scan{Highest: 500, UidValidity: 7}, uidValidity: 7, window: window, highest: 500, failed: "[]", rewindow: true},
+		{name: "zero window", scan: &db.Scan{Highest: 500, UidValidity: 7, Window: &db.Window{}}, uidValidity: 7, highest: 500, failed: "[]"},
+		{name: "nothing scanned", scan: &db.Scan{UidValidity: 7}, uidValidity: 7, window: window, failed: "[]"},
+	}
+	for _, tc := range cases {
+		highest, failed, rewindow := scanFrom(tc.scan, tc.uidValidity, tc.window, tc.rescan)
+		if highest != tc.highest || fmt.Sprint(failed) != tc.failed || rewindow != tc.rewindow {
+			t.Errorf("%s: resumed above %d, failed %v, rewindow %v, want %d, %s, %v", tc.name, highest, failed, rewindow, tc.highest, tc.failed, tc.rewindow)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt, base := range []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+		16 * time.Second, 32 * time.Second, time.Minute, time.Minute, time.Minute,
+	} {
+		for i := 0; i < 100; i++ {
+			if d := backoff(attempt); d < base || d >= base+base/2 {
+				t.Fatalf("backoff(%d) = %v, want [%v, %v)", attempt, d, base, base+base/2)
+			}
+		}
+	}
+}
+
+// testWorker returns a worker for an account, with nothing to fetch from.
+func testWorker(acc *account) *worker {
+	metrics := newMailboxMetrics(acc, "INBOX")
+	return &worker{
+		fetcher: &fetcher{
+			acc:     acc,
+			mailbox: "INBOX",
+			res:     &fetchResult{Mailbox: "INBOX", metrics: metrics},
+			metrics: metrics,
+		},
+		attempts: make(map[uint32]int),
+	}
+}
+
+func TestRequeue(t *testing.T) {
+	w := testWorker(&account{Name: "test", Retries: 2})
+	err := errors.New("NO try again")
+	for attempt, want := range []struct {
+		retry  int
+		failed string
+	}{
+		{1, "[]"},
+		{2, "[]"},
+		{2, "[7]"},
+	} {
+		w.requeue(msg{UID: 7}, err)
+		if len(w.retry) != want.retry || fmt.Sprint(w.res.Failed) != want.failed {
+			t.Errorf("attempt %d: %d to retry, failed %v, want %d, %s", attempt+1, len(w.retry), w.res.Failed, want.retry, want.failed)
+		}
+	}
+
+	// Each message has its own attempts.
+	w.requeue(msg{UID: 8}, err)
+	if len(w.retry) != 3 || w.attempts[8] != 1 {
+		t.Errorf("other message: %d to retry, %d attempts", len(w.retry), w.attempts[8])
+	}
+}
+
+func TestNext(t *testing.T) {
+	w := testWorker(&account{Name: "test", batchBytes: 1000})
+	w.msgids = make(chan msg, 10)
+
+	uids := func(msgs []msg) string {
+		var res []uint32
+		for _, m := range msgs {
+			res = append(res, m.UID)
+		}
+		return fmt.Sprint(res)
+	}
+
+	// Messages to retry come first, and a batch is filled up to the
+	// byte budget, the message passing it included.
+	w.retry = []msg{{UID: 1, Size: 100}}
+	for _, m := range []msg{{UID: 2, Size: 500}, {UID: 3, Size: 600}, {UID: 4, Size: 10}, {UID: largeMessageSize, Size: largeMessageSize + 1}, {UID: 5, Size: 10}} {
+		w.msgids <- m
+	}
+	if got := uids(w.next(false)); got != "[1 2 3]" {
+		t.Errorf("first batch %s, want [1 2 3]", got)
+	}
+
+	// Large messages are set aside.
+	if got := uids(w.next(false)); got != "[4 5]" {
+		t.Errorf("second batch %s, want [4 5]", got)
+	}
+	if got := uids(w.large); got != fmt.Sprintf("[%d]", largeMessageSize) {
+		t.Errorf("large messages %s", got)
+	}
+
+	// Without waiting, an empty channel gives an empty batch.
+	if got := w.next(false); len(got) != 0 {
+		t.Errorf("batch %s from an empty channel", uids(got))
+	}
+
+	// A batch of small messages is limited in count.
+	w.acc.batchBytes = 1 << 30
+	for i := 0; i < maxBatchMessages+1; i++ {
+		w.retry = append(w.retry, msg{UID: uint32(100 + i), Size: 1})
+	}
+	if got := w.next(false); len(got) != maxBatchMessages || len(w.retry) != 1 {
+		t.Errorf("batch of %d messages, %d left, want %d and 1", len(got), len(w.retry), maxBatchMessages)
+	}
+	w.retry = nil
+
+	// Waiting blocks for the first message only, and notices the end.
+	w.large = nil
+	go func() {
+		w.msgids <- msg{UID: 6, Size: 10}
+		close(w.msgids)
+	}()
+	if got := uids(w.next(true)); got != "[6]" {
+		t.Errorf("waited for %s, want [6]", got)
+	}
+	if got := w.next(true); len(got) != 0 || !w.closed {
+		t.Errorf("batch %s after the end, closed %v", uids(got), w.closed)
+	}
+}
+
+func TestFailAll(t *testing.T) {
+	w := testWorker(&account{Name: "test"})
+	w.inflight = []*batch{
+		{pending: map[uint32]msg{1: {UID: 1}}},
+		{pending: map[uint32]msg{}},
+	}
+	w.retry = []msg{{UID: 2}, {UID: 3}}
+	w.large = []msg{{UID: 4}}
+
+	w.failAll()
+	failed := slices.Sorted(slices.Values(w.res.Failed))
+	if fmt.Sprint(failed) != "[1 2 3 4]" {
+		t.Errorf("failed %v, want [1 2 3 4]", failed)
+	}
+	if len(w.inflight)+len(w.retry)+len(w.large) != 0 {
+		t.Error("messages still held")
+	}
+	if w.res.Complete() || w.res.Status() != statusPartial {
+		t.Errorf("status %s", w.res.Status())
+	}
+}
+
+func TestParseWindow(t *testing.T) {
+	for _, tc := range []struct {
+		since, before, maxSize string
+		want                   *db.Window
+		format                 string
+	}{
+		{want: &db.Window{}},
+		{since: "2019-01-01", want: &db.Window{Since: 1546300800}, format: "since 2019-01-01"},
+		{before: "2020-02-29", want: &db.Window{Before: 1582934400}, format: "before 2020-02-29"},
+		{maxSize: "10M", want: &db.Window{MaxSize: 10 << 20}, format: "of up to 10485760 bytes"},
+		{since: "2019-01-01", before: "2019-02-01", maxSize: "100k", want: &db.Window{Since: 1546300800, Before: 1548979200, MaxSize: 100 << 10},
+			format: "since 2019-01-01, before 2019-02-01, of up to 102400 bytes"},
+		{since: "2019-13-01"},
+		{before: "yesterday"},
+		{maxSize: "0"},
+		{maxSize: "5G"},
+		{maxSize: "huge"},
+	} {
+		w, err := parseWindow(tc.since, tc.before, tc.maxSize)
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("%q, %q, %q: accepted", tc.since, tc.before, tc.maxSize)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q, %q, %q: %v", tc.since, tc.before, tc.maxSize, err)
+			continue
+		}
+		if !sameWindow(w, tc.want) {
+			t.Errorf("%q, %q, %q: window %v, want %v", tc.since, tc.before, tc.maxSize, w, tc.want)
+		}
+		if got := formatWindow(w); got != tc.format {
+			t.Errorf("%q, %q, %q: formatted %q, want %q", tc.since, tc.before, tc.maxSize, got, tc.format)
+		}
+	}
+}
+
+func TestSameWindow(t *testing.T) {
+	for _, tc := range []struct {
+		a, b *db.Window
+		want bool
+	}{
+		{nil, nil, true},
+		{nil, &db.Window{}, true},
+		{&db.Window{}, &db.Window{}, true},
+		{&db.Window{Since: 1}, &db.Window{Since: 1}, true},
+		{&db.Window{Since: 1}, nil, false},
+		{&db.Window{Since: 1}, &db.Window{Before: 1}, false},
+		{&db.Window{MaxSize: 1}, &db.Window{MaxSize: 2}, false},
+	} {
+		if got := sameWindow(tc.a, tc.b); got != tc.want {
+			t.Errorf("sameWindow(%v, %v) = %v, want %v", tc.a, tc.b, got, tc.want)
+		}
+		if got := sameWindow(tc.b, tc.a); got != tc.want {
+			t.Errorf("sameWindow(%v, %v) = %v, want %v", tc.b, tc.a, got, tc.want)
+		}
+	}
+}
+
+func TestDryRunResult(t *testing.T) {
+	res := &dryRunResult{Mailbox: "INBOX", Scanned: 120, New: 3, Bytes: 4096, Labels: 2}
+	if got, want := res.String(), "INBOX: 120 scanned, would fetch 3 messages (4096 bytes) and update labels of 2"; got != want {
+		t.Errorf("%q, want %q", got, want)
+	}
+	res.ScanErr = errors.New("connection lost")
+	if got := res.String(); !strings.HasSuffix(got, ", scan incomplete: connection lost") {
+		t.Errorf("incomplete scan: %q", got)
+	}
+}
@@ -0,0 +1,346 @@
+package fts
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+const (
+	maxPartSize = 1 << 20  // text read from any one MIME part
+	maxBodySize = 16 << 20 // text read from a message body for display
+	maxDepth    = 10       // nesting of multiparts and attached messages
+)
+
+var wordDecoder = &mime.WordDecoder{
+	CharsetReader: charsetReader,
+}
+
+// DecodeHeader decodes RFC 2047 encoded words in a header value.
+func DecodeHeader(s string) string {
+	dec, err := wordDecoder.DecodeHeader(s)
+	if err != nil {
+		return s
+	}
+	return dec
+}
+
+func charsetReader(charset string, r io.Reader) (io.Reader, error) {
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported charset %q", charset)
+	}
+	return enc.NewDecoder().Reader(r), nil
+}
+
+// Summarize returns the summary of a raw RFC 822 message.
+func Summarize(id uint32, data []byte) *Message {
+	msg := &Message{MessageId: id, Size: int64(len(data))}
+	if m, err := mail.ReadMessage(bytes.NewReader(data)); err == nil {
+		summarize(msg, m.Header)
+	}
+	return msg
+}
+
+func summarize(msg *Message, hdr mail.Header) {
+	msg.Subject = DecodeHeader(hdr.Get("Subject"))
+	msg.From = DecodeHeader(hdr.Get("From"))
+	if date, err := hdr.Date(); err == nil {
+		msg.Date = date.Unix()
+	}
+}
+
+// Extract returns the summary of a raw RFC 822 message, and its
+// searchable text: the decoded headers followed by the text of every
+// text/plain and text/html part.
+func Extract(id uint32, data []byte) (*Message, []string) {
+	return ExtractReader(id, bytes.NewReader(data))
+}
+
+// ExtractReader is like Extract, reading the message from r. Parts other
+// than text are skipped as they are read, so that only the text is held
+// in memory.
+func ExtractReader(id uint32, r io.Reader) (*Message, []string) {
+	msg := &Message{MessageId: id}
+	cr := &countingReader{r: r}
+	defer func() {
+		// The size counts the whole message, however much of it was
+		// parsed.
+		io.Copy(io.Discard, cr)
+		msg.Size = cr.n
+	}()
+
+	m, err := mail.ReadMessage(cr)
+	if err != nil {
+		return msg, nil
+	}
+	summarize(msg, m.Header)
+
+	fields := []string{
+		msg.Subject,
+		msg.From,
+		DecodeHeader(m.Header.Get("To")),
+		DecodeHeader(m.Header.Get("Cc")),
+	}
+	fields = appendPart(fields, m.Header, m.Body, 0)
+	return msg, fields
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// PartHeader is the subset of a MIME header needed to decode a part.
+type PartHeader interface {
+	Get(key string) string
+}
+
+func appendPart(fields []string, hdr PartHeader, body io.Reader, depth int) []string {
+	if depth > maxDepth {
+		return fields
+	}
+
+	mediaType, params, err := mime.ParseMediaType(hdr.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", nil
+	}
+	if disp, _, _ := mime.ParseMediaType(hdr.Get("Content-Disposition")); disp == "attachment" {
+		return fields
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err != nil {
+				return fields
+			}
+			fields = appendPart(fields, p.Header, p, depth+1)
+		}
+
+	case mediaType == "message/rfc822":
+		m, err := mail.ReadMessage(DecodeTransfer(hdr, body))
+		if err != nil {
+			return fields
+		}
+		fields = append(fields, DecodeHeader(m.Header.Get("Subject")), DecodeHeader(m.Header.Get("From")))
+		return appendPart(fields, m.Header, m.Body, depth+1)
+
+	case mediaType == "text/plain", mediaType == "text/html":
+		// Index what could be decoded, even if the part is malformed.
+		text, _ := ReadText(hdr, body, maxPartSize)
+		if mediaType == "text/html" {
+			text = StripHTML(text)
+		}
+		return append(fields, text)
+	}
+
+	return fields
+}
+
+// DecodeTransfer undoes the Content-Transfer-Encoding of a part.
+func DecodeTransfer(hdr PartHeader, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(hdr.Get("Content-Transfer-Encoding"))) {
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	default:
+		return body
+	}
+}
+
+// ReadText reads up to limit bytes of a text part, decoded to UTF-8.
+func ReadText(hdr PartHeader, body io.Reader, limit int64) (string, error) {
+	r := DecodeTransfer(hdr, body)
+	if _, params, err := mime.ParseMediaType(hdr.Get("Content-Type")); err == nil {
+		if cs := params["charset"]; cs != "" && !strings.EqualFold(cs, "utf-8") && !strings.EqualFold(cs, "us-ascii") {
+			if cr, err := charsetReader(cs, r); err == nil {
+				r = cr
+			}
+		}
+	}
+	bs, err := ioutil.ReadAll(io.LimitReader(r, limit))
+	return strings.ToValidUTF8(string(bs), "�"), err
+}
+
+// StripHTML returns the text content of an HTML document, without tags,
+// scripts and styles.
+func StripHTML(s string) string {
+	var out strings.Builder
+	skip := ""
+	for len(s) > 0 {
+		lt := strings.IndexByte(s, '<')
+		if lt < 0 {
+			if skip == "" {
+				out.WriteString(html.UnescapeString(s))
+			}
+			break
+		}
+		if skip == "" {
+			out.WriteString(html.UnescapeString(s[:lt]))
+		}
+		gt := strings.IndexByte(s[lt:], '>')
+		if gt < 0 {
+			break
+		}
+		tag := strings.ToLower(s[lt+1 : lt+gt])
+		name := strings.FieldsFunc(tag, func(r rune) bool { return unicode.IsSpace(r) || r == '/' })
+		switch {
+		case skip != "" && strings.HasPrefix(tag, "/"+skip):
+			skip = ""
+		case skip == "" && len(name) > 0 && (name[0] == "script" || name[0] == "style") && !strings.HasPrefix(tag, "/"):
+			skip = name[0]
+		}
+		out.WriteByte(' ')
+		s = s[lt+gt+1:]
+	}
+	return out.String()
+}
+
+// Body returns the first text/plain and the first text/html part of a raw
+// RFC 822 message, decoded to UTF-8. Attachments and attached messages are
+// not considered.
+func Body(data []byte) (text, html string) {
+	return BodyReader(bytes.NewReader(data))
+}
+
+// BodyReader is like Body, reading the message from r. Other parts are
+// skipped as they are read.
+func BodyReader(r io.Reader) (text, html string) {
+	m, err := mail.ReadMessage(r)
+	if err != nil {
+		return "", ""
+	}
+	findBody(&text, &html, m.Header, m.Body, 0)
+	return text, html
+}
+
+func findBody(text, html *string, hdr PartHeader, body io.Reader, depth int) {
+	if depth > maxDepth {
+		return
+	}
+
+	mediaType, params, err := mime.ParseMediaType(hdr.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", nil
+	}
+	if disp, _, _ := mime.ParseMediaType(hdr.Get("Content-Disposition")); disp == "attachment" {
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err != nil {
+				return
+			}
+			findBody(text, html, p.Header, p, depth+1)
+		}
+
+	case mediaType == "text/plain" && *text == "":
+		*text, _ = ReadText(hdr, body, maxBodySize)
+
+	case mediaType == "text/html" && *html == "":
+		*html, _ = ReadText(hdr, body, maxBodySize)
+	}
+}
+
+// Attachment is a MIME part that is not part of the message text.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte // decoded content
+}
+
+// Attachments returns the attachments of a raw RFC 822 message: parts
+// with an attachment disposition or a file name.
+func Attachments(data []byte) []Attachment {
+	var atts []Attachment
+	WalkAttachments(bytes.NewReader(data), func(a Attachment, content io.Reader) bool {
+		a.Data, _ = ioutil.ReadAll(content)
+		atts = append(atts, a)
+		return true
+	})
+	return atts
+}
+
+// HasAttachment reports whether the raw RFC 822 message read from r has
+// an attachment, reading no further than the first one.
+func HasAttachment(r io.Reader) bool {
+	found := false
+	WalkAttachments(r, func(Attachment, io.Reader) bool {
+		found = true
+		return false
+	})
+	return found
+}
+
+// WalkAttachments calls fn with each attachment of the raw RFC 822
+// message read from r, without its data, and a reader for its decoded
+// content, until fn returns false. The content is read from r as fn
+// reads it, so that attachments are never held in memory.
+func WalkAttachments(r io.Reader, fn func(a Attachment, content io.Reader) bool) {
+	m, err := mail.ReadMessage(r)
+	if err != nil {
+		return
+	}
+	walkAttachments(m.Header, m.Body, 0, fn)
+}
+
+// walkAttachments walks the attachments of a part, returning false if fn
+// stopped the walk.
+func walkAttachments(hdr PartHeader, body io.Reader, depth int, fn func(Attachment, io.Reader) bool) bool {
+	if depth > maxDepth {
+		return true
+	}
+
+	mediaType, params, err := mime.ParseMediaType(hdr.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", nil
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err != nil {
+				return true
+			}
+			if !walkAttachments(p.Header, p, depth+1, fn) {
+				return false
+			}
+		}
+	}
+
+	disp, dparams, _ := mime.ParseMediaType(hdr.Get("Content-Disposition"))
+	filename := DecodeHeader(dparams["filename"])
+	if filename == "" {
+		filename = DecodeHeader(params["name"])
+	}
+	if disp != "attachment" && filename == "" {
+		return true
+	}
+	return fn(Attachment{Filename: filename, ContentType: mediaType}, DecodeTransfer(hdr, body))
+}
@@ -0,0 +1,181 @@
+//go:generate protoc --go_out=. --go_opt=paths=source_relative fts.proto
+
+// Package fts implements a full-text index over archived messages.
+package fts
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	maxTokenLen = 64
+
+	// fieldGap separates the positions of consecutive fields, so that
+	// phrases do not match across them.
+	fieldGap = 100
+)
+
+// Tokenize splits text into lower case words.
+func Tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Builder accumulates messages into a segment.
+type Builder struct {
+	terms    map[string][]*Posting
+	messages []*Message
+}
+
+func NewBuilder() *Builder {
+	return &Builder{
+		terms: make(map[string][]*Posting),
+	}
+}
+
+// Add indexes a raw RFC 822 message.
+func (b *Builder) Add(id uint32, data []byte) {
+	b.AddReader(id, bytes.NewReader(data))
+}
+
+// AddReader indexes a raw RFC 822 message read from r.
+func (b *Builder) AddReader(id uint32, r io.Reader) {
+	msg, fields := ExtractReader(id, r)
+	b.messages = append(b.messages, msg)
+
+	postings := make(map[string]*Posting)
+	pos := uint32(0)
+	for _, field := range fields {
+		for _, tok := range Tokenize(field) {
+			pos++
+			if len(tok) > maxTokenLen {
+				continue
+			}
+			p, ok := postings[tok]
+			if !ok {
+				p = &Posting{MessageId: id}
+				postings[tok] = p
+				b.terms[tok] = append(b.terms[tok], p)
+			}
+			p.Positions = append(p.Positions, pos)
+		}
+		pos += fieldGap
+	}
+}
+
+// Len returns the number of messages added since the last segment.
+func (b *Builder) Len() int {
+	return len(b.messages)
+}
+
+// Segment returns the messages added so far as a segment covering the
+// archive up to offset, and resets the builder.
+func (b *Builder) Segment(offset int64) *Segment {
+	seg := &Segment{
+		ArchiveOffset: offset,
+		Messages:      b.messages,
+	}
+	for term, postings := range b.terms {
+		seg.Terms = append(seg.Terms, &TermPostings{Term: term, Postings: postings})
+	}
+	sort.Slice(seg.Terms, func(a, b int) bool {
+		return seg.Terms[a].Term < seg.Terms[b].Term
+	})
+
+	b.terms = make(map[string][]*Posting)
+	b.messages = nil
+	return seg
+}
+
+// Index is the searchable union of segments.
+type Index struct {
+	terms    map[string][]*Posting
+	messages map[uint32]*Message
+	offset   int64
+}
+
+func NewIndex() *Index {
+	return &Index{
+		terms:    make(map[string][]*Posting),
+		messages: make(map[uint32]*Message),
+	}
+}
+
+// Add merges a segment into the index. Segments must be added in the
+// order they were written.
+func (idx *Index) Add(seg *Segment) {
+	for _, tp := range seg.Terms {
+		idx.terms[tp.Term] = append(idx.terms[tp.Term], tp.Postings...)
+	}
+	for _, msg := range seg.Messages {
+		idx.messages[msg.MessageId] = msg
+	}
+	if seg.ArchiveOffset > idx.offset {
+		idx.offset = seg.ArchiveOffset
+	}
+}
+
+// Offset returns the archive offset up to which messages are indexed.
+func (idx *Index) Offset() int64 {
+	return idx.offset
+}
+
+// Message returns the summary of an indexed message, or nil.
+func (idx *Index) Message(id uint32) *Message {
+	return idx.messages[id]
+}
+
+// Search returns the IDs of the messages matching the query, in
+// increasing order.
+func (idx *Index) Search(q Query) []uint32 {
+	set := q.eval(idx)
+	res := make([]uint32, 0, len(set))
+	for id := range set {
+		res = append(res, id)
+	}
+	sort.Slice(res, func(a, b int) bool { return res[a] < res[b] })
+	return res
+}
+
+// phrase returns the messages containing the terms at consecutive
+// positions.
+func (idx *Index) phrase(terms []string) set {
+	res := make(set)
+	if len(terms) == 0 {
+		return res
+	}
+
+	// Positions of each term, per message. A message indexed more than
+	// once has the positions of its last indexing.
+	positions := make([]map[uint32][]uint32, len(terms))
+	for i, term := range terms {
+		positions[i] = make(map[uint32][]uint32)
+		for _, p := range idx.terms[term] {
+			positions[i][p.MessageId] = p.Positions
+		}
+	}
+
+	for id, first := range positions[0] {
+	start:
+		for _, pos := range first {
+			for i := 1; i < len(terms); i++ {
+				if !containsPos(positions[i][id], pos+uint32(i)) {
+					continue start
+				}
+			}
+			res[id] = struct{}{}
+			break
+		}
+	}
+	return res
+}
+
+func containsPos(ps []uint32, p uint32) bool {
+	i := sort.Search(len(ps), func(i int) bool { return ps[i] >= p })
+	return i < len(ps) && ps[i] == p
+}
@@ -0,0 +1,178 @@
+package fts
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestTokenize(t *testing.T) {
+	cases := []struct {
+		in  string
+		out []string
+	}{
+		{"", nil},
+		{"Hello, World!", []string{"hello", "world"}},
+		{"e-mail a.b@example.com", []string{"e", "mail", "a", "b", "example", "com"}},
+		{"Grüße aus Köln", []string{"grüße", "aus", "köln"}},
+		{"Q3 2019", []string{"q3", "2019"}},
+		{"  \t\r\n ", nil},
+		{"日本語", []string{"日本語"}},
+	}
+	for _, tc := range cases {
+		if got := Tokenize(tc.in); fmt.Sprint(got) != fmt.Sprint(tc.out) {
+			t.Errorf("Tokenize(%q) = %q, want %q", tc.in, got, tc.out)
+		}
+	}
+}
+
+// testIndex returns an index of the messages, written as one segment per
+// message and read back as from the index file.
+func testIndex(t *testing.T, msgs map[uint32]string) *Index {
+	idx := NewIndex()
+	b := NewBuilder()
+	for id := uint32(1); id <= uint32(len(msgs)); id++ {
+		b.Add(id, []byte(msgs[id]))
+		bs, err := proto.Marshal(b.Segment(int64(id) * 100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var seg Segment
+		if err := proto.Unmarshal(bs, &seg); err != nil {
+			t.Fatal(err)
+		}
+		idx.Add(&seg)
+	}
+	return idx
+}
+
+func TestPhrase(t *testing.T) {
+	idx := testIndex(t, map[uint32]string{
+		1: "Subject: Quarterly review\r\nFrom: alice@example.com\r\n\r\nThe budget for the next quarter.\r\n",
+		2: "Subject: Budget\r\nFrom: bob@example.com\r\n\r\nReview of the quarterly budget.\r\n",
+		3: "Subject: quarterly\r\nFrom: carol@example.com\r\n\r\nreview\r\n",
+		4: "Subject: Long\r\n\r\n" + strings.Repeat("x", maxTokenLen+1) + " after\r\n",
+	})
+
+	cases := []struct {
+		phrase string
+		ids    []uint32
+	}{
+		{"budget", []uint32{1, 2}},
+		{"BUDGET", []uint32{1, 2}},
+		{"quarterly review", []uint32{1}},
+		{`"quarterly budget"`, []uint32{2}},
+		{"review quarterly", nil},
+		{"quarterly", []uint32{1, 2, 3}},
+		{"example com", []uint32{1, 2, 3}},
+		{"the budget for", []uint32{1}},
+		{"", nil},
+		{"nothing", nil},
+		// Fields are apart, so phrases do not span them.
+		{"quarterly carol", nil},
+		// Overlong tokens are not indexed but keep their position.
+		{"long after", nil},
+		{"after", []uint32{4}},
+	}
+	for _, tc := range cases {
+		if got := idx.Search(Phrase(tc.phrase)); fmt.Sprint(got) != fmt.Sprint(tc.ids) {
+			t.Errorf("Phrase(%q) = %v, want %v", tc.phrase, got, tc.ids)
+		}
+	}
+
+	if m := idx.Message(2); m == nil || m.Subject != "Budget" || m.From != "bob@example.com" {
+		t.Errorf("summary of 2: %v", m)
+	}
+	if m := idx.Message(5); m != nil {
+		t.Errorf("summary of unindexed message: %v", m)
+	}
+	if idx.Offset() != 400 {
+		t.Errorf("offset %d, want 400", idx.Offset())
+	}
+}
+
+func TestExtract(t *testing.T) {
+	cases := []struct {
+		name    string
+		msg     string
+		subject string
+		want    []string // substrings of the text
+		notWant []string
+	}{
+		{
+			name:    "plain",
+			msg:     "Subject: Hello\r\nFrom: a@example.com\r\nTo: b@example.com\r\nCc: c@example.com\r\n\r\nBody text\r\n",
+			subject: "Hello",
+			want:    []string{"Hello", "a@example.com", "b@example.com", "c@example.com", "Body text"},
+		},
+		{
+			name:    "encoded header",
+			msg:     "Subject: =?UTF-8?B?R3LDvMOfZQ==?=\r\n\r\nx\r\n",
+			subject: "Grüße",
+			want:    []string{"Grüße"},
+		},
+		{
+			name: "quoted-printable latin-1",
+			msg: "Subject: qp\r\nContent-Type: text/plain; charset=iso-8859-1\r\n" +
+				"Content-Transfer-Encoding: quoted-printable\r\n\r\nK=F6ln soft=\r\nbreak\r\n",
+			subject: "qp",
+			want:    []string{"Köln", "softbreak"},
+		},
+		{
+			name: "html and attachment",
+			msg: "Subject: mixed\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" +
+				"--b\r\nContent-Type: text/html\r\n\r\n<p>Visible&amp;text</p><script>hidden()</script>\r\n" +
+				"--b\r\nContent-Type: text/plain\r\nContent-Disposition: attachment\r\n\r\nattached text\r\n" +
+				"--b\r\nContent-Type: text/plain\r\nContent-Transfer-Encoding: base64\r\n\r\nZW5jb2RlZCB0ZXh0\r\n--b--\r\n",
+			subject: "mixed",
+			want:    []string{"Visible&text", "encoded text"},
+			notWant: []string{"hidden", "attached", "<p>"},
+		},
+		{
+			name: "attached message",
+			msg: "Subject: fwd\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" +
+				"--b\r\nContent-Type: message/rfc822\r\n\r\nSubject: inner\r\nFrom: d@example.com\r\n\r\ninner body\r\n--b--\r\n",
+			subject: "fwd",
+			want:    []string{"inner", "d@example.com", "inner body"},
+		},
+		{
+			name: "not a message",
+			msg:  "no header here",
+		},
+	}
+	for _, tc := range cases {
+		msg, fields := Extract(7, []byte(tc.msg))
+		if msg.MessageId != 7 || msg.Subject != tc.subject {
+			t.Errorf("%s: summary %v", tc.name, msg)
+		}
+		text := strings.Join(fields, "\n")
+		for _, w := range tc.want {
+			if !strings.Contains(text, w) {
+				t.Errorf("%s: %q not in %q", tc.name, w, text)
+			}
+		}
+		for _, w := range tc.notWant {
+			if strings.Contains(text, w) {
+				t.Errorf("%s: %q in %q", tc.name, w, text)
+			}
+		}
+	}
+}
+
+func TestStripHTML(t *testing.T) {
+	cases := []struct{ in, out string }{
+		{"plain", "plain"},
+		{"<b>bold</b> &lt;tag&gt;", " bold  <tag>"},
+		{"a<style>p { x }</style>b", "a  b"},
+		{"a<script type=x>alert(1)</script >b", "a  b"},
+		{"a<br/>b", "a b"},
+		{"unterminated <b", "unterminated "},
+	}
+	for _, tc := range cases {
+		if got := StripHTML(tc.in); got != tc.out {
+			t.Errorf("StripHTML(%q) = %q, want %q", tc.in, got, tc.out)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package fts
+
+// A Query selects messages from an index.
+type Query interface {
+	eval(idx *Index) set
+}
+
+type set map[uint32]struct{}
+
+type phraseQuery []string
+
+func (q phraseQuery) eval(idx *Index) set {
+	return idx.phrase(q)
+}
+
+// Phrase returns a query matching messages that contain the words of s in
+// sequence.
+func Phrase(s string) Query {
+	return phraseQuery(Tokenize(s))
+}
@@ -1,38 +1,127 @@
 package main
 
 import (
-	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/calmh/imapchive/db"
 	"github.com/mxk/go-imap/imap"
 )
 
 type IMAPClient struct {
-	imap.Client
+	*imap.Client
+	safe   bool
+	limits *limits
 }
 
-func Client(server, email, password, mailbox string) (*IMAPClient, error) {
-	tlsCfg := tls.Config{
-		InsecureSkipVerify: true,
+// readOnlyCommands are the commands available in safe mode, none of which
+// can alter a mailbox opened read-only. Fetches are further limited to
+// items that do not set \Seen, by FETCH and UID FETCH below.
+var readOnlyCommands = map[string]bool{
+	"CAPABILITY": true,
+	"NOOP":       true,
+	"LOGOUT":     true,
+	"LIST":       true,
+	"LSUB":       true,
+	"STATUS":     true,
+	"FETCH":      true,
+	"SEARCH":     true,
+	"UID FETCH":  true,
+	"UID SEARCH": true,
+}
+
+var errNotReadOnly = errors.New("server did not open the mailbox read-only")
+
+var errUnsafeFetch = errors.New("fetch item would mark messages as read")
+
+// safeFetchItem reports whether fetching the item leaves the \Seen flag
+// alone: bodies only with BODY.PEEK, and data other than bodies.
+func safeFetchItem(item string) bool {
+	item = strings.ToUpper(item)
+	switch item {
+	case "UID", "FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODYSTRUCTURE",
+		"X-GM-LABELS", "X-GM-THRID", "X-GM-MSGID":
+		return true
+	}
+	return strings.HasPrefix(item, "BODY.PEEK[")
+}
+
+// checkFetch returns an error if, in safe mode, any of the items would
+// set \Seen.
+func (client *IMAPClient) checkFetch(items []string) error {
+	if !client.safe {
+		return nil
+	}
+	for _, item := range items {
+		if !safeFetchItem(item) {
+			return fmt.Errorf("%s: %w", item, errUnsafeFetch)
+		}
+	}
+	return nil
+}
+
+// Fetch is the FETCH command, refusing in safe mode items that would set
+// \Seen.
+func (client *IMAPClient) Fetch(set *imap.SeqSet, items ...string) (*imap.Command, error) {
+	if err := client.checkFetch(items); err != nil {
+		return nil, err
+	}
+	return client.Client.Fetch(set, items...)
+}
+
+// UIDFetch is the UID FETCH command, refusing in safe mode items that
+// would set \Seen.
+func (client *IMAPClient) UIDFetch(set *imap.SeqSet, items ...string) (*imap.Command, error) {
+	if err := client.checkFetch(items); err != nil {
+		return nil, err
 	}
+	return client.Client.UIDFetch(set, items...)
+}
 
-	cl, err := imap.DialTLS(server, &tlsCfg)
+func Client(acc *account, mailbox string) (*IMAPClient, error) {
+	tlsCfg, err := acc.tlsConfig()
+	if err != nil {
+		return nil, fmt.Errorf("TLS configuration: %w", err)
+	}
+
+	cl, err := dial(acc.Server, tlsCfg, acc.limits)
 	if err != nil {
 		return nil, fmt.Errorf("connect to server: %w", err)
 	}
 
-	_, err = cl.Login(email, password)
+	_, err = cl.Login(acc.Email, acc.Password)
 	if err != nil {
-		return nil, fmt.Errorf("login as %q: %w", email, err)
+		cl.Logout(0)
+		return nil, fmt.Errorf("login as %q: %w", acc.Email, err)
 	}
 
 	if mailbox != "" {
+		// Select read-only (EXAMINE), so that nothing we do changes the
+		// mailbox.
 		_, err = cl.Select(mailbox, true)
 		if err != nil {
+			cl.Logout(0)
 			return nil, fmt.Errorf("select mailbox %q: %w", mailbox, err)
 		}
+		if acc.Safe && !cl.Mailbox.ReadOnly {
+			cl.Logout(0)
+			return nil, fmt.Errorf("select mailbox %q: %w", mailbox, errNotReadOnly)
+		}
+	}
+
+	if acc.Safe {
+		// Make any command that could alter the mailbox fail in the
+		// client, before it is sent.
+		for name := range cl.CommandConfig {
+			if !readOnlyCommands[name] {
+				delete(cl.CommandConfig, name)
+			}
+		}
 	}
 
 	go func() {
@@ -41,34 +130,90 @@ func Client(server, email, password, mailbox string) (*IMAPClient, error) {
 		cl.Data = nil
 	}()
 
-	return &IMAPClient{*cl}, nil
+	return &IMAPClient{cl, acc.Safe, acc.limits}, nil
 }
 
-func (client *IMAPClient) GetMail(uid uint32) ([]byte, error) {
+// FetchMessages sends a UID FETCH for the bodies of the messages, without
+// waiting for the response. Receive on the client to collect the data.
+// Bodies are fetched with BODY.PEEK[] so that messages are not marked as
+// read, even if the mailbox was not opened read-only.
+func (client *IMAPClient) FetchMessages(msgs []msg) (*imap.Command, error) {
 	var set = &imap.SeqSet{}
-	set.AddNum(uid)
+	for _, m := range msgs {
+		set.AddNum(m.UID)
+	}
 
-	cmd, err := client.UIDFetch(set, "RFC822")
-	if err != nil {
-		return nil, fmt.Errorf("get mail %d: %w", uid, err)
+	if client.safe && !client.Mailbox.ReadOnly {
+		return nil, fmt.Errorf("fetch %s: %w", set, errNotReadOnly)
 	}
-	if len(cmd.Data) == 0 {
-		return nil, fmt.Errorf("no data in mail %d", uid)
+	client.limits.request()
+	cmd, err := client.UIDFetch(set, "BODY.PEEK[]")
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: %w", set, err)
 	}
+	return cmd, nil
+}
+
+// partSize is the amount of a large message fetched per command.
+const partSize = 4 << 20
+
+// FetchParts fetches the body of a message in parts, using
+// BODY.PEEK[]<offset.length>, and writes it to w as it arrives, so that
+// the message is never held in memory as a whole.
+func (client *IMAPClient) FetchParts(uid uint32, w io.Writer) error {
+	var set = &imap.SeqSet{}
+	set.AddNum(uid)
 
-	for cmd.InProgress() {
-		err = client.Recv(-1)
+	if client.safe && !client.Mailbox.ReadOnly {
+		return fmt.Errorf("fetch %d: %w", uid, errNotReadOnly)
+	}
+	for offs := 0; ; offs += partSize {
+		client.limits.request()
+		cmd, err := imap.Wait(client.UIDFetch(set, fmt.Sprintf("BODY.PEEK[]<%d.%d>", offs, partSize)))
 		if err != nil {
-			return nil, fmt.Errorf("get mail %d: %w", uid, err)
+			return fmt.Errorf("fetch %d at %d: %w", uid, offs, err)
+		}
+
+		// The part is returned as BODY[]<offset>.
+		var part []byte
+		found := false
+		for _, rsp := range cmd.Data {
+			info := rsp.MessageInfo()
+			if info == nil || info.UID != uid {
+				continue
+			}
+			if v, ok := info.Attrs[fmt.Sprintf("BODY[]<%d>", offs)]; ok {
+				part, found = imap.AsBytes(v), true
+			}
+		}
+		cmd.Data = nil
+		if !found {
+			return fmt.Errorf("fetch %d at %d: %w", uid, offs, errNoMessage)
 		}
-	}
 
-	resp := cmd.Data[0]
-	body := imap.AsBytes(resp.MessageInfo().Attrs["RFC822"])
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+		if len(part) < partSize {
+			return nil
+		}
+	}
+}
 
-	return body, nil
+// messageBody returns the UID and body from a FETCH response.
+func messageBody(rsp *imap.Response) (uint32, []byte, bool) {
+	info := rsp.MessageInfo()
+	if info == nil {
+		return 0, nil, false
+	}
+	body, ok := info.Attrs["BODY[]"]
+	if !ok {
+		return 0, nil, false
+	}
+	return info.UID, imap.AsBytes(body), true
 }
 
+// Mailboxes returns the names of the mailboxes that can be selected.
 func (client *IMAPClient) Mailboxes() ([]string, error) {
 	cmd, err := imap.Wait(client.Client.List("", "*"))
 	if err != nil {
@@ -77,42 +222,155 @@ func (client *IMAPClient) Mailboxes() ([]string, error) {
 
 	var res []string
 	for _, rsp := range cmd.Data {
-		res = append(res, rsp.MailboxInfo().Name)
+		info := rsp.MailboxInfo()
+		if !noSelect(info.Attrs) {
+			res = append(res, info.Name)
+		}
 	}
 
 	return res, nil
 }
 
+// AllMailbox returns the name of the mailbox holding every message, such
+// as Gmail's "[Gmail]/All Mail", whose name depends on the account's
+// language.
+func (client *IMAPClient) AllMailbox() (string, error) {
+	cmd, err := imap.Wait(client.Client.List("", "*"))
+	if err != nil {
+		return "", fmt.Errorf("mailbox list: %w", err)
+	}
+	for _, rsp := range cmd.Data {
+		info := rsp.MailboxInfo()
+		for attr := range info.Attrs {
+			if strings.EqualFold(attr, `\All`) && !noSelect(info.Attrs) {
+				return info.Name, nil
+			}
+		}
+	}
+	return "", errors.New("server has no All Mail mailbox")
+}
+
+// Gmail reports whether the server supports the Gmail extensions, giving
+// labels and thread IDs.
+func (client *IMAPClient) Gmail() bool {
+	return client.Caps["X-GM-EXT-1"]
+}
+
+// Delimiter returns the hierarchy delimiter used in mailbox names, or the
+// empty string if there is no hierarchy.
+func (client *IMAPClient) Delimiter() (string, error) {
+	cmd, err := imap.Wait(client.Client.List("", ""))
+	if err != nil {
+		return "", fmt.Errorf("mailbox list: %w", err)
+	}
+	for _, rsp := range cmd.Data {
+		if info := rsp.MailboxInfo(); info != nil {
+			return info.Delim, nil
+		}
+	}
+	return "", nil
+}
+
+func noSelect(attrs imap.FlagSet) bool {
+	for attr := range attrs {
+		if strings.EqualFold(attr, `\Noselect`) || strings.EqualFold(attr, `\NonExistent`) {
+			return true
+		}
+	}
+	return false
+}
+
 type msg struct {
-	UID    uint32
-	Labels []string
+	UID      uint32
+	Size     uint32 // RFC822.SIZE
+	Labels   []string
+	ThreadID uint64
 }
 
-func (client *IMAPClient) MsgIDSearch(first, last uint32, withGmailLabels bool) ([]msg, error) {
-	ss := fmt.Sprintf("%d:%d", first, last)
-	seq, _ := imap.NewSeqSet(ss)
-	labels := []string{"UID"}
+// FetchInfo returns the size of each of the messages, and with Gmail
+// labels also their labels and thread IDs, using UID FETCH.
+func (client *IMAPClient) FetchInfo(uids []uint32, withGmailLabels bool) ([]msg, error) {
+	var set = &imap.SeqSet{}
+	set.AddNum(uids...)
+	items := []string{"RFC822.SIZE"}
 	if withGmailLabels {
-		labels = append(labels, "X-GM-LABELS")
+		items = append(items, "X-GM-LABELS", "X-GM-THRID")
 	}
-	cmd, err := imap.Wait(client.Client.Fetch(seq, labels...))
+	client.limits.request()
+	cmd, err := imap.Wait(client.UIDFetch(set, items...))
 	if err != nil {
-		return nil, fmt.Errorf("message id search %q: %w", ss, err)
+		return nil, fmt.Errorf("fetch %s: %w", set, err)
 	}
 
 	var res []msg
 	for _, rsp := range cmd.Data {
-		uid := rsp.MessageInfo().UID
+		info := rsp.MessageInfo()
+		if info == nil || info.Attrs["RFC822.SIZE"] == nil {
+			// Not a response to this command.
+			continue
+		}
 
 		var labels []string
+		var thrid uint64
 		if withGmailLabels {
-			for _, lbl := range rsp.MessageInfo().Attrs["X-GM-LABELS"].([]imap.Field) {
-				labels = append(labels, lbl.(string))
+			lbls, _ := info.Attrs["X-GM-LABELS"].([]imap.Field)
+			for _, lbl := range lbls {
+				labels = append(labels, imap.AsString(lbl))
 			}
 			sort.Strings(labels)
+			thrid = asUint64(info.Attrs["X-GM-THRID"])
 		}
 
-		res = append(res, msg{uid, labels})
+		res = append(res, msg{info.UID, info.Size, labels, thrid})
 	}
+	cmd.Data = nil
 	return res, nil
 }
+
+// Search returns the UIDs in the set of the messages within the window,
+// in order, using UID SEARCH with SINCE, BEFORE and NOT LARGER. A zero
+// window does not restrict. A set ending in * always includes the highest
+// UID in the mailbox, even if it is below the start of the set.
+func (client *IMAPClient) Search(set *imap.SeqSet, w *db.Window) ([]uint32, error) {
+	spec := []imap.Field{"UID", set}
+	if !w.IsZero() {
+		if w.Since != 0 {
+			spec = append(spec, "SINCE", time.Unix(w.Since, 0).UTC().Format(searchDate))
+		}
+		if w.Before != 0 {
+			spec = append(spec, "BEFORE", time.Unix(w.Before, 0).UTC().Format(searchDate))
+		}
+		if w.MaxSize != 0 {
+			spec = append(spec, "NOT", "LARGER", w.MaxSize)
+		}
+	}
+
+	client.limits.request()
+	cmd, err := imap.Wait(client.UIDSearch(spec...))
+	if err != nil {
+		return nil, fmt.Errorf("search %v: %w", spec, err)
+	}
+	var uids []uint32
+	for _, rsp := range cmd.Data {
+		uids = append(uids, rsp.SearchResults()...)
+	}
+	cmd.Data = nil
+	sort.Slice(uids, func(a, b int) bool { return uids[a] < uids[b] })
+	return uids, nil
+}
+
+// searchDate is the date format of SEARCH.
+const searchDate = "2-Jan-2006"
+
+// asUint64 returns the value of a numeric field. The IMAP library parses
+// numbers that do not fit in 32 bits as atoms.
+func asUint64(f imap.Field) uint64 {
+	switch v := f.(type) {
+	case uint32:
+		return uint64(v)
+	case string:
+		n, _ := strconv.ParseUint(v, 10, 64)
+		return n
+	}
+	return 0
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSafeFetchItem(t *testing.T) {
+	cases := []struct {
+		item string
+		safe bool
+	}{
+		{"BODY.PEEK[]", true},
+		{"body.peek[]<0.4096>", true},
+		{"BODY.PEEK[HEADER.FIELDS (MESSAGE-ID)]", true},
+		{"RFC822.SIZE", true},
+		{"FLAGS", true},
+		{"INTERNALDATE", true},
+		{"X-GM-LABELS", true},
+		{"X-GM-THRID", true},
+		{"BODY[]", false},
+		{"BODY[TEXT]", false},
+		{"RFC822", false},
+		{"RFC822.TEXT", false},
+		{"RFC822.HEADER", false},
+	}
+	for _, tc := range cases {
+		if got := safeFetchItem(tc.item); got != tc.safe {
+			t.Errorf("safeFetchItem(%q) = %v, want %v", tc.item, got, tc.safe)
+		}
+	}
+}
+
+func TestCheckFetch(t *testing.T) {
+	safe := &IMAPClient{safe: true}
+	if err := safe.checkFetch([]string{"RFC822.SIZE", "BODY.PEEK[]"}); err != nil {
+		t.Error(err)
+	}
+	if err := safe.checkFetch([]string{"RFC822.SIZE", "BODY[]"}); !errors.Is(err, errUnsafeFetch) {
+		t.Errorf("BODY[] in safe mode: %v", err)
+	}
+	unsafe := &IMAPClient{}
+	if err := unsafe.checkFetch([]string{"BODY[]"}); err != nil {
+		t.Errorf("BODY[] outside safe mode: %v", err)
+	}
+}
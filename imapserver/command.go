@@ -0,0 +1,310 @@
+package imapserver
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maxLiteral limits literals sent by clients. Nothing is ever appended to
+// an archive, so only short strings such as passwords and search terms
+// are expected.
+const maxLiteral = 64 << 10
+
+// maxLine limits the length of a command line.
+const maxLine = 64 << 10
+
+var errLineTooLong = errors.New("command line too long")
+
+// readCommand reads one command line including any literals, asking the
+// client to continue sending each literal.
+func readCommand(br *bufio.Reader, cont func() error) ([]byte, error) {
+	var cmd []byte
+	for {
+		line, err := readLine(br)
+		if err != nil {
+			return nil, err
+		}
+		cmd = append(cmd, line...)
+		if len(cmd) > maxLine {
+			return nil, errLineTooLong
+		}
+
+		n, sync, ok := literalSize(line)
+		if !ok {
+			return cmd, nil
+		}
+		if n > maxLiteral {
+			return nil, fmt.Errorf("literal of %d bytes too large", n)
+		}
+		if sync {
+			if err := cont(); err != nil {
+				return nil, err
+			}
+		}
+		cmd = append(cmd, "\r\n"...)
+		lit := make([]byte, n)
+		if _, err := io.ReadFull(br, lit); err != nil {
+			return nil, err
+		}
+		cmd = append(cmd, lit...)
+	}
+}
+
+func readLine(br *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		frag, isPrefix, err := br.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, frag...)
+		if len(line) > maxLine {
+			return nil, errLineTooLong
+		}
+		if !isPrefix {
+			return line, nil
+		}
+	}
+}
+
+// literalSize returns the size of the literal announced at the end of a
+// line, and whether the client waits for a continuation before sending it.
+func literalSize(line []byte) (int, bool, bool) {
+	if !bytes.HasSuffix(line, []byte("}")) {
+		return 0, false, false
+	}
+	open := bytes.LastIndexByte(line, '{')
+	if open < 0 {
+		return 0, false, false
+	}
+	num := string(line[open+1 : len(line)-1])
+	sync := true
+	if strings.HasSuffix(num, "+") {
+		num, sync = num[:len(num)-1], false
+	}
+	n, err := strconv.Atoi(num)
+	if err != nil || n < 0 {
+		return 0, false, false
+	}
+	return n, sync, true
+}
+
+// A command argument is either a string, for atoms, quoted strings and
+// literals alike, or a []interface{} for a parenthesized list.
+
+type parser struct {
+	s   []byte
+	pos int
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *parser) skipSpace() {
+	for p.pos < len(p.s) && p.s[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// args parses the remaining arguments.
+func (p *parser) args() ([]interface{}, error) {
+	var args []interface{}
+	for {
+		p.skipSpace()
+		if p.eof() {
+			return args, nil
+		}
+		arg, err := p.arg()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+}
+
+func (p *parser) arg() (interface{}, error) {
+	switch p.s[p.pos] {
+	case '(':
+		p.pos++
+		var list []interface{}
+		for {
+			p.skipSpace()
+			if p.eof() {
+				return nil, errors.New("missing )")
+			}
+			if p.s[p.pos] == ')' {
+				p.pos++
+				if list == nil {
+					list = []interface{}{}
+				}
+				return list, nil
+			}
+			arg, err := p.arg()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, arg)
+		}
+
+	case ')':
+		return nil, errors.New("unexpected )")
+
+	case '"':
+		var sb strings.Builder
+		for p.pos++; p.pos < len(p.s); p.pos++ {
+			switch c := p.s[p.pos]; c {
+			case '"':
+				p.pos++
+				return sb.String(), nil
+			case '\\':
+				p.pos++
+				if p.pos < len(p.s) {
+					sb.WriteByte(p.s[p.pos])
+				}
+			default:
+				sb.WriteByte(c)
+			}
+		}
+		return nil, errors.New("unterminated quoted string")
+
+	case '{':
+		end := bytes.Index(p.s[p.pos:], []byte("}\r\n"))
+		if end < 0 {
+			return nil, errors.New("invalid literal")
+		}
+		n, _, ok := literalSize(p.s[p.pos : p.pos+end+1])
+		start := p.pos + end + 3
+		if !ok || start+n > len(p.s) {
+			return nil, errors.New("invalid literal")
+		}
+		p.pos = start + n
+		return string(p.s[start:p.pos]), nil
+	}
+
+	// An atom. Brackets, as in BODY[HEADER.FIELDS (FROM)], may contain
+	// spaces and parentheses.
+	start := p.pos
+	depth := 0
+	for ; p.pos < len(p.s); p.pos++ {
+		c := p.s[p.pos]
+		if depth == 0 && (c == ' ' || c == '(' || c == ')') {
+			break
+		}
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			if depth > 0 {
+				depth--
+			}
+		}
+	}
+	return string(p.s[start:p.pos]), nil
+}
+
+// parseCommand splits a command line into its tag, name and arguments.
+func parseCommand(line []byte) (tag, name string, args []interface{}, err error) {
+	p := &parser{s: line}
+	if p.eof() {
+		return "", "", nil, errors.New("empty command")
+	}
+	t, err := p.arg()
+	if err != nil {
+		return "", "", nil, err
+	}
+	tag, ok := t.(string)
+	if !ok || tag == "" || tag == "*" || tag == "+" {
+		return "", "", nil, errors.New("invalid tag")
+	}
+	p.skipSpace()
+	if p.eof() {
+		return tag, "", nil, errors.New("missing command")
+	}
+	n, err := p.arg()
+	if err != nil {
+		return tag, "", nil, err
+	}
+	name, ok = n.(string)
+	if !ok {
+		return tag, "", nil, errors.New("invalid command")
+	}
+	args, err = p.args()
+	return tag, strings.ToUpper(name), args, err
+}
+
+// stringArg returns argument i as a string.
+func stringArg(args []interface{}, i int) (string, error) {
+	if i >= len(args) {
+		return "", errors.New("missing argument")
+	}
+	s, ok := args[i].(string)
+	if !ok {
+		return "", errors.New("unexpected list")
+	}
+	return s, nil
+}
+
+// seqSet is a parsed sequence set, with "*" already resolved.
+type seqSet []struct{ lo, hi uint32 }
+
+// parseSeqSet parses a sequence set such as "1:4,7,9:*", where "*" stands
+// for max.
+func parseSeqSet(s string, max uint32) (seqSet, error) {
+	var set seqSet
+	for _, r := range strings.Split(s, ",") {
+		a, b, isRange := strings.Cut(r, ":")
+		lo, err := parseSeqNum(a, max)
+		if err != nil {
+			return nil, err
+		}
+		hi := lo
+		if isRange {
+			if hi, err = parseSeqNum(b, max); err != nil {
+				return nil, err
+			}
+		}
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		set = append(set, struct{ lo, hi uint32 }{lo, hi})
+	}
+	return set, nil
+}
+
+func parseSeqNum(s string, max uint32) (uint32, error) {
+	if s == "*" {
+		return max, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid sequence set %q", s)
+	}
+	return uint32(n), nil
+}
+
+func (set seqSet) contains(n uint32) bool {
+	for _, r := range set {
+		if n >= r.lo && n <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+func isSeqSet(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c == '*' || c == ':' || c == ',') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,206 @@
+package imapserver
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	cases := []struct {
+		line      string
+		tag, name string
+		args      string // as formatted by %q, or the error
+		err       bool
+	}{
+		{line: "a1 NOOP", tag: "a1", name: "NOOP", args: "[]"},
+		{line: "a1 noop  ", tag: "a1", name: "NOOP", args: "[]"},
+		{line: `a2 LOGIN alice "se cr\"et\\"`, tag: "a2", name: "LOGIN", args: `["alice" "se cr\"et\\"]`},
+		{line: "a3 login {5}\r\nalice {3}\r\npw\"", tag: "a3", name: "LOGIN", args: `["alice" "pw\""]`},
+		{line: "a4 SELECT {0+}\r\n", tag: "a4", name: "SELECT", args: `[""]`},
+		{line: `a5 LIST "" *`, tag: "a5", name: "LIST", args: `["" "*"]`},
+		{line: "a6 FETCH 1:* (FLAGS BODY.PEEK[HEADER.FIELDS (FROM TO)]<0.100>)", tag: "a6", name: "FETCH",
+			args: `["1:*" ["FLAGS" "BODY.PEEK[HEADER.FIELDS (FROM TO)]<0.100>"]]`},
+		{line: "a7 UID SEARCH OR (FROM a) (TO b) ()", tag: "a7", name: "UID", args: `["SEARCH" "OR" ["FROM" "a"] ["TO" "b"] []]`},
+		{line: "a8 FETCH 1 BODY[", tag: "a8", name: "FETCH", args: `["1" "BODY["]`},
+
+		{line: "", args: "empty command", err: true},
+		{line: " NOOP", args: "invalid tag", err: true},
+		{line: "* NOOP", args: "invalid tag", err: true},
+		{line: "+ NOOP", args: "invalid tag", err: true},
+		{line: "(a) NOOP", args: "invalid tag", err: true},
+		{line: "a1", args: "missing command", err: true},
+		{line: "a1 (NOOP)", args: "invalid command", err: true},
+		{line: "a1 FETCH 1 (FLAGS", args: "missing )", err: true},
+		{line: "a1 FETCH 1 FLAGS)", args: "unexpected )", err: true},
+		{line: `a1 LOGIN "alice`, args: "unterminated quoted string", err: true},
+		{line: "a1 LOGIN {5}\r\nabc", args: "invalid literal", err: true},
+		{line: "a1 LOGIN {x}\r\nabc", args: "invalid literal", err: true},
+		{line: "a1 LOGIN {3}", args: "invalid literal", err: true},
+	}
+	for _, tc := range cases {
+		tag, name, args, err := parseCommand([]byte(tc.line))
+		if tc.err {
+			if err == nil || err.Error() != tc.args {
+				t.Errorf("parseCommand(%q): error %v, want %q", tc.line, err, tc.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseCommand(%q): %v", tc.line, err)
+			continue
+		}
+		if args == nil {
+			args = []interface{}{}
+		}
+		if got := fmt.Sprintf("%q", args); tag != tc.tag || name != tc.name || got != tc.args {
+			t.Errorf("parseCommand(%q) = %q, %q, %s, want %q, %q, %s", tc.line, tag, name, got, tc.tag, tc.name, tc.args)
+		}
+	}
+}
+
+func TestReadCommand(t *testing.T) {
+	cases := []struct {
+		in    string
+		cmd   string // or the start of the error
+		conts int    // continuation requests sent
+		err   bool
+	}{
+		{in: "a1 NOOP\r\n", cmd: "a1 NOOP"},
+		{in: "a1 NOOP\n", cmd: "a1 NOOP"},
+		{in: "a1 LOGIN {5}\r\nalice {2}\r\npw\r\n", cmd: "a1 LOGIN {5}\r\nalice {2}\r\npw", conts: 2},
+		{in: "a1 LOGIN {5+}\r\nalice {2+}\r\npw\r\n", cmd: "a1 LOGIN {5+}\r\nalice {2+}\r\npw"},
+		{in: "a1 LOGIN {5}\r\na\r\nb{}\r\n", cmd: "a1 LOGIN {5}\r\na\r\nb{}", conts: 1},
+		{in: "a1 SEARCH {-1}\r\n", cmd: "a1 SEARCH {-1}"},
+		{in: "a1 LOGIN {10}\r\nshort", cmd: "unexpected EOF", conts: 1, err: true},
+		{in: fmt.Sprintf("a1 LOGIN {%d}\r\n", maxLiteral+1), cmd: "literal of", err: true},
+		{in: "a1 " + strings.Repeat("x", maxLine) + "\r\n", cmd: "command line too long", err: true},
+		{in: "a1 NOOP", cmd: "a1 NOOP"},
+		{in: "", cmd: "EOF", err: true},
+	}
+	for _, tc := range cases {
+		conts := 0
+		cmd, err := readCommand(bufio.NewReaderSize(strings.NewReader(tc.in), 16), func() error {
+			conts++
+			return nil
+		})
+		switch {
+		case tc.err && (err == nil || !strings.HasPrefix(err.Error(), tc.cmd)):
+			t.Errorf("readCommand(%q): error %v, want %q", tc.in, err, tc.cmd)
+		case !tc.err && err != nil:
+			t.Errorf("readCommand(%q): %v", tc.in, err)
+		case !tc.err && string(cmd) != tc.cmd:
+			t.Errorf("readCommand(%q) = %q, want %q", tc.in, cmd, tc.cmd)
+		}
+		if conts != tc.conts {
+			t.Errorf("readCommand(%q): %d continuations, want %d", tc.in, conts, tc.conts)
+		}
+	}
+}
+
+func TestParseSeqSet(t *testing.T) {
+	cases := []struct {
+		s      string
+		max    uint32
+		in     []uint32
+		out    []uint32
+		errors bool
+	}{
+		{s: "1", max: 10, in: []uint32{1}, out: []uint32{2}},
+		{s: "2:4,7", max: 10, in: []uint32{2, 3, 4, 7}, out: []uint32{1, 5, 6, 8}},
+		{s: "4:2", max: 10, in: []uint32{2, 3, 4}, out: []uint32{1, 5}},
+		{s: "8:*", max: 10, in: []uint32{8, 9, 10}, out: []uint32{7, 11}},
+		{s: "*", max: 10, in: []uint32{10}, out: []uint32{9}},
+		{s: "*:20", max: 10, in: []uint32{10, 15, 20}, out: []uint32{9, 21}},
+		{s: "1:*", max: 0, in: []uint32{0, 1}, out: []uint32{2}},
+		{s: "0", errors: true},
+		{s: "1:0", errors: true},
+		{s: "", errors: true},
+		{s: "1,,2", errors: true},
+		{s: "a", errors: true},
+		{s: "4294967296", errors: true},
+	}
+	for _, tc := range cases {
+		set, err := parseSeqSet(tc.s, tc.max)
+		if tc.errors {
+			if err == nil {
+				t.Errorf("parseSeqSet(%q) = %v, want error", tc.s, set)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseSeqSet(%q): %v", tc.s, err)
+			continue
+		}
+		for _, n := range tc.in {
+			if !set.contains(n) {
+				t.Errorf("parseSeqSet(%q, %d) does not contain %d", tc.s, tc.max, n)
+			}
+		}
+		for _, n := range tc.out {
+			if set.contains(n) {
+				t.Errorf("parseSeqSet(%q, %d) contains %d", tc.s, tc.max, n)
+			}
+		}
+	}
+
+	for s, want := range map[string]bool{"1:*": true, "1,3:5": true, "": false, "ALL": false, "1 2": false} {
+		if got := isSeqSet(s); got != want {
+			t.Errorf("isSeqSet(%q) = %v, want %v", s, got, want)
+		}
+	}
+}
+
+func TestParseFetchItems(t *testing.T) {
+	cases := []struct {
+		arg   interface{}
+		items string // or the error
+		err   bool
+	}{
+		{arg: "fast", items: "FLAGS INTERNALDATE RFC822.SIZE"},
+		{arg: "ALL", items: "FLAGS INTERNALDATE RFC822.SIZE ENVELOPE"},
+		{arg: "FULL", items: "FLAGS INTERNALDATE RFC822.SIZE ENVELOPE BODY"},
+		{arg: "uid", items: "UID"},
+		{arg: []interface{}{"UID", "x-gm-labels"}, items: "UID X-GM-LABELS"},
+		{arg: "BODY[]", items: "BODY[]"},
+		{arg: "body.peek[1.MIME]<10.20>", items: "BODY.PEEK[1.MIME]<10.20>"},
+		{arg: "BODY[HEADER.FIELDS (FROM TO)]", items: "BODY[HEADER.FIELDS (FROM TO)]"},
+		{arg: []interface{}{}, items: ""},
+
+		{arg: []interface{}{"FLAGS", []interface{}{"UID"}}, items: "unexpected list in data items", err: true},
+		{arg: "FLAGS[]", items: `invalid data item "FLAGS[]"`, err: true},
+		{arg: "BODY]x[", items: `invalid data item "BODY]x["`, err: true},
+		{arg: "BODY[]<10>", items: `invalid partial "<10>"`, err: true},
+		{arg: "BODY[]<x.1>", items: `invalid partial "<x.1>"`, err: true},
+		{arg: "BODY[]<0.-1>", items: `invalid partial "<0.-1>"`, err: true},
+		{arg: "RFC822.BOGUS", items: `unknown data item "RFC822.BOGUS"`, err: true},
+	}
+	for _, tc := range cases {
+		items, err := parseFetchItems(tc.arg)
+		if tc.err {
+			if err == nil || err.Error() != tc.items {
+				t.Errorf("parseFetchItems(%q): error %v, want %q", tc.arg, err, tc.items)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseFetchItems(%q): %v", tc.arg, err)
+			continue
+		}
+		var names []string
+		for _, it := range items {
+			s := it.name
+			if it.hasSect {
+				s += "[" + it.section + "]"
+			}
+			if it.length >= 0 {
+				s += fmt.Sprintf("<%d.%d>", it.offset, it.length)
+			}
+			names = append(names, s)
+		}
+		if got := strings.Join(names, " "); got != tc.items {
+			t.Errorf("parseFetchItems(%q) = %s, want %s", tc.arg, got, tc.items)
+		}
+	}
+}
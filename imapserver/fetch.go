@@ -0,0 +1,434 @@
+package imapserver
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/calmh/imapchive/db"
+)
+
+// message is a message in the selected mailbox, read from the archive
+// when first needed.
+type message struct {
+	db     *db.DB
+	seq    uint32
+	uid    uint32
+	labels []string
+
+	data []byte
+	root *part
+	err  error
+}
+
+func (m *message) load() error {
+	if m.data == nil && m.err == nil {
+		rec, err := m.db.Message(m.uid)
+		if err != nil {
+			m.err = err
+			return err
+		}
+		m.data = rec.MessageData
+		m.root = parsePart(m.data, "text/plain", 0)
+	}
+	return m.err
+}
+
+// flags derives IMAP flags from Gmail labels. Archived messages have all
+// been read.
+func (m *message) flags() []string {
+	flags := []string{`\Seen`}
+	for _, l := range m.labels {
+		switch l {
+		case `\Starred`:
+			flags = append(flags, `\Flagged`)
+		case `\Draft`:
+			flags = append(flags, `\Draft`)
+		}
+	}
+	return flags
+}
+
+// date returns the date of the message, which also serves as its
+// internal date.
+func (m *message) date() time.Time {
+	if m.load() == nil {
+		if date, err := mail.Header(m.root.hdr).Date(); err == nil {
+			return date
+		}
+	}
+	return time.Unix(0, 0).UTC()
+}
+
+// fetchItem is a requested data item, such as FLAGS or BODY.PEEK[TEXT]<0.100>.
+type fetchItem struct {
+	name    string // upper case, without section and partial
+	section string // between the brackets, as requested
+	hasSect bool
+	offset  int
+	length  int // -1 for no partial
+}
+
+// parseFetchItems parses the data items of a FETCH command, expanding the
+// ALL, FAST and FULL macros.
+func parseFetchItems(arg interface{}) ([]fetchItem, error) {
+	var names []string
+	switch arg := arg.(type) {
+	case string:
+		switch strings.ToUpper(arg) {
+		case "ALL":
+			names = []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE"}
+		case "FAST":
+			names = []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE"}
+		case "FULL":
+			names = []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODY"}
+		default:
+			names = []string{arg}
+		}
+	case []interface{}:
+		for _, a := range arg {
+			s, ok := a.(string)
+			if !ok {
+				return nil, fmt.Errorf("unexpected list in data items")
+			}
+			names = append(names, s)
+		}
+	}
+
+	var items []fetchItem
+	for _, n := range names {
+		it := fetchItem{length: -1}
+		name := n
+		if open := strings.IndexByte(n, '['); open >= 0 {
+			close := strings.LastIndexByte(n, ']')
+			if close < open {
+				return nil, fmt.Errorf("invalid data item %q", n)
+			}
+			name = n[:open]
+			it.section = n[open+1 : close]
+			it.hasSect = true
+			if partial := n[close+1:]; partial != "" {
+				o, l, ok := strings.Cut(strings.Trim(partial, "<>"), ".")
+				var err1, err2 error
+				it.offset, err1 = strconv.Atoi(o)
+				if ok {
+					it.length, err2 = strconv.Atoi(l)
+				}
+				if !ok || err1 != nil || err2 != nil || it.offset < 0 || it.length < 0 {
+					return nil, fmt.Errorf("invalid partial %q", partial)
+				}
+			}
+		}
+		it.name = strings.ToUpper(name)
+
+		switch it.name {
+		case "UID", "FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODYSTRUCTURE", "RFC822", "RFC822.HEADER", "RFC822.TEXT", "X-GM-LABELS":
+			if it.hasSect {
+				return nil, fmt.Errorf("invalid data item %q", n)
+			}
+		case "BODY", "BODY.PEEK":
+		default:
+			return nil, fmt.Errorf("unknown data item %q", n)
+		}
+		items = append(items, it)
+	}
+	return items, nil
+}
+
+// fetch writes the FETCH response for a message.
+func fetch(w *bytes.Buffer, m *message, items []fetchItem, withUID bool) error {
+	fmt.Fprintf(w, "* %d FETCH (", m.seq)
+	first := true
+	sep := func() {
+		if !first {
+			w.WriteByte(' ')
+		}
+		first = false
+	}
+
+	if withUID {
+		sep()
+		fmt.Fprintf(w, "UID %d", m.uid)
+	}
+	for _, it := range items {
+		switch it.name {
+		case "UID":
+			if withUID {
+				continue
+			}
+			sep()
+			fmt.Fprintf(w, "UID %d", m.uid)
+
+		case "FLAGS":
+			sep()
+			fmt.Fprintf(w, "FLAGS (%s)", strings.Join(m.flags(), " "))
+
+		case "X-GM-LABELS":
+			sep()
+			w.WriteString("X-GM-LABELS (")
+			for i, l := range m.labels {
+				if i > 0 {
+					w.WriteByte(' ')
+				}
+				writeString(w, l)
+			}
+			w.WriteByte(')')
+
+		case "INTERNALDATE":
+			sep()
+			fmt.Fprintf(w, `INTERNALDATE "%s"`, m.date().Format("02-Jan-2006 15:04:05 -0700"))
+
+		default:
+			if err := m.load(); err != nil {
+				return err
+			}
+			sep()
+			switch it.name {
+			case "RFC822.SIZE":
+				fmt.Fprintf(w, "RFC822.SIZE %d", len(m.data))
+			case "ENVELOPE":
+				w.WriteString("ENVELOPE ")
+				writeEnvelope(w, m.root.hdr)
+			case "BODYSTRUCTURE":
+				w.WriteString("BODYSTRUCTURE ")
+				writeBodyStructure(w, m.root, true)
+			case "RFC822":
+				w.WriteString("RFC822 ")
+				writeLiteral(w, m.data)
+			case "RFC822.HEADER":
+				w.WriteString("RFC822.HEADER ")
+				writeLiteral(w, m.root.header)
+			case "RFC822.TEXT":
+				w.WriteString("RFC822.TEXT ")
+				writeLiteral(w, m.root.body)
+			case "BODY", "BODY.PEEK":
+				if !it.hasSect {
+					w.WriteString("BODY ")
+					writeBodyStructure(w, m.root, false)
+					continue
+				}
+				data, ok := m.root.section(it.section, m.data)
+				if !ok {
+					data = nil
+				}
+				fmt.Fprintf(w, "BODY[%s]", it.section)
+				if it.length >= 0 {
+					fmt.Fprintf(w, "<%d>", it.offset)
+					if it.offset > len(data) {
+						data = nil
+					} else {
+						data = data[it.offset:]
+						if len(data) > it.length {
+							data = data[:it.length]
+						}
+					}
+				}
+				w.WriteByte(' ')
+				writeLiteral(w, data)
+			}
+		}
+	}
+	w.WriteString(")\r\n")
+	return nil
+}
+
+// writeString writes a string as a quoted string where possible, and as a
+// literal otherwise.
+func writeString(w *bytes.Buffer, s string) {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == '\r' || c == '\n' || c == 0 || c >= 0x80 {
+			writeLiteral(w, []byte(s))
+			return
+		}
+	}
+	w.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == '"' || c == '\\' {
+			w.WriteByte('\\')
+		}
+		w.WriteByte(s[i])
+	}
+	w.WriteByte('"')
+}
+
+// writeNString writes a string, or NIL if it is empty.
+func writeNString(w *bytes.Buffer, s string) {
+	if s == "" {
+		w.WriteString("NIL")
+		return
+	}
+	writeString(w, s)
+}
+
+func writeLiteral(w *bytes.Buffer, b []byte) {
+	fmt.Fprintf(w, "{%d}\r\n", len(b))
+	w.Write(b)
+}
+
+// encodeWord makes a header value safe for a quoted string, encoding
+// anything that is not ASCII as an RFC 2047 encoded word.
+func encodeWord(s string) string {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			if !utf8.ValidString(s) {
+				s = strings.ToValidUTF8(s, "?")
+			}
+			return mime.QEncoding.Encode("utf-8", s)
+		}
+	}
+	return s
+}
+
+func writeEnvelope(w *bytes.Buffer, hdr map[string][]string) {
+	h := mail.Header(hdr)
+	get := func(k string) string {
+		return strings.TrimSpace(h.Get(k))
+	}
+
+	w.WriteByte('(')
+	writeNString(w, encodeWord(get("Date")))
+	w.WriteByte(' ')
+	writeNString(w, encodeWord(get("Subject")))
+
+	from := get("From")
+	for _, k := range []string{"From", "Sender", "Reply-To", "To", "Cc", "Bcc"} {
+		v := get(k)
+		if v == "" && (k == "Sender" || k == "Reply-To") {
+			v = from
+		}
+		w.WriteByte(' ')
+		writeAddresses(w, v)
+	}
+
+	w.WriteByte(' ')
+	writeNString(w, get("In-Reply-To"))
+	w.WriteByte(' ')
+	writeNString(w, get("Message-Id"))
+	w.WriteByte(')')
+}
+
+func writeAddresses(w *bytes.Buffer, v string) {
+	addrs, err := mail.ParseAddressList(v)
+	if v == "" || err != nil || len(addrs) == 0 {
+		w.WriteString("NIL")
+		return
+	}
+	w.WriteByte('(')
+	for _, a := range addrs {
+		local, domain := a.Address, ""
+		if at := strings.LastIndexByte(local, '@'); at >= 0 {
+			local, domain = local[:at], local[at+1:]
+		}
+		w.WriteByte('(')
+		writeNString(w, encodeWord(a.Name))
+		w.WriteString(" NIL ")
+		writeNString(w, local)
+		w.WriteByte(' ')
+		writeNString(w, domain)
+		w.WriteByte(')')
+	}
+	w.WriteByte(')')
+}
+
+// writeParams writes MIME parameters as a list, or NIL.
+func writeParams(w *bytes.Buffer, params map[string]string) {
+	if len(params) == 0 {
+		w.WriteString("NIL")
+		return
+	}
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	w.WriteByte('(')
+	for i, k := range keys {
+		if i > 0 {
+			w.WriteByte(' ')
+		}
+		writeString(w, strings.ToUpper(k))
+		w.WriteByte(' ')
+		writeString(w, encodeWord(params[k]))
+	}
+	w.WriteByte(')')
+}
+
+// writeBodyStructure writes the BODYSTRUCTURE, or with ext unset the BODY,
+// of a part.
+func writeBodyStructure(w *bytes.Buffer, p *part, ext bool) {
+	typ, subtype, _ := strings.Cut(p.mediaType, "/")
+	w.WriteByte('(')
+
+	if len(p.children) > 0 {
+		for _, c := range p.children {
+			writeBodyStructure(w, c, ext)
+		}
+		w.WriteByte(' ')
+		writeString(w, strings.ToUpper(subtype))
+		if ext {
+			w.WriteByte(' ')
+			writeParams(w, p.params)
+			w.WriteByte(' ')
+			writeDisposition(w, p)
+			w.WriteString(" NIL NIL")
+		}
+		w.WriteByte(')')
+		return
+	}
+
+	writeString(w, strings.ToUpper(typ))
+	w.WriteByte(' ')
+	writeString(w, strings.ToUpper(subtype))
+	w.WriteByte(' ')
+	writeParams(w, p.params)
+	w.WriteByte(' ')
+	writeNString(w, strings.TrimSpace(p.hdr.Get("Content-Id")))
+	w.WriteByte(' ')
+	writeNString(w, encodeWord(strings.TrimSpace(p.hdr.Get("Content-Description"))))
+	w.WriteByte(' ')
+	enc := strings.ToUpper(strings.TrimSpace(p.hdr.Get("Content-Transfer-Encoding")))
+	if enc == "" {
+		enc = "7BIT"
+	}
+	writeString(w, enc)
+	fmt.Fprintf(w, " %d", len(p.body))
+
+	switch {
+	case p.msg != nil:
+		w.WriteByte(' ')
+		writeEnvelope(w, p.msg.hdr)
+		w.WriteByte(' ')
+		writeBodyStructure(w, p.msg, ext)
+		fmt.Fprintf(w, " %d", countLines(p.body))
+	case typ == "text":
+		fmt.Fprintf(w, " %d", countLines(p.body))
+	}
+
+	if ext {
+		w.WriteByte(' ')
+		writeNString(w, strings.TrimSpace(p.hdr.Get("Content-Md5")))
+		w.WriteByte(' ')
+		writeDisposition(w, p)
+		w.WriteString(" NIL NIL")
+	}
+	w.WriteByte(')')
+}
+
+func writeDisposition(w *bytes.Buffer, p *part) {
+	disp, params, err := mime.ParseMediaType(p.hdr.Get("Content-Disposition"))
+	if err != nil {
+		w.WriteString("NIL")
+		return
+	}
+	w.WriteByte('(')
+	writeString(w, strings.ToUpper(disp))
+	w.WriteByte(' ')
+	writeParams(w, params)
+	w.WriteByte(')')
+}
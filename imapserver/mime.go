@@ -0,0 +1,237 @@
+package imapserver
+
+import (
+	"bufio"
+	"bytes"
+	"mime"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// maxDepth limits the nesting of multiparts and attached messages.
+const maxDepth = 10
+
+// part is a MIME entity: a message, or a part of a multipart or attached
+// message, kept as the raw bytes it was stored as.
+type part struct {
+	header []byte // raw header, including the terminating blank line
+	body   []byte
+	hdr    textproto.MIMEHeader
+
+	mediaType string // lower case, such as "text/plain"
+	params    map[string]string
+
+	children []*part // parts of a multipart
+	msg      *part   // the message inside a message/rfc822 part
+}
+
+// parsePart parses a raw entity. The default content type is text/plain,
+// or message/rfc822 within a multipart/digest.
+func parsePart(data []byte, defaultType string, depth int) *part {
+	p := &part{}
+	p.header, p.body = splitHeader(data)
+
+	tr := textproto.NewReader(bufio.NewReader(bytes.NewReader(p.header)))
+	p.hdr, _ = tr.ReadMIMEHeader()
+	if p.hdr == nil {
+		p.hdr = make(textproto.MIMEHeader)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(p.hdr.Get("Content-Type"))
+	if err != nil || !strings.Contains(mediaType, "/") {
+		mediaType, params = defaultType, nil
+		if mediaType == "text/plain" {
+			params = map[string]string{"charset": "us-ascii"}
+		}
+	}
+	p.mediaType, p.params = mediaType, params
+
+	if depth >= maxDepth {
+		return p
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "":
+		childType := "text/plain"
+		if mediaType == "multipart/digest" {
+			childType = "message/rfc822"
+		}
+		for _, raw := range splitMultipart(p.body, params["boundary"]) {
+			p.children = append(p.children, parsePart(raw, childType, depth+1))
+		}
+	case mediaType == "message/rfc822":
+		p.msg = parsePart(p.body, "text/plain", depth+1)
+	}
+	return p
+}
+
+// splitHeader splits an entity at the blank line ending its header.
+func splitHeader(data []byte) ([]byte, []byte) {
+	if bytes.HasPrefix(data, []byte("\r\n")) {
+		return data[:2], data[2:]
+	}
+	if bytes.HasPrefix(data, []byte("\n")) {
+		return data[:1], data[1:]
+	}
+	crlf := bytes.Index(data, []byte("\r\n\r\n"))
+	lf := bytes.Index(data, []byte("\n\n"))
+	switch {
+	case crlf >= 0 && (lf < 0 || crlf < lf+1):
+		return data[:crlf+4], data[crlf+4:]
+	case lf >= 0:
+		return data[:lf+2], data[lf+2:]
+	}
+	return data, nil
+}
+
+// splitMultipart returns the raw parts of a multipart body, without the
+// line breaks that belong to the delimiters.
+func splitMultipart(body []byte, boundary string) [][]byte {
+	delim := []byte("--" + boundary)
+	var parts [][]byte
+	start := -1
+	for pos := 0; pos < len(body); {
+		end := bytes.IndexByte(body[pos:], '\n')
+		if end < 0 {
+			end = len(body)
+		} else {
+			end += pos + 1
+		}
+		line := bytes.TrimRight(body[pos:end], " \t\r\n")
+
+		if bytes.HasPrefix(line, delim) {
+			rest := line[len(delim):]
+			if len(rest) == 0 || bytes.Equal(rest, []byte("--")) {
+				if start >= 0 {
+					parts = append(parts, trimLineBreak(body[start:pos]))
+				}
+				if len(rest) > 0 {
+					return parts
+				}
+				start = end
+			}
+		}
+		pos = end
+	}
+	if start >= 0 && start < len(body) {
+		parts = append(parts, body[start:])
+	}
+	return parts
+}
+
+func trimLineBreak(b []byte) []byte {
+	if bytes.HasSuffix(b, []byte("\r\n")) {
+		return b[:len(b)-2]
+	}
+	if bytes.HasSuffix(b, []byte("\n")) {
+		return b[:len(b)-1]
+	}
+	return b
+}
+
+// child returns part n, counting from one, as addressed by a section
+// number.
+func (p *part) child(n int) *part {
+	if p.msg != nil {
+		p = p.msg
+	}
+	if len(p.children) > 0 {
+		if n < 1 || n > len(p.children) {
+			return nil
+		}
+		return p.children[n-1]
+	}
+	if n == 1 {
+		return p
+	}
+	return nil
+}
+
+// filterHeader returns the header lines with (or without, if not is set)
+// the given field names, followed by a blank line.
+func filterHeader(header []byte, names []string, not bool) []byte {
+	want := make(map[string]bool)
+	for _, n := range names {
+		want[textproto.CanonicalMIMEHeaderKey(n)] = true
+	}
+
+	var out []byte
+	keep := false
+	for _, line := range bytes.SplitAfter(header, []byte("\n")) {
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			name, _, _ := bytes.Cut(line, []byte(":"))
+			keep = want[textproto.CanonicalMIMEHeaderKey(string(bytes.TrimSpace(name)))] != not
+		}
+		if keep {
+			out = append(out, line...)
+		}
+	}
+	return append(out, "\r\n"...)
+}
+
+func countLines(b []byte) int {
+	n := bytes.Count(b, []byte("\n"))
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		n++
+	}
+	return n
+}
+
+// section returns the contents of a FETCH body section such as "",
+// "HEADER", "1.2.TEXT" or "HEADER.FIELDS (FROM TO)", or false if the
+// message has no such section.
+func (p *part) section(spec string, full []byte) ([]byte, bool) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return full, true
+	}
+
+	cur := p
+	numbered := false
+	for spec != "" {
+		num, rest, _ := strings.Cut(spec, ".")
+		n, err := strconv.Atoi(num)
+		if err != nil {
+			break
+		}
+		if cur = cur.child(n); cur == nil {
+			return nil, false
+		}
+		numbered = true
+		spec = rest
+	}
+
+	text, fields, _ := strings.Cut(spec, " ")
+	text = strings.ToUpper(text)
+	if text == "" {
+		return cur.body, true
+	}
+	if text == "MIME" {
+		if !numbered {
+			return nil, false
+		}
+		return cur.header, true
+	}
+
+	// The remaining specifiers refer to a message: the whole message, or
+	// an attached one.
+	if numbered {
+		if cur.msg == nil {
+			return nil, false
+		}
+		cur = cur.msg
+	}
+	switch text {
+	case "HEADER":
+		return cur.header, true
+	case "TEXT":
+		return cur.body, true
+	case "HEADER.FIELDS", "HEADER.FIELDS.NOT":
+		names := strings.Fields(strings.Trim(strings.TrimSpace(fields), "()"))
+		return filterHeader(cur.header, names, text == "HEADER.FIELDS.NOT"), true
+	}
+	return nil, false
+}
@@ -0,0 +1,293 @@
+package imapserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/calmh/imapchive/fts"
+)
+
+// criterion is a parsed SEARCH key.
+type criterion func(m *message) bool
+
+// searcher parses SEARCH keys for the selected mailbox.
+type searcher struct {
+	args   []interface{}
+	pos    int
+	maxSeq uint32
+	maxUID uint32
+}
+
+// parseSearch parses the search keys of a SEARCH command, all of which
+// must match.
+func parseSearch(args []interface{}, maxSeq, maxUID uint32) (criterion, error) {
+	if len(args) >= 2 {
+		if s, ok := args[0].(string); ok && strings.EqualFold(s, "CHARSET") {
+			cs, _ := args[1].(string)
+			if !strings.EqualFold(cs, "UTF-8") && !strings.EqualFold(cs, "US-ASCII") {
+				return nil, errBadCharset
+			}
+			args = args[2:]
+		}
+	}
+	s := &searcher{args: args, maxSeq: maxSeq, maxUID: maxUID}
+	var all []criterion
+	for s.pos < len(s.args) {
+		c, err := s.key()
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, c)
+	}
+	if len(all) == 0 {
+		return nil, errors.New("missing search key")
+	}
+	return and(all), nil
+}
+
+var errBadCharset = errors.New("unsupported charset")
+
+func and(cs []criterion) criterion {
+	return func(m *message) bool {
+		for _, c := range cs {
+			if !c(m) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func (s *searcher) next() (interface{}, error) {
+	if s.pos >= len(s.args) {
+		return nil, errors.New("missing search argument")
+	}
+	s.pos++
+	return s.args[s.pos-1], nil
+}
+
+func (s *searcher) str() (string, error) {
+	a, err := s.next()
+	if err != nil {
+		return "", err
+	}
+	str, ok := a.(string)
+	if !ok {
+		return "", errors.New("unexpected list")
+	}
+	return str, nil
+}
+
+func (s *searcher) date() (time.Time, error) {
+	str, err := s.str()
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, err := time.Parse("2-Jan-2006", str)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q", str)
+	}
+	return t, nil
+}
+
+func (s *searcher) number() (int, error) {
+	str, err := s.str()
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(str)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid number %q", str)
+	}
+	return n, nil
+}
+
+func (s *searcher) key() (criterion, error) {
+	a, err := s.next()
+	if err != nil {
+		return nil, err
+	}
+	if list, ok := a.([]interface{}); ok {
+		sub := &searcher{args: list, maxSeq: s.maxSeq, maxUID: s.maxUID}
+		var all []criterion
+		for sub.pos < len(sub.args) {
+			c, err := sub.key()
+			if err != nil {
+				return nil, err
+			}
+			all = append(all, c)
+		}
+		return and(all), nil
+	}
+
+	key := a.(string)
+	if isSeqSet(key) {
+		set, err := parseSeqSet(key, s.maxSeq)
+		if err != nil {
+			return nil, err
+		}
+		return func(m *message) bool { return set.contains(m.seq) }, nil
+	}
+
+	switch strings.ToUpper(key) {
+	case "ALL", "OLD", "SEEN", "UNANSWERED", "UNDELETED":
+		return func(*message) bool { return true }, nil
+	case "NEW", "RECENT", "UNSEEN", "ANSWERED", "DELETED":
+		return func(*message) bool { return false }, nil
+	case "FLAGGED", "UNFLAGGED", "DRAFT", "UNDRAFT":
+		k := strings.ToUpper(key)
+		want := !strings.HasPrefix(k, "UN")
+		flag := `\Flagged`
+		if strings.HasSuffix(k, "DRAFT") {
+			flag = `\Draft`
+		}
+		return func(m *message) bool { return hasFlag(m, flag) == want }, nil
+
+	case "KEYWORD":
+		if _, err := s.str(); err != nil {
+			return nil, err
+		}
+		return func(*message) bool { return false }, nil
+	case "UNKEYWORD":
+		if _, err := s.str(); err != nil {
+			return nil, err
+		}
+		return func(*message) bool { return true }, nil
+
+	case "UID":
+		str, err := s.str()
+		if err != nil {
+			return nil, err
+		}
+		set, err := parseSeqSet(str, s.maxUID)
+		if err != nil {
+			return nil, err
+		}
+		return func(m *message) bool { return set.contains(m.uid) }, nil
+
+	case "NOT":
+		c, err := s.key()
+		if err != nil {
+			return nil, err
+		}
+		return func(m *message) bool { return !c(m) }, nil
+
+	case "OR":
+		a, err := s.key()
+		if err != nil {
+			return nil, err
+		}
+		b, err := s.key()
+		if err != nil {
+			return nil, err
+		}
+		return func(m *message) bool { return a(m) || b(m) }, nil
+
+	case "FROM", "TO", "CC", "BCC", "SUBJECT":
+		v, err := s.str()
+		if err != nil {
+			return nil, err
+		}
+		return headerContains(key, v), nil
+
+	case "HEADER":
+		name, err := s.str()
+		if err != nil {
+			return nil, err
+		}
+		v, err := s.str()
+		if err != nil {
+			return nil, err
+		}
+		return headerContains(name, v), nil
+
+	case "BODY", "TEXT":
+		v, err := s.str()
+		if err != nil {
+			return nil, err
+		}
+		v = strings.ToLower(v)
+		withHeader := strings.EqualFold(key, "TEXT")
+		return func(m *message) bool {
+			if m.load() != nil {
+				return false
+			}
+			_, fields := fts.Extract(m.uid, m.data)
+			if withHeader {
+				fields = append(fields, string(m.root.header))
+			}
+			for _, f := range fields {
+				if strings.Contains(strings.ToLower(f), v) {
+					return true
+				}
+			}
+			return bytes.Contains(bytes.ToLower(m.root.body), []byte(v))
+		}, nil
+
+	case "LARGER", "SMALLER":
+		n, err := s.number()
+		if err != nil {
+			return nil, err
+		}
+		larger := strings.EqualFold(key, "LARGER")
+		return func(m *message) bool {
+			if m.load() != nil {
+				return false
+			}
+			if larger {
+				return len(m.data) > n
+			}
+			return len(m.data) < n
+		}, nil
+
+	case "BEFORE", "ON", "SINCE", "SENTBEFORE", "SENTON", "SENTSINCE":
+		d, err := s.date()
+		if err != nil {
+			return nil, err
+		}
+		op := strings.TrimPrefix(strings.ToUpper(key), "SENT")
+		return func(m *message) bool {
+			md := m.date()
+			day := time.Date(md.Year(), md.Month(), md.Day(), 0, 0, 0, 0, time.UTC)
+			switch op {
+			case "BEFORE":
+				return day.Before(d)
+			case "ON":
+				return day.Equal(d)
+			default:
+				return !day.Before(d)
+			}
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported search key %q", key)
+}
+
+func hasFlag(m *message, flag string) bool {
+	for _, f := range m.flags() {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func headerContains(name, v string) criterion {
+	v = strings.ToLower(v)
+	return func(m *message) bool {
+		if m.load() != nil {
+			return false
+		}
+		for _, hv := range m.root.hdr[textproto.CanonicalMIMEHeaderKey(name)] {
+			if strings.Contains(strings.ToLower(fts.DecodeHeader(hv)), v) {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,586 @@
+// Package imapserver serves archives read-only over IMAP, so that they can
+// be browsed with ordinary mail clients.
+//
+// Each archive is a mailbox, holding its live messages with their archive
+// message IDs as UIDs. Gmail labels appear as mailboxes below it, holding
+// the messages with that label. Nothing is ever written to the archives;
+// commands that would modify a mailbox are refused.
+package imapserver
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/calmh/imapchive/db"
+	"github.com/mxk/go-imap/imap"
+)
+
+const (
+	capabilities = "IMAP4rev1 AUTH=PLAIN UNSELECT"
+	delimiter    = "/"
+	idleTimeout  = 30 * time.Minute
+)
+
+// Server serves a set of archives.
+type Server struct {
+	// Archives maps mailbox names to archives.
+	Archives map[string]*db.DB
+
+	// User and Password, if set, are required to log in. Otherwise any
+	// credentials are accepted.
+	User, Password string
+
+	mut      sync.Mutex
+	cached   []*mailbox        // the mailboxes, as last listed
+	versions map[string]uint64 // of the archives when they were listed
+}
+
+// Serve accepts connections on the listener and serves them until it
+// fails.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		c := &conn{
+			srv: s,
+			nc:  nc,
+			br:  bufio.NewReader(nc),
+			bw:  bufio.NewWriter(nc),
+		}
+		go func() {
+			if err := c.serve(); err != nil && err != io.EOF {
+				log.Printf("IMAP connection from %s: %v", nc.RemoteAddr(), err)
+			}
+			nc.Close()
+		}()
+	}
+}
+
+// mailbox is an archive, or the messages in it with a given label.
+type mailbox struct {
+	name  string
+	db    *db.DB
+	label string
+}
+
+func (m *mailbox) uids() []uint32 {
+	ids := m.db.MessageIDs()
+	if m.label == "" {
+		return ids
+	}
+	var res []uint32
+	for _, id := range ids {
+		for _, l := range m.db.Labels(id) {
+			if l == m.label {
+				res = append(res, id)
+				break
+			}
+		}
+	}
+	return res
+}
+
+func (m *mailbox) uidValidity() uint32 {
+	if h := m.db.Header(); h != nil && h.Created > 0 {
+		return uint32(h.Created)
+	}
+	return 1
+}
+
+// mailboxes returns all mailboxes in name order. The list is kept until
+// an archive changes, rather than gathering the labels of every message
+// for each command. It must not be modified.
+func (s *Server) mailboxes() []*mailbox {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	versions := make(map[string]uint64, len(s.Archives))
+	for name, d := range s.Archives {
+		versions[name] = d.Version()
+	}
+	if s.cached != nil && maps.Equal(versions, s.versions) {
+		return s.cached
+	}
+
+	res := []*mailbox{}
+	for name, d := range s.Archives {
+		res = append(res, &mailbox{name: name, db: d})
+
+		labels := make(map[string]bool)
+		for _, id := range d.MessageIDs() {
+			for _, l := range d.Labels(id) {
+				labels[l] = true
+			}
+		}
+		for l := range labels {
+			res = append(res, &mailbox{name: name + delimiter + LabelName(l), db: d, label: l})
+		}
+	}
+	sort.Slice(res, func(a, b int) bool { return res[a].name < res[b].name })
+	s.cached, s.versions = res, versions
+	return res
+}
+
+// LabelName returns the mailbox name for a Gmail label, which is stored
+// in modified UTF-7 as received from the server. System labels lose their
+// leading backslash.
+func LabelName(l string) string {
+	if dec, err := imap.UTF7Decode(l); err == nil {
+		l = dec
+	}
+	return strings.TrimPrefix(l, `\`)
+}
+
+func (s *Server) mailbox(name string) *mailbox {
+	for _, m := range s.mailboxes() {
+		if m.name == name || strings.EqualFold(name, "INBOX") && strings.EqualFold(m.name, "INBOX") {
+			return m
+		}
+	}
+	return nil
+}
+
+type conn struct {
+	srv *Server
+	nc  net.Conn
+	br  *bufio.Reader
+	bw  *bufio.Writer
+
+	authed bool
+	sel    *mailbox
+	msgs   []*message // the selected mailbox, by sequence number
+}
+
+// errLogout ends the connection after a LOGOUT.
+var errLogout = errors.New("logout")
+
+// errReadOnly is the response to commands that would modify a mailbox.
+var errReadOnly = errors.New("archives are read-only")
+
+func (c *conn) serve() error {
+	fmt.Fprintf(c.bw, "* OK [CAPABILITY %s] imapchive ready\r\n", capabilities)
+	if err := c.bw.Flush(); err != nil {
+		return err
+	}
+
+	for {
+		c.nc.SetReadDeadline(time.Now().Add(idleTimeout))
+		line, err := readCommand(c.br, func() error {
+			c.bw.WriteString("+ Ready for literal\r\n")
+			return c.bw.Flush()
+		})
+		if err != nil {
+			if err == errLineTooLong {
+				c.bw.WriteString("* BYE Command line too long\r\n")
+				c.bw.Flush()
+			}
+			return err
+		}
+
+		tag, name, args, err := parseCommand(line)
+		var buf bytes.Buffer
+		code := ""
+		if err == nil {
+			code, err = c.handle(&buf, tag, name, args)
+		}
+		c.bw.Write(buf.Bytes())
+
+		var no noError
+		switch {
+		case err == errLogout:
+			fmt.Fprintf(c.bw, "%s OK LOGOUT completed\r\n", tag)
+			return c.bw.Flush()
+		case err == errReadOnly || errors.As(err, &no):
+			fmt.Fprintf(c.bw, "%s NO %s\r\n", tag, err)
+		case err == errBadCharset:
+			fmt.Fprintf(c.bw, "%s NO [BADCHARSET (UTF-8 US-ASCII)] %s\r\n", tag, err)
+		case err != nil && tag == "":
+			fmt.Fprintf(c.bw, "* BAD %s\r\n", err)
+		case err != nil:
+			fmt.Fprintf(c.bw, "%s BAD %s\r\n", tag, err)
+		default:
+			if code != "" {
+				code = "[" + code + "] "
+			}
+			fmt.Fprintf(c.bw, "%s OK %s%s completed\r\n", tag, code, name)
+		}
+		if err := c.bw.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// noError is an error that is reported as a NO response.
+type noError string
+
+func (e noError) Error() string {
+	return string(e)
+}
+
+// handle executes a command, writing untagged responses to w. It returns
+// the response code, if any, of the tagged OK response.
+func (c *conn) handle(w *bytes.Buffer, tag, name string, args []interface{}) (string, error) {
+	switch name {
+	case "CAPABILITY":
+		fmt.Fprintf(w, "* CAPABILITY %s\r\n", capabilities)
+		return "", nil
+	case "NOOP", "CHECK":
+		return "", nil
+	case "LOGOUT":
+		w.WriteString("* BYE imapchive logging out\r\n")
+		return "", errLogout
+	case "LOGIN":
+		user, err := stringArg(args, 0)
+		if err != nil {
+			return "", err
+		}
+		pass, err := stringArg(args, 1)
+		if err != nil {
+			return "", err
+		}
+		return "", c.login(user, pass)
+	case "AUTHENTICATE":
+		return "", c.authenticate(args)
+	}
+
+	if !c.authed {
+		return "", noError("not logged in")
+	}
+
+	switch name {
+	case "LIST", "LSUB":
+		return "", c.list(w, name, args)
+	case "STATUS":
+		return "", c.status(w, args)
+	case "SELECT", "EXAMINE":
+		return "READ-ONLY", c.selectMailbox(w, args)
+	case "SUBSCRIBE", "UNSUBSCRIBE":
+		// Every mailbox is always subscribed.
+		return "", nil
+	case "CREATE", "DELETE", "RENAME", "APPEND":
+		return "", errReadOnly
+	}
+
+	if c.sel == nil {
+		return "", noError("no mailbox selected")
+	}
+
+	switch name {
+	case "CLOSE", "UNSELECT":
+		c.sel, c.msgs = nil, nil
+		return "", nil
+	case "FETCH":
+		return "", c.fetch(w, args, false)
+	case "SEARCH":
+		return "", c.search(w, args, false)
+	case "STORE", "COPY", "MOVE", "EXPUNGE":
+		return "", errReadOnly
+	case "UID":
+		sub, err := stringArg(args, 0)
+		if err != nil {
+			return "", err
+		}
+		switch strings.ToUpper(sub) {
+		case "FETCH":
+			return "", c.fetch(w, args[1:], true)
+		case "SEARCH":
+			return "", c.search(w, args[1:], true)
+		case "STORE", "COPY", "MOVE", "EXPUNGE":
+			return "", errReadOnly
+		}
+		return "", fmt.Errorf("unknown command UID %s", sub)
+	}
+
+	return "", fmt.Errorf("unknown command %s", name)
+}
+
+func (c *conn) login(user, pass string) error {
+	s := c.srv
+	if s.User != "" || s.Password != "" {
+		okUser := subtle.ConstantTimeCompare([]byte(user), []byte(s.User)) == 1
+		okPass := subtle.ConstantTimeCompare([]byte(pass), []byte(s.Password)) == 1
+		if !okUser || !okPass {
+			return noError("invalid credentials")
+		}
+	}
+	c.authed = true
+	return nil
+}
+
+func (c *conn) authenticate(args []interface{}) error {
+	mech, err := stringArg(args, 0)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(mech, "PLAIN") {
+		return noError("unsupported authentication mechanism")
+	}
+
+	resp, err := stringArg(args, 1)
+	if err != nil {
+		c.bw.WriteString("+ \r\n")
+		if err := c.bw.Flush(); err != nil {
+			return err
+		}
+		line, err := readLine(c.br)
+		if err != nil {
+			return err
+		}
+		resp = string(line)
+	}
+	if resp == "*" {
+		return noError("authentication cancelled")
+	}
+
+	dec, err := base64.StdEncoding.DecodeString(resp)
+	if err != nil {
+		return errors.New("invalid base64")
+	}
+	fields := strings.Split(string(dec), "\x00")
+	if len(fields) != 3 {
+		return errors.New("invalid PLAIN response")
+	}
+	return c.login(fields[1], fields[2])
+}
+
+func (c *conn) list(w *bytes.Buffer, name string, args []interface{}) error {
+	ref, err := stringArg(args, 0)
+	if err != nil {
+		return err
+	}
+	pattern, err := stringArg(args, 1)
+	if err != nil {
+		return err
+	}
+
+	if pattern == "" {
+		fmt.Fprintf(w, "* %s (\\Noselect) \"%s\" \"\"\r\n", name, delimiter)
+		return nil
+	}
+
+	re := listPattern(imapDecode(ref + pattern))
+	for _, m := range c.srv.mailboxes() {
+		if !re(m.name) {
+			continue
+		}
+		fmt.Fprintf(w, "* %s () \"%s\" ", name, delimiter)
+		writeString(w, imap.UTF7Encode(m.name))
+		w.WriteString("\r\n")
+	}
+	return nil
+}
+
+func imapDecode(s string) string {
+	if dec, err := imap.UTF7Decode(s); err == nil {
+		return dec
+	}
+	return s
+}
+
+// listPattern returns a matcher for a LIST pattern, where * matches
+// anything and % anything but the hierarchy delimiter.
+func listPattern(pattern string) func(string) bool {
+	return func(name string) bool {
+		return matchPattern(pattern, name)
+	}
+}
+
+func matchPattern(pattern, name string) bool {
+	for pattern != "" {
+		switch pattern[0] {
+		case '*', '%':
+			for i := 0; i <= len(name); i++ {
+				if pattern[0] == '%' && i > 0 && name[i-1:i] == delimiter {
+					return false
+				}
+				if matchPattern(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		default:
+			if name == "" || pattern[0] != name[0] {
+				return false
+			}
+			pattern, name = pattern[1:], name[1:]
+		}
+	}
+	return name == ""
+}
+
+func (c *conn) status(w *bytes.Buffer, args []interface{}) error {
+	name, err := stringArg(args, 0)
+	if err != nil {
+		return err
+	}
+	if len(args) < 2 {
+		return errors.New("missing status items")
+	}
+	items, ok := args[1].([]interface{})
+	if !ok {
+		return errors.New("invalid status items")
+	}
+	m := c.srv.mailbox(imapDecode(name))
+	if m == nil {
+		return noError("no such mailbox")
+	}
+
+	uids := m.uids()
+	var res []string
+	for _, it := range items {
+		item, _ := it.(string)
+		switch strings.ToUpper(item) {
+		case "MESSAGES":
+			res = append(res, fmt.Sprintf("MESSAGES %d", len(uids)))
+		case "RECENT":
+			res = append(res, "RECENT 0")
+		case "UIDNEXT":
+			res = append(res, fmt.Sprintf("UIDNEXT %d", uidNext(uids)))
+		case "UIDVALIDITY":
+			res = append(res, fmt.Sprintf("UIDVALIDITY %d", m.uidValidity()))
+		case "UNSEEN":
+			res = append(res, "UNSEEN 0")
+		default:
+			return fmt.Errorf("unknown status item %q", item)
+		}
+	}
+	w.WriteString("* STATUS ")
+	writeString(w, imap.UTF7Encode(m.name))
+	fmt.Fprintf(w, " (%s)\r\n", strings.Join(res, " "))
+	return nil
+}
+
+func uidNext(uids []uint32) uint32 {
+	if len(uids) == 0 {
+		return 1
+	}
+	return uids[len(uids)-1] + 1
+}
+
+func (c *conn) selectMailbox(w *bytes.Buffer, args []interface{}) error {
+	c.sel, c.msgs = nil, nil
+
+	name, err := stringArg(args, 0)
+	if err != nil {
+		return err
+	}
+	m := c.srv.mailbox(imapDecode(name))
+	if m == nil {
+		return noError("no such mailbox")
+	}
+
+	uids := m.uids()
+	c.sel = m
+	c.msgs = make([]*message, len(uids))
+	for i, uid := range uids {
+		c.msgs[i] = &message{db: m.db, seq: uint32(i + 1), uid: uid, labels: m.db.Labels(uid)}
+	}
+
+	w.WriteString("* FLAGS (\\Seen \\Flagged \\Draft)\r\n")
+	w.WriteString("* OK [PERMANENTFLAGS ()] Read-only mailbox\r\n")
+	fmt.Fprintf(w, "* %d EXISTS\r\n", len(uids))
+	w.WriteString("* 0 RECENT\r\n")
+	fmt.Fprintf(w, "* OK [UIDVALIDITY %d] UIDs valid\r\n", m.uidValidity())
+	fmt.Fprintf(w, "* OK [UIDNEXT %d] Predicted next UID\r\n", uidNext(uids))
+	return nil
+}
+
+// selected returns the selected messages in a sequence set of sequence
+// numbers, or UIDs if uid is set.
+func (c *conn) selected(set string, uid bool) ([]*message, error) {
+	var max uint32
+	if n := len(c.msgs); n > 0 {
+		max = uint32(n)
+		if uid {
+			max = c.msgs[n-1].uid
+		}
+	}
+	ss, err := parseSeqSet(set, max)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*message
+	for _, m := range c.msgs {
+		n := m.seq
+		if uid {
+			n = m.uid
+		}
+		if ss.contains(n) {
+			res = append(res, m)
+		}
+	}
+	return res, nil
+}
+
+func (c *conn) fetch(w *bytes.Buffer, args []interface{}, uid bool) error {
+	set, err := stringArg(args, 0)
+	if err != nil {
+		return err
+	}
+	if len(args) < 2 {
+		return errors.New("missing data items")
+	}
+	items, err := parseFetchItems(args[1])
+	if err != nil {
+		return err
+	}
+	msgs, err := c.selected(set, uid)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range msgs {
+		if err := fetch(w, m, items, uid); err != nil {
+			return noError(err.Error())
+		}
+
+		// Write large responses as they are produced, and let go of
+		// the message data.
+		if w.Len() > 1<<20 {
+			c.bw.Write(w.Bytes())
+			w.Reset()
+		}
+		m.data, m.root = nil, nil
+	}
+	return nil
+}
+
+func (c *conn) search(w *bytes.Buffer, args []interface{}, uid bool) error {
+	var maxSeq, maxUID uint32
+	if n := len(c.msgs); n > 0 {
+		maxSeq, maxUID = uint32(n), c.msgs[n-1].uid
+	}
+	crit, err := parseSearch(args, maxSeq, maxUID)
+	if err != nil {
+		return err
+	}
+
+	w.WriteString("* SEARCH")
+	for _, m := range c.msgs {
+		if crit(m) {
+			n := m.seq
+			if uid {
+				n = m.uid
+			}
+			fmt.Fprintf(w, " %d", n)
+		}
+		m.data, m.root = nil, nil
+	}
+	w.WriteString("\r\n")
+	return nil
+}
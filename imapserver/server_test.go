@@ -0,0 +1,56 @@
+package imapserver
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/calmh/imapchive/db"
+)
+
+func TestMailboxes(t *testing.T) {
+	d, err := db.Open(filepath.Join(t.TempDir(), "test.imapchive"), db.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	for id, labels := range [][]string{{`\Inbox`}, {`\Inbox`, "Work"}, nil} {
+		if err := d.WriteMessage(uint32(id+1), []byte("Subject: x\r\n\r\n"), labels, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &Server{Archives: map[string]*db.DB{"Archive": d}}
+
+	names := func() string {
+		var names []string
+		for _, m := range s.mailboxes() {
+			names = append(names, m.name)
+		}
+		return strings.Join(names, " ")
+	}
+	if got := names(); got != "Archive Archive/Inbox Archive/Work" {
+		t.Errorf("mailboxes %s", got)
+	}
+	// Unchanged archives are not read again.
+	if first, again := s.mailboxes(), s.mailboxes(); &first[0] != &again[0] {
+		t.Error("mailboxes listed again")
+	}
+
+	// Changes to the labels show, as does another archive.
+	if err := d.SetLabels(3, []string{"Travel"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(); got != "Archive Archive/Inbox Archive/Travel Archive/Work" {
+		t.Errorf("mailboxes after labelling %s", got)
+	}
+	if err := d.SetLabels(2, []string{`\Inbox`}); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(); got != "Archive Archive/Inbox Archive/Travel" {
+		t.Errorf("mailboxes after removing a label %s", got)
+	}
+	s.Archives["Other"] = d
+	if got := names(); !strings.HasSuffix(got, " Other Other/Inbox Other/Travel") {
+		t.Errorf("mailboxes with another archive %s", got)
+	}
+}
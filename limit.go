@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/calmh/imapchive/query"
+	"github.com/mxk/go-imap/imap"
+	"golang.org/x/time/rate"
+)
+
+// limits are the rate limits of an account, shared by all its
+// connections. A nil *limits imposes none.
+type limits struct {
+	bandwidth *rate.Limiter // bytes received per second, or nil
+	requests  *rate.Limiter // commands sent per second, or nil
+
+	mut       sync.Mutex
+	throttles int       // times the server reported throttling
+	paused    time.Time // no commands are sent before then
+}
+
+// maxSlowdowns is the number of times the limits are halved when the
+// server reports throttling.
+const maxSlowdowns = 4
+
+// setLimits parses the account's rate limits.
+func (acc *account) setLimits() error {
+	var bandwidth int64
+	if acc.MaxBandwidth != "" {
+		n, err := query.ParseSize(acc.MaxBandwidth)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid bandwidth %q", acc.MaxBandwidth)
+		}
+		bandwidth = n
+	}
+	if acc.MaxRequestsPerSecond < 0 {
+		return fmt.Errorf("invalid request rate %v", acc.MaxRequestsPerSecond)
+	}
+
+	acc.limits = &limits{}
+	if bandwidth > 0 {
+		// Reads are split to fit the burst, which allows a second's
+		// worth of data.
+		acc.limits.bandwidth = rate.NewLimiter(rate.Limit(bandwidth), int(bandwidth))
+	}
+	if acc.MaxRequestsPerSecond > 0 {
+		acc.limits.requests = rate.NewLimiter(rate.Limit(acc.MaxRequestsPerSecond), 1)
+	}
+	return nil
+}
+
+// request waits until a command may be sent.
+func (l *limits) request() {
+	if l == nil {
+		return
+	}
+	l.mut.Lock()
+	paused := time.Until(l.paused)
+	l.mut.Unlock()
+	time.Sleep(paused)
+	if l.requests != nil {
+		l.requests.Wait(context.Background())
+	}
+}
+
+// throttled reports whether the error is the server throttling the
+// account. If so, all connections pause, for longer each time it
+// happens, and the limits are halved.
+func (l *limits) throttled(err error) bool {
+	if l == nil || !isThrottled(err) {
+		return false
+	}
+
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if time.Now().Before(l.paused) {
+		// Already paused, likely for the same reason.
+		return true
+	}
+	delay := backoff(l.throttles)
+	l.throttles++
+	l.paused = time.Now().Add(delay)
+	if l.throttles <= maxSlowdowns {
+		for _, lim := range []*rate.Limiter{l.bandwidth, l.requests} {
+			if lim != nil {
+				lim.SetLimit(lim.Limit() / 2)
+			}
+		}
+	}
+	log.Printf("Server is throttling, pausing for %v: %v", delay, err)
+	return true
+}
+
+// isThrottled reports whether the error is the server refusing a command
+// because the account is sending too many or downloading too much.
+func isThrottled(err error) bool {
+	if err == nil {
+		return false
+	}
+	s := strings.ToLower(err.Error())
+	return strings.Contains(s, "[throttled]") ||
+		strings.Contains(s, "exceeded command or bandwidth limits") ||
+		strings.Contains(s, "bandwidth limit exceeded")
+}
+
+// dial connects to the server over TLS, keeping to the bandwidth limit.
+func dial(addr string, cfg *tls.Config, l *limits) (*imap.Client, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, addr = addr, net.JoinHostPort(addr, "993")
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if l != nil && l.bandwidth != nil {
+		conn = &limitedConn{conn, l.bandwidth}
+	}
+	cl, err := imap.NewClient(tls.Client(conn, cfg), host, time.Minute)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return cl, nil
+}
+
+// limitedConn is a connection that waits for the bandwidth limit after
+// each read.
+type limitedConn struct {
+	net.Conn
+	lim *rate.Limiter
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	if len(p) > c.lim.Burst() {
+		p = p[:c.lim.Burst()]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.lim.WaitN(context.Background(), n)
+	}
+	return n, err
+}
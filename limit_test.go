@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestSetLimits(t *testing.T) {
+	for _, tc := range []struct {
+		bandwidth string
+		requests  float64
+		wantBW    rate.Limit // zero for no limiter
+		wantReq   rate.Limit
+		err       bool
+	}{
+		{"", 0, 0, 0, false},
+		{"2M", 0, 2 << 20, 0, false},
+		{"512k", 10, 512 << 10, 10, false},
+		{"", 0.5, 0, 0.5, false},
+		{"fast", 0, 0, 0, true},
+		{"0", 0, 0, 0, true},
+		{"", -1, 0, 0, true},
+	} {
+		acc := &account{MaxBandwidth: tc.bandwidth, MaxRequestsPerSecond: tc.requests}
+		err := acc.setLimits()
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q, %v: accepted", tc.bandwidth, tc.requests)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q, %v: %v", tc.bandwidth, tc.requests, err)
+			continue
+		}
+		if got := limitOf(acc.limits.bandwidth); got != tc.wantBW {
+			t.Errorf("%q: bandwidth limit %v, want %v", tc.bandwidth, got, tc.wantBW)
+		}
+		if got := limitOf(acc.limits.requests); got != tc.wantReq {
+			t.Errorf("%v: request limit %v, want %v", tc.requests, got, tc.wantReq)
+		}
+	}
+}
+
+func limitOf(lim *rate.Limiter) rate.Limit {
+	if lim == nil {
+		return 0
+	}
+	return lim.Limit()
+}
+
+func TestIsThrottled(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("connection reset by peer"), false},
+		{errors.New("NO [THROTTLED] Request rate too high"), true},
+		{errors.New("NO Account exceeded command or bandwidth limits."), true},
+		{errors.New("NO [ALERT] Bandwidth limit exceeded"), true},
+		{errors.New("NO [OVERQUOTA] Mailbox is full"), false},
+	} {
+		if got := isThrottled(tc.err); got != tc.want {
+			t.Errorf("isThrottled(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestThrottled(t *testing.T) {
+	var none *limits
+	if none.throttled(errors.New("[THROTTLED]")) {
+		t.Error("throttled without limits")
+	}
+
+	acc := &account{MaxBandwidth: "1M", MaxRequestsPerSecond: 16}
+	if err := acc.setLimits(); err != nil {
+		t.Fatal(err)
+	}
+	l := acc.limits
+	throttling := errors.New("NO [THROTTLED] slow down")
+
+	if l.throttled(errors.New("NO mailbox does not exist")) || !l.paused.IsZero() {
+		t.Error("other errors pause")
+	}
+
+	for i := 1; i <= maxSlowdowns+2; i++ {
+		if !l.throttled(throttling) {
+			t.Fatalf("%d: not throttled", i)
+		}
+		if time.Until(l.paused) <= 0 {
+			t.Fatalf("%d: not paused", i)
+		}
+		// A second report during the pause changes nothing.
+		l.throttled(throttling)
+		if l.throttles != i {
+			t.Errorf("%d: %d throttles counted", i, l.throttles)
+		}
+		slowdowns := min(i, maxSlowdowns)
+		if got, want := l.requests.Limit(), 16/rate.Limit(int(1)<<slowdowns); got != want {
+			t.Errorf("%d: request limit %v, want %v", i, got, want)
+		}
+		if got, want := l.bandwidth.Limit(), 1<<20/rate.Limit(int(1)<<slowdowns); got != want {
+			t.Errorf("%d: bandwidth limit %v, want %v", i, got, want)
+		}
+		l.paused = time.Time{}
+	}
+}
+
+func TestLimitedConn(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	go func() {
+		server.Write(make([]byte, 300))
+		server.Close()
+	}()
+
+	conn := &limitedConn{client, rate.NewLimiter(rate.Inf, 100)}
+	buf := make([]byte, 1000)
+	total := 0
+	for {
+		n, err := conn.Read(buf)
+		if n > 100 {
+			t.Errorf("read %d bytes, more than the burst", n)
+		}
+		total += n
+		if err != nil {
+			break
+		}
+	}
+	if total != 300 {
+		t.Errorf("read %d bytes in all, want 300", total)
+	}
+}
@@ -3,18 +3,30 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
+	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
-	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/alecthomas/kingpin"
 	"github.com/calmh/imapchive/db"
+	"github.com/calmh/imapchive/fts"
+	"github.com/calmh/imapchive/imapserver"
+	"github.com/calmh/imapchive/query"
+	"github.com/calmh/imapchive/thread"
+	"github.com/calmh/imapchive/webui"
 )
 
 const (
@@ -26,168 +38,704 @@ var (
 	fullVersion = fmt.Sprintf("imapchive %s (%s-%s)", version, runtime.GOOS, runtime.GOARCH)
 )
 
-var progress struct {
-	toScan  int64
-	scanned int64
-	fetched int64
-	labels  int64
-}
-
 func main() {
 	kingpin.Version(fullVersion)
 
 	flagServer := kingpin.Flag("server", "Server address").Envar("IMAP_SERVER").String()
 	flagEmail := kingpin.Flag("email", "Email address").Envar("IMAP_EMAIL").String()
-	flagPassword := kingpin.Flag("password", "Password").Envar("IMAP_PASSWORD").String()
+	flagPassword := kingpin.Flag("password", "Password (visible to other users; prefer the alternatives)").Envar("IMAP_PASSWORD").String()
+	flagPasswordFile := kingpin.Flag("password-file", "Read the password from the first line of this file").Envar("IMAP_PASSWORD_FILE").String()
+	flagPasswordCommand := kingpin.Flag("password-command", "Run this command to get the password").Envar("IMAP_PASSWORD_COMMAND").String()
+	flagPassphrase := kingpin.Flag("passphrase", "Archive encryption passphrase").Envar("IMAPCHIVE_PASSPHRASE").String()
+	flagKeyFile := kingpin.Flag("key-file", "Archive encryption key file (32 bytes, raw or hex)").Envar("IMAPCHIVE_KEY_FILE").String()
+	flagSigningKey := kingpin.Flag("signing-key", "Checkpoint signing key file").Envar("IMAPCHIVE_SIGNING_KEY").String()
+	flagSafe := kingpin.Flag("safe", "Require mailboxes to be opened read-only and refuse any command that could alter them").Envar("IMAPCHIVE_SAFE").Bool()
+	flagConfig := kingpin.Flag("config", "Configuration file").Default(defaultConfigFile()).Envar("IMAPCHIVE_CONFIG").String()
+	flagLogFormat := kingpin.Flag("log-format", "Log as plain text or JSON").Default("text").Enum("text", "json")
+	flagMetricsListen := kingpin.Flag("metrics-listen", "Serve metrics and health checks on this address").PlaceHolder("ADDR").Envar("IMAPCHIVE_METRICS_LISTEN").String()
 
 	cmdFetch := kingpin.Command("fetch", "Fetch new mail")
 	flagMailbox := cmdFetch.Arg("mailbox", "Mailbox name").Required().String()
 	flagConcurrency := cmdFetch.Flag("concurrency", "Number of parallel fetch threads").Default("4").Int()
+	flagRetries := cmdFetch.Flag("retries", "Number of times to retry a failed message or connection").Default("5").Int()
+	flagBatchSize := cmdFetch.Flag("batch-size", "Bytes of messages to fetch per command").Default(defaultBatchSize).String()
+	flagPipeline := cmdFetch.Flag("pipeline", "Number of fetch commands in flight per connection").Default(strconv.Itoa(defaultPipeline)).Int()
+	flagCompression := cmdFetch.Flag("compression", "Compression for new archives").Default("gzip").Enum("gzip", "zstd")
+	flagMaxBandwidth := cmdFetch.Flag("max-bandwidth", "Bytes to receive per second, over all connections").PlaceHolder("SIZE").String()
+	flagMaxRequests := cmdFetch.Flag("max-requests-per-second", "Commands to send per second, over all connections").PlaceHolder("N").Float64()
+	flagSince := cmdFetch.Flag("since", "Only fetch messages received on or after this date").PlaceHolder("YYYY-MM-DD").String()
+	flagBefore := cmdFetch.Flag("before", "Only fetch messages received before this date").PlaceHolder("YYYY-MM-DD").String()
+	flagMaxSize := cmdFetch.Flag("max-size", "Only fetch messages up to this size").PlaceHolder("SIZE").String()
+	flagAll := cmdFetch.Flag("all", "Fetch all messages, ignoring the window recorded in the archive").Bool()
+	flagRescan := cmdFetch.Flag("rescan", "Search the whole mailbox for messages not yet archived").Bool()
+	flagDryRun := cmdFetch.Flag("dry-run", "Report what would be fetched, without fetching or writing to the archive").Bool()
+	flagFetchSummary := cmdFetch.Flag("summary", "Write a JSON summary of the run to this file (- for standard output)").PlaceHolder("FILE").String()
+
+	cmdSync := kingpin.Command("sync", "Fetch new mail for the accounts in the configuration file")
+	argSyncAccounts := cmdSync.Arg("accounts", "Only sync these accounts").Strings()
+	flagSyncSummary := cmdSync.Flag("summary", "Write a JSON summary of the run to this file (- for standard output)").PlaceHolder("FILE").String()
+
+	cmdMigrate := kingpin.Command("migrate", "Copy the mailboxes of one configured account to another, by way of its archives")
+	argMigrateSource := cmdMigrate.Arg("source", "Source account").Required().String()
+	argMigrateDestination := cmdMigrate.Arg("destination", "Destination account").Required().String()
+	flagMigrateMap := cmdMigrate.Flag("map", "Rename a mailbox, as source=destination").PlaceHolder("SOURCE=DESTINATION").StringMap()
 
 	cmdMbox := kingpin.Command("mbox", "Write an MBOX file with all messages to stdout")
-	argFile := cmdMbox.Arg("file", "Archive file").Required().String()
+	argFile := cmdMbox.Arg("file", "Archive file").Required().ExistingFile()
+	flagMboxQuery := cmdMbox.Flag("query", "Only write messages matching the query").String()
+	flagMboxByLabel := cmdMbox.Flag("by-label", "Write an MBOX file per label to the directory, instead of to stdout").PlaceHolder("DIR").String()
 
 	cmdList := kingpin.Command("list", "List available mailboxes")
 
-	switch kingpin.Parse() {
+	cmdCompact := kingpin.Command("compact", "Rewrite an archive keeping only the latest state of each message")
+	argCompactFile := cmdCompact.Arg("file", "Archive file").Required().String()
+	flagKeepDeleted := cmdCompact.Flag("keep-deleted", "Keep records of deleted messages").Bool()
+
+	cmdRecompress := kingpin.Command("recompress", "Rewrite an archive using a different compression")
+	argRecompressFile := cmdRecompress.Arg("file", "Archive file").Required().String()
+	flagRecompressCodec := cmdRecompress.Flag("compression", "Compression to use").Default("zstd").Enum("gzip", "zstd")
+	flagDictionary := cmdRecompress.Flag("dictionary", "Train and use a zstd dictionary").Bool()
+
+	cmdVerify := kingpin.Command("verify", "Verify the integrity of an archive")
+	argVerifyFile := cmdVerify.Arg("file", "Archive file").Required().ExistingFile()
+	flagVerifyChain := cmdVerify.Flag("chain", "Verify the hash chain and checkpoint signatures").Bool()
+	flagPublicKey := cmdVerify.Flag("public-key", "Require checkpoints signed by this public key (file)").String()
+
+	cmdSearch := kingpin.Command("search", "Search the text of archived messages")
+	argSearchFile := cmdSearch.Arg("file", "Archive file").Required().ExistingFile()
+	argSearchQuery := cmdSearch.Arg("query", "Query; see README for the syntax").Required().Strings()
+
+	cmdIndex := kingpin.Command("index", "Build or update the full-text index of an archive")
+	argIndexFile := cmdIndex.Arg("file", "Archive file").Required().ExistingFile()
+
+	cmdQuery := kingpin.Command("query", "Print the UIDs of messages matching a query")
+	argQueryFile := cmdQuery.Arg("file", "Archive file").Required().ExistingFile()
+	argQuery := cmdQuery.Arg("query", "Query; see README for the syntax").Required().Strings()
+
+	cmdDelete := kingpin.Command("delete", "Delete messages matching a query from an archive")
+	argDeleteFile := cmdDelete.Arg("file", "Archive file").Required().String()
+	argDeleteQuery := cmdDelete.Arg("query", "Query; see README for the syntax").Strings()
+	flagDeleteAll := cmdDelete.Flag("all", "Allow an empty query, deleting every message").Bool()
+	flagDeleteDryRun := cmdDelete.Flag("dry-run", "Report how many messages match without deleting them").Bool()
+
+	cmdThreads := kingpin.Command("threads", "Show the conversations in an archive")
+	argThreadsFile := cmdThreads.Arg("file", "Archive file").Required().ExistingFile()
+	argThreadsUID := cmdThreads.Arg("uid", "Only show the conversation containing this message").Uint32()
+
+	cmdStats := kingpin.Command("stats", "Show statistics about an archive")
+	argStatsFile := cmdStats.Arg("file", "Archive file").Required().ExistingFile()
+	flagStatsJSON := cmdStats.Flag("json", "Output JSON").Bool()
+	flagStatsTop := cmdStats.Flag("top", "Number of top senders and largest messages to show").Default("10").Int()
+
+	cmdServeIMAP := kingpin.Command("serve-imap", "Serve archives read-only over IMAP")
+	argServeIMAPFiles := cmdServeIMAP.Arg("files", "Archive files").Required().ExistingFiles()
+	flagServeIMAPListen := cmdServeIMAP.Flag("listen", "Address to listen on").Default("127.0.0.1:1143").String()
+	flagServeIMAPLogin := cmdServeIMAP.Flag("login", "Require this user:password to log in").Envar("IMAPCHIVE_SERVE_LOGIN").String()
+
+	cmdServeHTTP := kingpin.Command("serve-http", "Serve an archive read-only over HTTP")
+	argServeHTTPFile := cmdServeHTTP.Arg("file", "Archive file").Required().ExistingFile()
+	flagServeHTTPListen := cmdServeHTTP.Flag("listen", "Address to listen on").Default("127.0.0.1:8080").String()
+	flagServeHTTPLogin := cmdServeHTTP.Flag("login", "Require this user:password to log in").Envar("IMAPCHIVE_SERVE_LOGIN").String()
+
+	cmdGenKey := kingpin.Command("signing-key", "Generate a checkpoint signing key")
+	argGenKeyFile := cmdGenKey.Arg("file", "Key file to create").Required().String()
+
+	cmd := kingpin.Parse()
+
+	// flagAccount returns the account given on the command line.
+	flagAccount := func() *account {
+		acc := &account{
+			Server:          *flagServer,
+			Email:           *flagEmail,
+			Password:        *flagPassword,
+			PasswordFile:    *flagPasswordFile,
+			PasswordCommand: *flagPasswordCommand,
+			TLS:             tlsConfig{InsecureSkipVerify: true},
+			Safe:            *flagSafe,
+		}
+		if err := acc.resolvePassword(); err != nil {
+			fatal("Getting password:", err)
+		}
+		return acc
+	}
+
+	archiveOptions := func() db.Options {
+		opts := db.Options{
+			Passphrase: *flagPassphrase,
+		}
+		if *flagKeyFile != "" {
+			key, err := db.ReadKeyFile(*flagKeyFile)
+			if err != nil {
+				fatal("Reading key:", err)
+			}
+			opts.Key = key
+		}
+		if *flagSigningKey != "" {
+			key, err := db.ReadSigningKey(*flagSigningKey)
+			if err != nil {
+				fatal("Reading signing key:", err)
+			}
+			opts.SigningKey = key
+		}
+		return opts
+	}
+
+	// openReadOnly opens an archive read-only, so that reading or serving
+	// it never writes to it or its index files.
+	openReadOnly := func(file string) *db.DB {
+		opts := archiveOptions()
+		opts.ReadOnly = true
+		d, err := db.Open(file, opts)
+		if err != nil {
+			fatal("Opening archive:", err)
+		}
+		return d
+	}
+
+	if *flagLogFormat == "json" {
+		// The standard logger writes through the default slog handler
+		// once one is set.
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+		logJSON = true
+	}
+
+	if *flagMetricsListen != "" {
+		if err := serveMetrics(*flagMetricsListen); err != nil {
+			fatal("Serving metrics:", err)
+		}
+	}
+
+	switch cmd {
 	case cmdList.FullCommand():
-		cl, err := Client(*flagServer, *flagEmail, *flagPassword, "")
+		cl, err := Client(flagAccount(), "")
 		if err != nil {
-			fmt.Println("Listing mailboxes:", err)
-			os.Exit(1)
+			fatal("Listing mailboxes:", err)
 		}
 		mailboxes, err := cl.Mailboxes()
 		if err != nil {
-			fmt.Println("Listing mailboxes:", err)
-			os.Exit(1)
+			fatal("Listing mailboxes:", err)
 		}
 		for _, mb := range mailboxes {
 			fmt.Println(mb)
 		}
 
 	case cmdFetch.FullCommand():
-		log.Println("Opening archive")
-		dbName := strings.Replace(*flagMailbox, "/", "_", -1) + extension
-		db, err := db.Open(dbName)
+		opts := archiveOptions()
+		opts.Compression = parseCodec(*flagCompression)
+		acc := flagAccount()
+		acc.Concurrency = *flagConcurrency
+		acc.Retries = *flagRetries
+		acc.Pipeline = *flagPipeline
+		batchBytes, err := query.ParseSize(*flagBatchSize)
+		if err != nil || batchBytes <= 0 {
+			fatal("Invalid batch size:", *flagBatchSize)
+		}
+		acc.batchBytes = batchBytes
+		acc.MaxBandwidth = *flagMaxBandwidth
+		acc.MaxRequestsPerSecond = *flagMaxRequests
+		if err := acc.setLimits(); err != nil {
+			fatal("Invalid limits:", err)
+		}
+		acc.rescan = *flagRescan
+		if *flagAll || *flagSince != "" || *flagBefore != "" || *flagMaxSize != "" {
+			acc.window, err = parseWindow(*flagSince, *flagBefore, *flagMaxSize)
+			if err != nil {
+				fatal("Invalid window:", err)
+			}
+		}
+		if *flagDryRun {
+			res, err := dryRunMailbox(acc, *flagMailbox, "", opts)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			log.Println(res)
+			if res.ScanErr != nil {
+				os.Exit(exitFailed)
+			}
+			return
+		}
+		sum := newRunSummary()
+		res, err := fetchMailbox(acc, *flagMailbox, "", opts)
 		if err != nil {
-			log.Fatalln("Failed to open archive:", err)
+			if res == nil {
+				res = &fetchResult{Mailbox: *flagMailbox}
+			}
+			res.Err = err
 		}
+		log.Println(res)
+		sum.add(acc, res)
+		if *flagFetchSummary != "" {
+			if err := sum.write(*flagFetchSummary); err != nil {
+				fatal("Writing summary:", err)
+			}
+		}
+		os.Exit(sum.exitCode())
 
-		log.Printf("Have %d messages", db.Size())
-		uids := findNewUIDs(*flagServer, *flagEmail, *flagPassword, *flagMailbox, db)
+	case cmdSync.FullCommand():
+		cfg, err := loadConfig(*flagConfig)
+		if err != nil {
+			fatal("Reading config:", err)
+		}
+		if *flagSafe {
+			for _, acc := range cfg.Accounts {
+				acc.Safe = true
+			}
+		}
+		sum, err := syncAccounts(cfg, *argSyncAccounts, archiveOptions())
+		if sum != nil && *flagSyncSummary != "" {
+			if err := sum.write(*flagSyncSummary); err != nil {
+				fatal("Writing summary:", err)
+			}
+		}
+		if err != nil {
+			// Logged rather than printed, to keep standard output
+			// for the summary.
+			log.Println("Syncing:", err)
+			if sum != nil {
+				os.Exit(sum.exitCode())
+			}
+			os.Exit(exitFailed)
+		}
 
-		var wg sync.WaitGroup
-		for i := 1; i <= *flagConcurrency; i++ {
-			wg.Add(1)
-			go func(i int) {
-				fetchAndStore(*flagServer, *flagEmail, *flagPassword, *flagMailbox, i, db, uids)
-				wg.Done()
-			}(i)
+	case cmdMigrate.FullCommand():
+		cfg, err := loadConfig(*flagConfig)
+		if err != nil {
+			fatal("Reading config:", err)
+		}
+		src, dst := cfg.account(*argMigrateSource), cfg.account(*argMigrateDestination)
+		if src == nil || dst == nil || src == dst {
+			fatal("Migrating: source and destination must be two different configured accounts")
+		}
+		if *flagSafe {
+			src.Safe = true
+		}
+		if err := migrate(src, dst, *flagMigrateMap, archiveOptions()); err != nil {
+			fatal("Migrating:", err)
 		}
 
-		go func() {
-			for {
-				time.Sleep(10 * time.Second)
-				log.Printf("%d of %d scanned, %d fetched, %d labelupdated",
-					atomic.LoadInt64(&progress.scanned), atomic.LoadInt64(&progress.toScan),
-					atomic.LoadInt64(&progress.fetched), atomic.LoadInt64(&progress.labels))
+	case cmdMbox.FullCommand():
+		db := openReadOnly(*argFile)
+
+		ids := selectMessages(db, *flagMboxQuery)
+		if *flagMboxByLabel != "" {
+			if err := mboxByLabel(db, ids, *flagMboxByLabel); err != nil {
+				fatal("Writing MBOX files:", err)
 			}
-		}()
+			break
+		}
+		n := mbox(db, ids, os.Stdout)
+		log.Printf("Wrote %d messages to stdout", n)
 
-		wg.Wait()
+	case cmdCompact.FullCommand():
+		db, err := db.Open(*argCompactFile, archiveOptions())
+		if err != nil {
+			fatal("Opening archive:", err)
+		}
 
-		err = db.WriteClose()
+		res, err := db.Compact(*flagKeepDeleted)
 		if err != nil {
-			log.Fatalln("Failed to close archive:", err)
+			fatal("Compacting archive:", err)
 		}
 
-	case cmdMbox.FullCommand():
-		db, err := db.Open(*argFile)
+		log.Printf("Compacted to %d messages and %d deletions, %d -> %d bytes (%d bytes reclaimed)",
+			res.Messages, res.Deleted, res.Before, res.After, res.Before-res.After)
+
+	case cmdRecompress.FullCommand():
+		db, err := db.Open(*argRecompressFile, archiveOptions())
 		if err != nil {
-			fmt.Println("Opening archive:", err)
-			os.Exit(1)
+			fatal("Opening archive:", err)
 		}
 
-		mbox(db, os.Stdout)
-	}
-}
+		before, after, err := db.Recompress(parseCodec(*flagRecompressCodec), *flagDictionary)
+		if err != nil {
+			fatal("Recompressing archive:", err)
+		}
 
-func findNewUIDs(server, email, password, mailbox string, db *db.DB) chan msg {
-	client, err := Client(server, email, password, mailbox)
-	if err != nil {
-		log.Fatalln("Failed to connect to server:", err)
-	}
+		log.Printf("Recompressed with %s, %d -> %d bytes", *flagRecompressCodec, before, after)
 
-	atomic.StoreInt64(&progress.toScan, int64(client.Mailbox.Messages))
+	case cmdVerify.FullCommand():
+		var pub ed25519.PublicKey
+		if *flagPublicKey != "" {
+			var err error
+			pub, err = db.ReadPublicKey(*flagPublicKey)
+			if err != nil {
+				fatal("Reading public key:", err)
+			}
+		}
+
+		db := openReadOnly(*argVerifyFile)
 
-	const step = 1000
-	out := make(chan msg, step)
-	go func() {
-		begin := uint32(1)
-		for begin < client.Mailbox.Messages {
-			end := begin + step - 1
-			if end > client.Mailbox.Messages {
-				end = client.Mailbox.Messages
+		res, err := db.Verify(*flagVerifyChain, pub)
+		if err != nil {
+			fatal("Verification failed:", err)
+		}
+
+		fmt.Printf("%d records, %d messages verified\n", res.Records, res.Messages)
+		if *flagVerifyChain {
+			if res.Unchained > 0 {
+				fmt.Printf("%d records predate the hash chain\n", res.Unchained)
+			}
+			if res.Checkpoints > 0 {
+				fmt.Printf("%d checkpoints verified, last at %s\n", res.Checkpoints, res.LastCheckpoint.Format(time.RFC3339))
+			}
+			if res.EmbeddedKey {
+				fmt.Println("Checkpoints verified against their own public key only; give --public-key to check who signed them")
 			}
+			if res.Unsigned > 0 {
+				fmt.Printf("%d records after the last checkpoint\n", res.Unsigned)
+			}
+		}
 
-			msgs, err := client.MsgIDSearch(begin, end, strings.Contains(server, "gmail"))
-			if err != nil {
-				log.Fatalln("Failed to search for messages:", err)
+	case cmdSearch.FullCommand():
+		db := openReadOnly(*argSearchFile)
+
+		ids := selectMessages(db, strings.Join(*argSearchQuery, " "))
+		idx, err := db.SearchIndex()
+		if err != nil {
+			fatal("Reading search index:", err)
+		}
+		for _, id := range ids {
+			hit := idx.Message(id)
+			if hit == nil {
+				// Matched on conditions alone, before the message was
+				// indexed.
+				rec, err := db.Message(id)
+				if err != nil {
+					fatal("Reading message:", err)
+				}
+				hit = fts.Summarize(id, rec.MessageData)
+			}
+			fmt.Printf("%d\t%s\t%s\t%s\n", hit.MessageId, time.Unix(hit.Date, 0).Format("2006-01-02 15:04"), hit.From, hit.Subject)
+		}
+
+	case cmdIndex.FullCommand():
+		db, err := db.Open(*argIndexFile, archiveOptions())
+		if err != nil {
+			fatal("Opening archive:", err)
+		}
+
+		if _, err := db.SearchIndex(); err != nil {
+			fatal("Indexing archive:", err)
+		}
+		if err := db.Close(); err != nil {
+			fatal("Closing archive:", err)
+		}
+
+		log.Printf("Indexed %d messages", db.Size())
+
+	case cmdQuery.FullCommand():
+		db := openReadOnly(*argQueryFile)
+
+		for _, id := range selectMessages(db, strings.Join(*argQuery, " ")) {
+			fmt.Println(id)
+		}
+
+	case cmdDelete.FullCommand():
+		db, err := db.Open(*argDeleteFile, archiveOptions())
+		if err != nil {
+			fatal("Opening archive:", err)
+		}
+
+		q := strings.Join(*argDeleteQuery, " ")
+		if strings.TrimSpace(q) == "" && !*flagDeleteAll {
+			fatal("Deleting: the empty query matches every message; use --all to delete them")
+		}
+		ids := selectMessages(db, q)
+		log.Printf("Deleting %d of %d messages", len(ids), len(db.MessageIDs()))
+		if *flagDeleteDryRun {
+			db.Close()
+			break
+		}
+		for _, id := range ids {
+			if err := db.DeleteMessage(id); err != nil {
+				fatal("Deleting message:", err)
 			}
+		}
+		if err := db.WriteClose(); err != nil {
+			fatal("Closing archive:", err)
+		}
 
-			begin = end + 1
-			atomic.AddInt64(&progress.scanned, int64(len(msgs)))
+		log.Printf("Deleted %d messages", len(ids))
 
-			for _, msg := range msgs {
-				if !db.Have(msg.UID) {
-					out <- msg
-				} else if !sliceEquals(db.Labels(msg.UID), msg.Labels) {
-					db.SetLabels(msg.UID, msg.Labels)
-					atomic.AddInt64(&progress.labels, 1)
+	case cmdThreads.FullCommand():
+		db := openReadOnly(*argThreadsFile)
+
+		threads, err := thread.Load(db)
+		if err != nil {
+			fatal("Threading messages:", err)
+		}
+		if *argThreadsUID != 0 {
+			t := thread.Find(threads, *argThreadsUID)
+			if t == nil {
+				fatal("No message", *argThreadsUID)
+			}
+			threads = []*thread.Node{t}
+		}
+
+		for _, t := range threads {
+			t.Walk(func(n *thread.Node, depth int) {
+				if m := n.Message; m != nil {
+					fmt.Printf("%s%d\t%s\t%s\t%s\n", strings.Repeat("  ", depth), m.ID, m.Date.Format("2006-01-02 15:04"), m.From, m.Subject)
 				}
+			})
+			fmt.Println()
+		}
+
+	case cmdStats.FullCommand():
+		db := openReadOnly(*argStatsFile)
+
+		stats, err := db.Stats(*flagStatsTop)
+		if err != nil {
+			fatal("Reading archive:", err)
+		}
+
+		if *flagStatsJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(stats)
+		} else {
+			printStats(stats)
+		}
+
+	case cmdServeIMAP.FullCommand():
+		srv := &imapserver.Server{
+			Archives: make(map[string]*db.DB),
+		}
+		if *flagServeIMAPLogin != "" {
+			user, pass, ok := strings.Cut(*flagServeIMAPLogin, ":")
+			if !ok {
+				fatal("Login must be given as user:password")
+			}
+			srv.User, srv.Password = user, pass
+		}
+		for _, file := range *argServeIMAPFiles {
+			srv.Archives[archiveName(file)] = openReadOnly(file)
+		}
+
+		l, err := net.Listen("tcp", *flagServeIMAPListen)
+		if err != nil {
+			fatal("Listening:", err)
+		}
+		log.Printf("Serving %d archives over IMAP on %s", len(srv.Archives), l.Addr())
+		if err := srv.Serve(l); err != nil {
+			fatal("Serving IMAP:", err)
+		}
+
+	case cmdServeHTTP.FullCommand():
+		srv := &webui.Server{
+			DB:   openReadOnly(*argServeHTTPFile),
+			Name: archiveName(*argServeHTTPFile),
+		}
+		if *flagServeHTTPLogin != "" {
+			user, pass, ok := strings.Cut(*flagServeHTTPLogin, ":")
+			if !ok {
+				fatal("Login must be given as user:password")
 			}
+			srv.User, srv.Password = user, pass
 		}
-		close(out)
-	}()
 
-	return out
+		l, err := net.Listen("tcp", *flagServeHTTPListen)
+		if err != nil {
+			fatal("Listening:", err)
+		}
+		log.Printf("Serving %s over HTTP on http://%s/", srv.Name, l.Addr())
+		if err := http.Serve(l, srv.Handler()); err != nil {
+			fatal("Serving HTTP:", err)
+		}
+
+	case cmdGenKey.FullCommand():
+		pub, err := db.GenerateSigningKey(*argGenKeyFile)
+		if err != nil {
+			fatal("Generating key:", err)
+		}
+		fmt.Printf("Public key: %x\n", pub)
+	}
+}
+
+// selectMessages returns the IDs of the messages matching the query, or
+// all messages if it is empty.
+func selectMessages(d *db.DB, q string) []uint32 {
+	pq, err := query.Parse(q)
+	if err != nil {
+		fatal("Parsing query:", err)
+	}
+	ids, err := pq.Matches(d)
+	if err != nil {
+		fatal("Querying archive:", err)
+	}
+	return ids
 }
 
-func sliceEquals(a, b []string) bool {
-	if len(a) != len(b) {
-		return false
+// logJSON is set when logging as JSON.
+var logJSON bool
+
+// fatal reports an error and exits with status 1. The error is printed on
+// standard output, or logged when logging as JSON, so that nothing but
+// JSON is written.
+func fatal(a ...any) {
+	if logJSON {
+		slog.Error(strings.TrimSuffix(fmt.Sprintln(a...), "\n"))
+	} else {
+		fmt.Println(a...)
 	}
-	for i := range a {
-		if a[i] != b[i] {
-			return false
+	os.Exit(1)
+}
+
+// archiveName returns the name of an archive file without directory and
+// extension.
+func archiveName(file string) string {
+	return strings.TrimSuffix(filepath.Base(file), extension)
+}
+
+func parseCodec(s string) db.Codec {
+	return db.Codec(db.Codec_value[strings.ToUpper(s)])
+}
+
+// syncAccounts fetches all selected mailboxes of the configured accounts,
+// or of only the named ones, logs a summary and returns it.
+func syncAccounts(cfg *config, names []string, opts db.Options) (*runSummary, error) {
+	accounts := cfg.Accounts
+	if len(names) > 0 {
+		accounts = nil
+		for _, name := range names {
+			acc := cfg.account(name)
+			if acc == nil {
+				return nil, fmt.Errorf("no account %q in configuration", name)
+			}
+			accounts = append(accounts, acc)
 		}
 	}
-	return true
+
+	run := newRunSummary()
+	type summary struct {
+		acc     *account
+		results []*fetchResult
+		err     error
+	}
+	var sums []summary
+	for _, acc := range accounts {
+		res, err := syncAccount(acc, opts)
+		sums = append(sums, summary{acc, res, err})
+	}
+
+	var failed []string
+	for _, sum := range sums {
+		ok := sum.err == nil
+		for _, res := range sum.results {
+			log.Printf("%s/%s", sum.acc.Name, res)
+			run.add(sum.acc, res)
+			ok = ok && res.Complete()
+		}
+		if sum.err != nil {
+			log.Printf("%s: %v", sum.acc.Name, sum.err)
+			run.addError(sum.acc, sum.err)
+		}
+		if !ok {
+			failed = append(failed, sum.acc.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return run, fmt.Errorf("incomplete accounts: %s", strings.Join(failed, ", "))
+	}
+	return run, nil
 }
 
-func fetchAndStore(server, email, password, mailbox string, id int, db *db.DB, msgids chan msg) {
-	client, err := Client(server, email, password, mailbox)
+// syncAccount fetches the selected mailboxes of the account. Mailboxes
+// whose archive cannot be opened or closed are skipped, with the error in
+// their result.
+func syncAccount(acc *account, opts db.Options) ([]*fetchResult, error) {
+	log.Printf("Syncing account %s", acc.Name)
+	if err := acc.resolvePassword(); err != nil {
+		return nil, fmt.Errorf("getting password: %w", err)
+	}
+	cl, err := connect(acc, "", acc.Retries)
 	if err != nil {
-		log.Fatalln("Failed to connect to server:", err)
+		return nil, err
+	}
+	mailboxes, err := accountMailboxes(acc, cl)
+	cl.Logout(time.Second)
+	if err != nil {
+		return nil, err
 	}
 
-	for msgid := range msgids {
-		body, err := client.GetMail(msgid.UID)
+	if err := os.MkdirAll(acc.Directory, 0o700); err != nil {
+		return nil, err
+	}
+	opts.Compression = parseCodec(acc.Compression)
+	var results []*fetchResult
+	for _, mb := range mailboxes {
+		log.Printf("Fetching %s/%s", acc.Name, mb)
+		res, err := fetchMailbox(acc, mb, acc.Directory, opts)
 		if err != nil {
-			log.Println("Failed to get mail, skipping:", err)
-			continue
+			log.Printf("Fetching %s/%s: %v", acc.Name, mb, err)
+			if res == nil {
+				res = &fetchResult{Mailbox: mb}
+			}
+			res.Err = err
 		}
+		results = append(results, res)
+	}
+	return results, nil
+}
 
-		err = db.WriteMessage(msgid.UID, body, msgid.Labels)
+// accountMailboxes returns the mailboxes of the account to archive. In
+// Gmail All Mail mode that is only the mailbox holding every message, as
+// the other mailboxes are views of its labels.
+func accountMailboxes(acc *account, cl *IMAPClient) ([]string, error) {
+	if !acc.GmailAllMail {
+		mailboxes, err := cl.Mailboxes()
 		if err != nil {
-			log.Fatalln("Failed to store message, aborting:", err)
+			return nil, err
 		}
+		return acc.selected(mailboxes), nil
+	}
+	if !cl.Gmail() {
+		return nil, errors.New("gmail_all_mail: server does not support the Gmail extensions")
+	}
+	mb, err := cl.AllMailbox()
+	if err != nil {
+		return nil, fmt.Errorf("gmail_all_mail: %w", err)
+	}
+	return []string{mb}, nil
+}
 
-		atomic.AddInt64(&progress.fetched, 1)
+// mboxByLabel writes the messages to an MBOX file per label in the
+// directory, recreating the mailboxes of a Gmail account archived in All
+// Mail mode. Messages without labels are not written.
+func mboxByLabel(d *db.DB, ids []uint32, dir string) error {
+	byLabel := make(map[string][]uint32)
+	for _, id := range ids {
+		for _, l := range d.Labels(id) {
+			byLabel[l] = append(byLabel[l], id)
+		}
+	}
+	labels := make([]string, 0, len(byLabel))
+	for l := range byLabel {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	for _, l := range labels {
+		name := filepath.Join(dir, strings.Replace(imapserver.LabelName(l), "/", "_", -1)+".mbox")
+		fd, err := os.Create(name)
+		if err != nil {
+			return err
+		}
+		n := mbox(d, byLabel[l], fd)
+		if err := fd.Close(); err != nil {
+			return err
+		}
+		log.Printf("Wrote %d messages to %s", n, name)
 	}
+	return nil
 }
 
-func mbox(db *db.DB, wr io.Writer) {
+// mbox writes the messages to wr in MBOX format and returns the number
+// written.
+func mbox(db *db.DB, ids []uint32, wr io.Writer) int {
 	var nwritten int
 	nl := []byte("\n")
 	from := []byte("From ")
@@ -195,29 +743,40 @@ func mbox(db *db.DB, wr io.Writer) {
 
 	bwr := bufio.NewWriter(wr)
 
-	for {
-		rec, err := db.ReadRecord()
-		if err == io.EOF {
-			break
-		}
-
-		if !db.Have(rec.MessageId) {
-			// Message has been deleted
-			continue
+	for _, id := range ids {
+		// Messages are streamed, so that large ones are not held in
+		// memory.
+		rd, err := db.MessageReader(id)
+		if err != nil {
+			log.Fatalln("Failed to read message:", err)
 		}
+		labels := db.Labels(id)
 
 		bwr.Write([]byte("From MAILER-DAEMON Thu Jan  1 01:00:00 1970\n"))
-		if labels := db.Labels(rec.MessageId); len(labels) > 0 {
+		if len(labels) > 0 {
 			fmt.Fprintf(bwr, "X-Gmail-Labels: %s\n", strings.Join(labels, ","))
 		}
-		sc := bufio.NewScanner(bytes.NewReader(rec.MessageData))
-		for sc.Scan() {
-			line := sc.Bytes()
-			if bytes.HasPrefix(line, from) {
+		brd := bufio.NewReader(rd)
+		start := true // at the start of a line
+		for {
+			line, err := brd.ReadSlice('\n')
+			if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+				log.Fatalln("Failed to read message:", err)
+			}
+			if start && bytes.HasPrefix(line, from) {
 				bwr.Write(esc)
 			}
+			start = err != bufio.ErrBufferFull
+			if start {
+				line = bytes.TrimSuffix(bytes.TrimSuffix(line, nl), []byte("\r"))
+			}
 			bwr.Write(line)
-			bwr.Write(nl)
+			if start && (err == nil || len(line) > 0) {
+				bwr.Write(nl)
+			}
+			if err == io.EOF {
+				break
+			}
 		}
 		bwr.Write(nl)
 		bwr.Flush()
@@ -225,5 +784,5 @@ func mbox(db *db.DB, wr io.Writer) {
 		nwritten++
 	}
 
-	log.Printf("Wrote %d messages to stdout", nwritten)
+	return nwritten
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/calmh/imapchive/db"
+)
+
+func TestMbox(t *testing.T) {
+	d, err := db.Open(filepath.Join(t.TempDir(), "test.imapchive"), db.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	for id, data := range []string{
+		"Subject: one\r\n\r\nFrom here on\r\n>From quoted\r\n",
+		"Subject: two\n\nno newline at the end",
+	} {
+		if err := d.WriteMessage(uint32(id+1), []byte(data), []string{`\Inbox`, "Work"}[:id+1], 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if n := mbox(d, []uint32{1, 2}, &buf); n != 2 {
+		t.Errorf("wrote %d messages, want 2", n)
+	}
+	const want = "From MAILER-DAEMON Thu Jan  1 01:00:00 1970\n" +
+		"X-Gmail-Labels: \\Inbox\n" +
+		"Subject: one\n\n>From here on\n>From quoted\n\n" +
+		"From MAILER-DAEMON Thu Jan  1 01:00:00 1970\n" +
+		"X-Gmail-Labels: \\Inbox,Work\n" +
+		"Subject: two\n\nno newline at the end\n\n"
+	if buf.String() != want {
+		t.Errorf("wrote\n%q\nwant\n%q", buf.String(), want)
+	}
+}
+
+func TestMboxByLabel(t *testing.T) {
+	d, err := db.Open(filepath.Join(t.TempDir(), "test.imapchive"), db.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	for id, labels := range [][]string{
+		{`\Inbox`, "Work/Projects"},
+		{"Work/Projects"},
+		nil,
+		{"&AMQ-rger"}, // modified UTF-7
+	} {
+		if err := d.WriteMessage(uint32(id+1), []byte("Subject: hello\r\n\r\n"), labels, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := filepath.Join(t.TempDir(), "labels")
+	if err := mboxByLabel(d, d.MessageIDs(), dir); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if want := []string{"Inbox.mbox", "Work_Projects.mbox", "Ärger.mbox"}; !slices.Equal(names, want) {
+		t.Errorf("wrote %q, want %q", names, want)
+	}
+
+	// Each file has the messages with the label, and none is written
+	// for messages without labels.
+	for name, want := range map[string]int{"Inbox.mbox": 1, "Work_Projects.mbox": 2, "Ärger.mbox": 1} {
+		bs, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := strings.Count(string(bs), "From MAILER-DAEMON"); n != want {
+			t.Errorf("%s: %d messages, want %d", name, n, want)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics are always collected, and served with --metrics-listen. All are
+// labelled with the account and mailbox.
+var (
+	mailboxLabels = []string{"account", "mailbox"}
+
+	metricScanned = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "imapchive_messages_scanned_total",
+		Help: "Messages scanned on the server.",
+	}, mailboxLabels)
+	metricFetched = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "imapchive_messages_fetched_total",
+		Help: "Messages fetched and written to the archive.",
+	}, mailboxLabels)
+	metricLabels = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "imapchive_label_updates_total",
+		Help: "Messages with updated labels.",
+	}, mailboxLabels)
+	metricBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "imapchive_message_bytes_written_total",
+		Help: "Bytes of message data written to the archive, before compression.",
+	}, mailboxLabels)
+	metricErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "imapchive_errors_total",
+		Help: "Messages that could not be fetched, and scans that stopped early.",
+	}, mailboxLabels)
+	metricRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "imapchive_retries_total",
+		Help: "Messages and scans retried, and connections reestablished.",
+	}, mailboxLabels)
+	metricQueue = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "imapchive_queue_messages",
+		Help: "New messages found by the scan and not yet fetched.",
+	}, mailboxLabels)
+	metricArchiveSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "imapchive_archive_size_bytes",
+		Help: "Size of the archive file.",
+	}, mailboxLabels)
+	metricLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "imapchive_last_success_timestamp_seconds",
+		Help: "Time of the last fetch that got all new messages.",
+	}, mailboxLabels)
+)
+
+// mailboxMetrics are the metrics of one mailbox.
+type mailboxMetrics struct {
+	scanned     prometheus.Counter
+	fetched     prometheus.Counter
+	labels      prometheus.Counter
+	bytes       prometheus.Counter
+	errors      prometheus.Counter
+	retries     prometheus.Counter
+	queue       prometheus.Gauge
+	archiveSize prometheus.Gauge
+	lastSuccess prometheus.Gauge
+}
+
+func newMailboxMetrics(acc *account, mailbox string) *mailboxMetrics {
+	l := prometheus.Labels{"account": acc.label(), "mailbox": mailbox}
+	return &mailboxMetrics{
+		scanned:     metricScanned.With(l),
+		fetched:     metricFetched.With(l),
+		labels:      metricLabels.With(l),
+		bytes:       metricBytes.With(l),
+		errors:      metricErrors.With(l),
+		retries:     metricRetries.With(l),
+		queue:       metricQueue.With(l),
+		archiveSize: metricArchiveSize.With(l),
+		lastSuccess: metricLastSuccess.With(l),
+	}
+}
+
+// label returns the name of the account for metrics: its name in the
+// configuration file, or the email address.
+func (acc *account) label() string {
+	if acc.Name != "" {
+		return acc.Name
+	}
+	return acc.Email
+}
+
+// health is the outcome of the last fetch of each mailbox, for the health
+// endpoint.
+var health struct {
+	mut     sync.Mutex
+	results map[string]healthResult
+}
+
+type healthResult struct {
+	Complete bool      `json:"complete"`
+	Time     time.Time `json:"time"`
+	Summary  string    `json:"summary"`
+}
+
+// recordHealth records the outcome of fetching a mailbox.
+func recordHealth(acc *account, res *fetchResult) {
+	health.mut.Lock()
+	defer health.mut.Unlock()
+	if health.results == nil {
+		health.results = make(map[string]healthResult)
+	}
+	health.results[acc.label()+"/"+res.Mailbox] = healthResult{res.Complete(), time.Now(), res.String()}
+}
+
+// serveMetrics serves the metrics at /metrics, and at /health the outcome
+// of the mailboxes fetched so far, in the background. The health check
+// fails if the last fetch of any mailbox was incomplete.
+func serveMetrics(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Serving metrics on http://%s/metrics", l.Addr())
+	go func() {
+		if err := http.Serve(l, metricsHandler()); err != nil {
+			log.Println("Serving metrics:", err)
+		}
+	}()
+	return nil
+}
+
+// metricsHandler returns the handler for the metrics and health endpoints.
+func metricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.Handler())
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
+		health.mut.Lock()
+		defer health.mut.Unlock()
+
+		status := http.StatusOK
+		names := make([]string, 0, len(health.results))
+		for name, res := range health.results {
+			names = append(names, name)
+			if !res.Complete {
+				status = http.StatusServiceUnavailable
+			}
+		}
+		sort.Strings(names)
+
+		type entry struct {
+			Mailbox string `json:"mailbox"`
+			healthResult
+		}
+		entries := make([]entry, 0, len(names))
+		for _, name := range names {
+			entries = append(entries, entry{name, health.results[name]})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(entries)
+	})
+	return mux
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHealth(t *testing.T) {
+	health.mut.Lock()
+	health.results = nil
+	health.mut.Unlock()
+
+	srv := httptest.NewServer(metricsHandler())
+	defer srv.Close()
+
+	work := &account{Name: "work"}
+	home := &account{Email: "me@example.com"}
+	for _, tc := range []struct {
+		acc       *account
+		res       *fetchResult
+		status    int
+		mailboxes string
+	}{
+		{status: http.StatusOK, mailboxes: ""},
+		{work, &fetchResult{Mailbox: "INBOX", Fetched: 3}, http.StatusOK, "work/INBOX"},
+		{home, &fetchResult{Mailbox: "Sent", ScanErr: errors.New("connection lost")}, http.StatusServiceUnavailable, "me@example.com/Sent work/INBOX"},
+		// The last fetch of each mailbox counts.
+		{home, &fetchResult{Mailbox: "Sent"}, http.StatusOK, "me@example.com/Sent work/INBOX"},
+		{work, &fetchResult{Mailbox: "INBOX", Failed: []uint32{7}}, http.StatusServiceUnavailable, "me@example.com/Sent work/INBOX"},
+	} {
+		if tc.res != nil {
+			tc.res.metrics = newMailboxMetrics(tc.acc, tc.res.Mailbox)
+			recordHealth(tc.acc, tc.res)
+		}
+
+		resp, err := http.Get(srv.URL + "/health")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entries []struct {
+			Mailbox  string `json:"mailbox"`
+			Complete bool   `json:"complete"`
+			Summary  string `json:"summary"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&entries)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var mailboxes []string
+		for _, e := range entries {
+			mailboxes = append(mailboxes, e.Mailbox)
+			if e.Summary == "" {
+				t.Errorf("%s: no summary", e.Mailbox)
+			}
+		}
+		if resp.StatusCode != tc.status || strings.Join(mailboxes, " ") != tc.mailboxes {
+			t.Errorf("status %d, mailboxes %q, want %d, %q", resp.StatusCode, mailboxes, tc.status, tc.mailboxes)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	srv := httptest.NewServer(metricsHandler())
+	defer srv.Close()
+
+	m := newMailboxMetrics(&account{Name: "metrics-test"}, "Archive")
+	m.fetched.Add(2)
+	m.bytes.Add(4096)
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	bs, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`imapchive_messages_fetched_total{account="metrics-test",mailbox="Archive"} 2`,
+		`imapchive_message_bytes_written_total{account="metrics-test",mailbox="Archive"} 4096`,
+	} {
+		if !strings.Contains(string(bs), want) {
+			t.Errorf("metrics lack %s", want)
+		}
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/calmh/imapchive/db"
+	"github.com/mxk/go-imap/imap"
+)
+
+// migrateResult summarises the migration of a mailbox.
+type migrateResult struct {
+	Mailbox     string // in the source account
+	Destination string
+	Appended    int
+	Skipped     int      // migrated by an earlier run
+	Failed      []uint32 // source UIDs that could not be appended
+	Err         error    // set if the mailbox could not be migrated
+}
+
+// Complete reports whether all archived messages were migrated.
+func (r *migrateResult) Complete() bool {
+	return r.Err == nil && len(r.Failed) == 0
+}
+
+func (r *migrateResult) String() string {
+	s := fmt.Sprintf("%s -> %s: %d appended, %d already migrated", r.Mailbox, r.Destination, r.Appended, r.Skipped)
+	if len(r.Failed) > 0 {
+		s += fmt.Sprintf(", %d failed (UIDs %s)", len(r.Failed), uidList(r.Failed, 10))
+	}
+	if r.Err != nil {
+		s += fmt.Sprintf(", incomplete: %v", r.Err)
+	}
+	return s
+}
+
+// migrator appends archived messages to the destination account.
+type migrator struct {
+	src, dst *account
+	mapping  map[string]string // source to destination mailbox names
+	srcDelim string
+	dstDelim string
+	client   *IMAPClient // connected to the destination
+}
+
+// migrate fetches the selected mailboxes of the source account into their
+// archives, then appends the archived messages to the destination
+// account, with their flags and internal dates as found on the source.
+// Mailboxes are renamed according to the mapping, and otherwise keep their
+// names, using the destination's hierarchy delimiter. Progress is recorded
+// in each archive, so that an interrupted migration can be run again
+// without duplicating messages.
+func migrate(src, dst *account, mapping map[string]string, opts db.Options) error {
+	if dst.Safe {
+		return errors.New("the destination account cannot be used in safe mode")
+	}
+	if err := dst.resolvePassword(); err != nil {
+		return fmt.Errorf("getting destination password: %w", err)
+	}
+
+	results, syncErr := syncAccount(src, opts)
+	if syncErr != nil {
+		log.Printf("%s: %v", src.Name, syncErr)
+	}
+
+	m := &migrator{src: src, dst: dst, mapping: mapping}
+	var err error
+	if m.srcDelim, err = delimiter(src); err != nil {
+		return fmt.Errorf("source: %w", err)
+	}
+	if m.client, err = connect(dst, "", dst.Retries); err != nil {
+		return fmt.Errorf("destination: %w", err)
+	}
+	defer func() { m.client.Logout(time.Second) }()
+	if m.dstDelim, err = m.client.Delimiter(); err != nil {
+		return fmt.Errorf("destination: %w", err)
+	}
+
+	var failed []string
+	for _, res := range results {
+		if !res.Complete() {
+			log.Printf("%s/%s", src.Name, res)
+		}
+		if res.Err != nil {
+			failed = append(failed, res.Mailbox)
+			continue
+		}
+		log.Printf("Migrating %s/%s", src.Name, res.Mailbox)
+		mres := m.mailbox(res.Mailbox, opts)
+		log.Printf("%s/%s", src.Name, mres)
+		if !res.Complete() || !mres.Complete() {
+			failed = append(failed, res.Mailbox)
+		}
+	}
+
+	if syncErr != nil {
+		return syncErr
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("incomplete mailboxes: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// delimiter returns the hierarchy delimiter of the account's server.
+func delimiter(acc *account) (string, error) {
+	cl, err := connect(acc, "", acc.Retries)
+	if err != nil {
+		return "", err
+	}
+	defer cl.Logout(time.Second)
+	return cl.Delimiter()
+}
+
+// destination returns the name of the destination mailbox for a source
+// mailbox.
+func (m *migrator) destination(mailbox string) string {
+	if name, ok := m.mapping[mailbox]; ok {
+		return name
+	}
+	if m.srcDelim == "" || m.dstDelim == "" {
+		return mailbox
+	}
+	return strings.ReplaceAll(mailbox, m.srcDelim, m.dstDelim)
+}
+
+// sourceInfo is what the source server says about a message.
+type sourceInfo struct {
+	flags imap.FlagSet
+	date  time.Time
+}
+
+// mailbox appends the archived messages of a mailbox that have not yet
+// been migrated.
+func (m *migrator) mailbox(mailbox string, opts db.Options) *migrateResult {
+	res := &migrateResult{Mailbox: mailbox, Destination: m.destination(mailbox)}
+
+	opts.Source = nil
+	archive, err := db.Open(archiveFile(m.src.Directory, mailbox), opts)
+	if err != nil {
+		res.Err = fmt.Errorf("open archive: %w", err)
+		return res
+	}
+	defer archive.Close()
+	defer func() {
+		if err := archive.WriteClose(); err != nil && res.Err == nil {
+			res.Err = fmt.Errorf("close archive: %w", err)
+		}
+	}()
+
+	done, _ := archive.Migration(m.dst.Name)
+	var todo []uint32
+	for _, uid := range archive.MessageIDs() {
+		if done[uid] {
+			res.Skipped++
+		} else {
+			todo = append(todo, uid)
+		}
+	}
+	if len(todo) == 0 {
+		return res
+	}
+
+	info, err := m.sourceInfo(mailbox, todo)
+	if err != nil {
+		res.Err = fmt.Errorf("source flags: %w", err)
+		return res
+	}
+
+	if err := m.ensureMailbox(res.Destination); err != nil {
+		res.Err = err
+		return res
+	}
+
+	for _, uid := range todo {
+		size, err := archive.MessageSize(uid)
+		if err != nil {
+			res.Err = fmt.Errorf("read message %d: %w", uid, err)
+			return res
+		}
+		if size > math.MaxUint32 {
+			log.Printf("Message %d of %d bytes is too large to append, skipping", uid, size)
+			res.Failed = append(res.Failed, uid)
+			continue
+		}
+
+		msg := &archivedMessage{archive: archive, uid: uid, size: size}
+		appended, err := m.deliver(archive, res.Destination, msg, info[uid])
+		switch {
+		case errors.Is(err, errGiveUp) || errors.Is(err, errState):
+			res.Err = err
+			return res
+		case err != nil:
+			log.Printf("Failed to append message %d, skipping: %v", uid, err)
+			res.Failed = append(res.Failed, uid)
+		case appended:
+			res.Appended++
+		default:
+			res.Skipped++
+		}
+	}
+	return res
+}
+
+// deliver appends a message to the destination mailbox, unless an earlier
+// attempt that was interrupted turns out to have delivered it. It reports
+// whether the message was appended.
+func (m *migrator) deliver(archive *db.DB, mailbox string, msg *archivedMessage, info sourceInfo) (bool, error) {
+	uid := msg.uid
+	for attempt := 0; ; attempt++ {
+		if _, appending := archive.Migration(m.dst.Name); appending[uid] {
+			found, err := m.find(mailbox, msg)
+			if err != nil {
+				return false, err
+			}
+			if found {
+				return false, m.mark(archive.MarkAppended, uid)
+			}
+		}
+
+		if err := m.mark(archive.MarkAppending, uid); err != nil {
+			return false, err
+		}
+		err := m.append(mailbox, msg, info)
+		if err == nil {
+			return true, m.mark(archive.MarkAppended, uid)
+		}
+		if !connectionLost(m.client, err) {
+			return false, err
+		}
+		// The message may have arrived before the connection was lost,
+		// so it is looked for before being appended again.
+		if err := m.reconnect(attempt, err); err != nil {
+			return false, err
+		}
+	}
+}
+
+// mark records migration progress using one of the archive's Mark
+// methods.
+func (m *migrator) mark(fn func(string, uint32) error, uid uint32) error {
+	if err := fn(m.dst.Name, uid); err != nil {
+		return fmt.Errorf("%w: %v", errState, err)
+	}
+	return nil
+}
+
+// sourceInfo returns the flags and internal dates of the given messages
+// in the source mailbox.
+func (m *migrator) sourceInfo(mailbox string, uids []uint32) (map[uint32]sourceInfo, error) {
+	cl, err := connect(m.src, mailbox, m.src.Retries)
+	if err != nil {
+		return nil, err
+	}
+	defer cl.Logout(time.Second)
+
+	res := make(map[uint32]sourceInfo)
+	for len(uids) > 0 {
+		n := min(len(uids), 1000)
+		set := &imap.SeqSet{}
+		set.AddNum(uids[:n]...)
+		uids = uids[n:]
+
+		cmd, err := imap.Wait(cl.UIDFetch(set, "FLAGS", "INTERNALDATE"))
+		if err != nil {
+			return nil, err
+		}
+		for _, rsp := range cmd.Data {
+			if info := rsp.MessageInfo(); info != nil {
+				res[info.UID] = sourceInfo{info.Flags, info.InternalDate}
+			}
+		}
+	}
+	return res, nil
+}
+
+// ensureMailbox creates the destination mailbox if it does not exist.
+func (m *migrator) ensureMailbox(name string) error {
+	return m.retry(func() error {
+		cmd, err := imap.Wait(m.client.List("", imap.UTF7Encode(name)))
+		if err != nil {
+			return err
+		}
+		if len(cmd.Data) > 0 {
+			return nil
+		}
+		log.Printf("Creating mailbox %s", name)
+		_, err = imap.Wait(m.client.Create(name))
+		return err
+	})
+}
+
+// append appends a message to the destination mailbox. The internal date
+// is taken from the source, or failing that from the Date header. The
+// \Recent flag cannot be set by clients and is dropped.
+func (m *migrator) append(mailbox string, msg *archivedMessage, info sourceInfo) error {
+	flags := imap.FlagSet{}
+	for flag := range info.flags {
+		if !strings.EqualFold(flag, `\Recent`) {
+			flags[flag] = true
+		}
+	}
+	date := info.date
+	if date.IsZero() {
+		date, _ = msg.header().Date()
+	}
+	var idate *time.Time
+	if !date.IsZero() {
+		idate = &date
+	}
+
+	_, err := imap.Wait(m.client.Append(mailbox, flags, idate, msg))
+	return err
+}
+
+// find reports whether the message is present in the destination
+// mailbox, looking for its Message-ID or, lacking one, comparing it to the
+// messages of the same size. The mailbox is left selected read-only, which
+// does not affect appending.
+func (m *migrator) find(mailbox string, msg *archivedMessage) (bool, error) {
+	msgID := msg.header().Get("Message-Id")
+	var hash []byte
+	if msgID == "" {
+		var err error
+		if hash, err = msg.hash(); err != nil {
+			return false, fmt.Errorf("read message %d: %w", msg.uid, err)
+		}
+	}
+
+	found := false
+	err := m.retry(func() error {
+		found = false
+		if _, err := m.client.Select(mailbox, true); err != nil {
+			return err
+		}
+		if msgID != "" {
+			cmd, err := imap.Wait(m.client.UIDSearch("HEADER", "Message-ID", m.client.Quote(msgID)))
+			if err != nil {
+				return err
+			}
+			for _, rsp := range cmd.Data {
+				found = found || len(rsp.SearchResults()) > 0
+			}
+			return nil
+		}
+
+		cmd, err := imap.Wait(m.client.UIDSearch("LARGER", uint32(msg.size-1), "SMALLER", uint32(msg.size+1)))
+		if err != nil {
+			return err
+		}
+		set := &imap.SeqSet{}
+		for _, rsp := range cmd.Data {
+			set.AddNum(rsp.SearchResults()...)
+		}
+		if set.Empty() {
+			return nil
+		}
+		cmd, err = imap.Wait(m.client.UIDFetch(set, "BODY.PEEK[]"))
+		if err != nil {
+			return err
+		}
+		for _, rsp := range cmd.Data {
+			if info := rsp.MessageInfo(); info != nil {
+				sum := sha256.Sum256(imap.AsBytes(info.Attrs["BODY[]"]))
+				found = found || bytes.Equal(sum[:], hash)
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+// archivedMessage is a message to append, read from the archive as it is
+// sent, so that large messages are never held in memory. Its size comes
+// from the archive beforehand, as the literal announces it.
+type archivedMessage struct {
+	archive *db.DB
+	uid     uint32
+	size    int64
+}
+
+// Info implements imap.Literal.
+func (a *archivedMessage) Info() imap.LiteralInfo {
+	return imap.LiteralInfo{Len: uint32(a.size)}
+}
+
+// WriteTo implements imap.Literal, writing the message as archived.
+func (a *archivedMessage) WriteTo(w io.Writer) (int64, error) {
+	r, err := a.archive.MessageReader(a.uid)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(w, io.LimitReader(r, a.size))
+	if err == nil && n != a.size {
+		err = fmt.Errorf("message %d: %w", a.uid, io.ErrUnexpectedEOF)
+	}
+	return n, err
+}
+
+// header returns the header of the message, reading no further, or an
+// empty header if it cannot be read.
+func (a *archivedMessage) header() mail.Header {
+	if r, err := a.archive.MessageReader(a.uid); err == nil {
+		if msg, err := mail.ReadMessage(r); err == nil {
+			return msg.Header
+		}
+	}
+	return make(mail.Header)
+}
+
+// hash returns the SHA-256 hash of the message.
+func (a *archivedMessage) hash() ([]byte, error) {
+	r, err := a.archive.MessageReader(a.uid)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// errState is returned when migration progress cannot be recorded.
+var errState = errors.New("recording migration progress")
+
+// errGiveUp is returned when the destination cannot be reached.
+var errGiveUp = errors.New("giving up on the destination server")
+
+// retry runs fn, which must be safe to repeat, reconnecting to the
+// destination and retrying if the connection is lost. The server refusing
+// a command is returned as is.
+func (m *migrator) retry(fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !connectionLost(m.client, err) {
+			return err
+		}
+		if err := m.reconnect(attempt, err); err != nil {
+			return err
+		}
+	}
+}
+
+// reconnect reconnects to the destination after waiting for retry number
+// attempt, or gives up.
+func (m *migrator) reconnect(attempt int, err error) error {
+	if attempt >= m.dst.Retries {
+		return fmt.Errorf("%w: %v", errGiveUp, err)
+	}
+	delay := backoff(attempt)
+	log.Printf("Lost connection to destination, reconnecting in %v: %v", delay, err)
+	time.Sleep(delay)
+	m.client.Logout(0)
+	cl, err := connect(m.dst, "", m.dst.Retries)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errGiveUp, err)
+	}
+	m.client = cl
+	return nil
+}
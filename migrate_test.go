@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/calmh/imapchive/db"
+)
+
+func TestArchivedMessage(t *testing.T) {
+	d, err := db.Open(filepath.Join(t.TempDir(), "test.imapchive"), db.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	small := "Message-ID: <1@example.com>\r\nSubject: small\r\n\r\nbody\r\n"
+	large := "Subject: large\r\nDate: Sat, 5 Jan 2019 10:00:00 +0000\r\n\r\n" + strings.Repeat("0123456789abcdef\r\n", 300000)
+	if err := d.WriteMessage(1, []byte(small), nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.WriteMessageStream(2, strings.NewReader(large), nil, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		uid   uint32
+		data  string
+		msgID string
+	}{
+		{1, small, "<1@example.com>"},
+		{2, large, ""},
+	} {
+		size, err := d.MessageSize(tc.uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := &archivedMessage{archive: d, uid: tc.uid, size: size}
+		if n := msg.Info().Len; n != uint32(len(tc.data)) {
+			t.Errorf("message %d: literal of %d bytes, want %d", tc.uid, n, len(tc.data))
+		}
+		// Written again for each attempt to append it.
+		for i := 0; i < 2; i++ {
+			var buf bytes.Buffer
+			if n, err := msg.WriteTo(&buf); err != nil || n != size || buf.String() != tc.data {
+				t.Errorf("message %d: wrote %d bytes, %v", tc.uid, n, err)
+			}
+		}
+		if id := msg.header().Get("Message-Id"); id != tc.msgID {
+			t.Errorf("message %d: Message-ID %q, want %q", tc.uid, id, tc.msgID)
+		}
+		want := sha256.Sum256([]byte(tc.data))
+		if hash, err := msg.hash(); err != nil || !bytes.Equal(hash, want[:]) {
+			t.Errorf("message %d: hash %x, %v", tc.uid, hash, err)
+		}
+	}
+
+	// A literal announcing more than the archive holds fails rather than
+	// sending short.
+	msg := &archivedMessage{archive: d, uid: 1, size: int64(len(small)) + 1}
+	if _, err := msg.WriteTo(new(bytes.Buffer)); err == nil {
+		t.Error("short message written")
+	}
+}
@@ -0,0 +1,251 @@
+package query
+
+import (
+	"io"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/calmh/imapchive/db"
+	"github.com/calmh/imapchive/fts"
+	"github.com/calmh/imapchive/thread"
+)
+
+// Matches returns the IDs of the live messages in the archive matching
+// the query, in increasing order. Message data is only read as needed to
+// decide the query, and then streamed rather than read into memory. Sizes
+// come from the search index where it has them.
+func (q *Query) Matches(d *db.DB) ([]uint32, error) {
+	var idx *fts.Index
+	if len(q.texts) > 0 || len(q.sizes) > 0 {
+		var err error
+		idx, err = d.SearchIndex()
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range q.texts {
+			t.ids = make(map[uint32]bool)
+			for _, id := range idx.Search(fts.Phrase(t.phrase)) {
+				t.ids[id] = true
+			}
+		}
+	}
+
+	if len(q.threads) > 0 {
+		threads, err := thread.Load(d)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range q.threads {
+			t.ids = make(map[uint32]bool)
+			if root := thread.Find(threads, t.id); root != nil {
+				for _, id := range root.IDs() {
+					t.ids[id] = true
+				}
+			}
+		}
+	}
+
+	var res []uint32
+	for _, id := range d.MessageIDs() {
+		if q.root == nil {
+			res = append(res, id)
+			continue
+		}
+		m := &message{db: d, id: id, size: -1}
+		if idx != nil {
+			m.summary = idx.Message(id)
+		}
+		ok, err := q.root.match(m)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			res = append(res, id)
+		}
+	}
+	return res, nil
+}
+
+// message is a candidate message, read from the archive when first
+// needed.
+type message struct {
+	db      *db.DB
+	id      uint32
+	summary *fts.Message // from the search index, if loaded and covering the message
+	size    int64        // -1 until known
+	hdr     mail.Header
+}
+
+// header returns the message header, reading no further than its end.
+func (m *message) header() (mail.Header, error) {
+	if m.hdr != nil {
+		return m.hdr, nil
+	}
+	r, err := m.db.MessageReader(m.id)
+	if err != nil {
+		return nil, err
+	}
+	m.hdr = make(mail.Header)
+	if msg, err := mail.ReadMessage(r); err == nil {
+		m.hdr = msg.Header
+	}
+	return m.hdr, nil
+}
+
+// rawSize returns the size of the message, from the search index or else
+// by reading through the message.
+func (m *message) rawSize() (int64, error) {
+	if m.size >= 0 {
+		return m.size, nil
+	}
+	if m.summary != nil && m.summary.Size > 0 {
+		m.size = m.summary.Size
+		return m.size, nil
+	}
+	r, err := m.db.MessageReader(m.id)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(io.Discard, r)
+	if err != nil {
+		return 0, err
+	}
+	m.size = n
+	return n, nil
+}
+
+type node interface {
+	match(m *message) (bool, error)
+}
+
+type andNode []node
+
+func (n andNode) match(m *message) (bool, error) {
+	for _, sub := range n {
+		if ok, err := sub.match(m); err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+type orNode []node
+
+func (n orNode) match(m *message) (bool, error) {
+	for _, sub := range n {
+		if ok, err := sub.match(m); err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+type notNode struct {
+	node
+}
+
+func (n notNode) match(m *message) (bool, error) {
+	ok, err := n.node.match(m)
+	return !ok, err
+}
+
+type textNode struct {
+	phrase string
+	ids    map[uint32]bool
+}
+
+func (n *textNode) match(m *message) (bool, error) {
+	return n.ids[m.id], nil
+}
+
+type headerNode struct {
+	header string
+	value  string // lower case
+}
+
+func (n *headerNode) match(m *message) (bool, error) {
+	hdr, err := m.header()
+	if err != nil {
+		return false, err
+	}
+	v := strings.ToLower(fts.DecodeHeader(hdr.Get(n.header)))
+	return strings.Contains(v, n.value), nil
+}
+
+type labelNode struct {
+	label string // normalized
+}
+
+func (n *labelNode) match(m *message) (bool, error) {
+	for _, l := range m.db.Labels(m.id) {
+		if normalizeLabel(l) == n.label {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type dateNode struct {
+	t     time.Time
+	after bool
+}
+
+func (n *dateNode) match(m *message) (bool, error) {
+	hdr, err := m.header()
+	if err != nil {
+		return false, err
+	}
+	date, err := hdr.Date()
+	if err != nil {
+		// Messages without a usable date match neither bound.
+		return false, nil
+	}
+	if n.after {
+		return !date.Before(n.t), nil
+	}
+	return date.Before(n.t), nil
+}
+
+type sizeNode struct {
+	size   int64
+	larger bool
+}
+
+func (n *sizeNode) match(m *message) (bool, error) {
+	size, err := m.rawSize()
+	if err != nil {
+		return false, err
+	}
+	if n.larger {
+		return size > n.size, nil
+	}
+	return size < n.size, nil
+}
+
+type attachmentNode struct{}
+
+func (attachmentNode) match(m *message) (bool, error) {
+	r, err := m.db.MessageReader(m.id)
+	if err != nil {
+		return false, err
+	}
+	return fts.HasAttachment(r), nil
+}
+
+type uidNode struct {
+	lo, hi uint32
+}
+
+func (n *uidNode) match(m *message) (bool, error) {
+	return m.id >= n.lo && m.id <= n.hi, nil
+}
+
+type threadNode struct {
+	id  uint32
+	ids map[uint32]bool
+}
+
+func (n *threadNode) match(m *message) (bool, error) {
+	return n.ids[m.id], nil
+}
@@ -0,0 +1,374 @@
+// Package query implements a query language for selecting messages from
+// an archive, combining full-text search with conditions on headers,
+// labels, dates, sizes and attachments.
+package query
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/calmh/imapchive/fts"
+)
+
+// Query is a parsed query.
+type Query struct {
+	root    node
+	texts   []*textNode
+	threads []*threadNode
+	sizes   []*sizeNode
+}
+
+// Parse parses a query. A query is a sequence of terms that must all
+// match; terms can be combined with OR, negated with NOT or a leading
+// minus, and grouped with parentheses. A term is either words or a
+// "quoted phrase" to search for in the message text, or a condition:
+//
+//	from:alice        From header contains "alice"
+//	to:, cc:, subject:  likewise for those headers
+//	label:Important   message has the label (case insensitive)
+//	after:2019-01-01  message date is on or after the day
+//	before:2019-01-01 message date is before the day
+//	larger:5M         message is larger than the size (K, M or G)
+//	smaller:100K      message is smaller than the size
+//	has:attachment    message has attachments
+//	uid:100 uid:100-200  message ID is, or is in, the range
+//	thread:100        message is in the same thread as message 100
+//
+// Condition values may be quoted. The empty query matches all messages.
+func Parse(s string) (*Query, error) {
+	p := &parser{toks: lex(s)}
+	q := &Query{}
+	if len(p.toks) == 0 {
+		return q, nil
+	}
+
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected %q", p.toks[p.pos].text)
+	}
+	q.root = root
+	q.texts = p.texts
+	q.threads = p.threads
+	q.sizes = p.sizes
+	return q, nil
+}
+
+var fields = map[string]func(string) (node, error){
+	"from":    headerCond("From"),
+	"to":      headerCond("To"),
+	"cc":      headerCond("Cc"),
+	"subject": headerCond("Subject"),
+	"label":   labelCond,
+	"after":   dateCond(true),
+	"before":  dateCond(false),
+	"larger":  sizeCond(true),
+	"smaller": sizeCond(false),
+	"has":     hasCond,
+	"uid":     uidCond,
+	"thread":  threadCond,
+}
+
+func headerCond(name string) func(string) (node, error) {
+	return func(v string) (node, error) {
+		return &headerNode{header: name, value: strings.ToLower(v)}, nil
+	}
+}
+
+func labelCond(v string) (node, error) {
+	return &labelNode{label: normalizeLabel(v)}, nil
+}
+
+func dateCond(after bool) func(string) (node, error) {
+	return func(v string) (node, error) {
+		for _, layout := range []string{"2006-01-02", "2006/01/02"} {
+			if t, err := time.ParseInLocation(layout, v, time.Local); err == nil {
+				return &dateNode{t: t, after: after}, nil
+			}
+		}
+		return nil, fmt.Errorf("invalid date %q (expected YYYY-MM-DD)", v)
+	}
+}
+
+func sizeCond(larger bool) func(string) (node, error) {
+	return func(v string) (node, error) {
+		size, err := ParseSize(v)
+		if err != nil {
+			return nil, err
+		}
+		return &sizeNode{size: size, larger: larger}, nil
+	}
+}
+
+func hasCond(v string) (node, error) {
+	if strings.ToLower(v) != "attachment" {
+		return nil, fmt.Errorf("unknown has:%s (expected has:attachment)", v)
+	}
+	return attachmentNode{}, nil
+}
+
+func uidCond(v string) (node, error) {
+	lo, hi, found := strings.Cut(v, "-")
+	l, err := strconv.ParseUint(lo, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid uid %q", v)
+	}
+	h := l
+	if found {
+		if h, err = strconv.ParseUint(hi, 10, 32); err != nil {
+			return nil, fmt.Errorf("invalid uid %q", v)
+		}
+	}
+	return &uidNode{lo: uint32(l), hi: uint32(h)}, nil
+}
+
+func threadCond(v string) (node, error) {
+	id, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid thread %q", v)
+	}
+	return &threadNode{id: uint32(id)}, nil
+}
+
+// ParseSize parses a size in bytes, with an optional K, M or G suffix
+// for binary multiples.
+func ParseSize(s string) (int64, error) {
+	mult := int64(1)
+	if s == "" {
+		return 0, errors.New("empty size")
+	}
+	num := s
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		num = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if n > math.MaxInt64/mult {
+		return 0, fmt.Errorf("size %q too large", s)
+	}
+	return n * mult, nil
+}
+
+// normalizeLabel makes Gmail system labels such as \Important match
+// their plain names.
+func normalizeLabel(l string) string {
+	return strings.ToLower(strings.TrimPrefix(l, `\`))
+}
+
+type tokenKind int
+
+const (
+	tokWord tokenKind = iota
+	tokPhrase
+	tokField
+	tokOpen
+	tokClose
+	tokNot
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	field string
+}
+
+func lex(s string) []token {
+	var toks []token
+	for {
+		s = strings.TrimLeftFunc(s, unicode.IsSpace)
+		if s == "" {
+			return toks
+		}
+
+		switch s[0] {
+		case '(':
+			toks = append(toks, token{kind: tokOpen, text: "("})
+			s = s[1:]
+			continue
+		case ')':
+			toks = append(toks, token{kind: tokClose, text: ")"})
+			s = s[1:]
+			continue
+		case '-':
+			toks = append(toks, token{kind: tokNot, text: "-"})
+			s = s[1:]
+			continue
+		case '"':
+			var text string
+			text, s = quoted(s)
+			toks = append(toks, token{kind: tokPhrase, text: text})
+			continue
+		}
+
+		end := strings.IndexFunc(s, func(r rune) bool {
+			return unicode.IsSpace(r) || r == '(' || r == ')' || r == '"' || r == ':'
+		})
+		if end < 0 {
+			end = len(s)
+		}
+		word := s[:end]
+		s = s[end:]
+
+		if strings.HasPrefix(s, ":") {
+			if _, ok := fields[strings.ToLower(word)]; ok {
+				var value string
+				if strings.HasPrefix(s[1:], `"`) {
+					value, s = quoted(s[1:])
+				} else {
+					end := strings.IndexFunc(s[1:], func(r rune) bool {
+						return unicode.IsSpace(r) || r == '(' || r == ')'
+					})
+					if end < 0 {
+						end = len(s) - 1
+					}
+					value, s = s[1:end+1], s[end+1:]
+				}
+				toks = append(toks, token{kind: tokField, text: value, field: strings.ToLower(word)})
+				continue
+			}
+
+			// Not a condition; the colon is part of the word.
+			word += ":"
+			s = s[1:]
+		}
+		toks = append(toks, token{kind: tokWord, text: word})
+	}
+}
+
+// quoted returns the contents of the quoted string at the start of s,
+// and the remainder of s.
+func quoted(s string) (string, string) {
+	end := strings.IndexByte(s[1:], '"')
+	if end < 0 {
+		return s[1:], ""
+	}
+	return s[1 : end+1], s[end+2:]
+}
+
+type parser struct {
+	toks    []token
+	pos     int
+	texts   []*textNode
+	threads []*threadNode
+	sizes   []*sizeNode
+}
+
+func (p *parser) peek() *token {
+	if p.pos >= len(p.toks) {
+		return nil
+	}
+	return &p.toks[p.pos]
+}
+
+func (p *parser) or() (node, error) {
+	var terms orNode
+	for {
+		n, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, n)
+
+		if t := p.peek(); t == nil || t.kind != tokWord || t.text != "OR" {
+			break
+		}
+		p.pos++
+	}
+	if len(terms) == 1 {
+		return terms[0], nil
+	}
+	return terms, nil
+}
+
+func (p *parser) and() (node, error) {
+	var terms andNode
+	for {
+		t := p.peek()
+		if t == nil || t.kind == tokClose || t.kind == tokWord && t.text == "OR" {
+			break
+		}
+		n, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, n)
+	}
+	switch len(terms) {
+	case 0:
+		return nil, errors.New("empty expression")
+	case 1:
+		return terms[0], nil
+	}
+	return terms, nil
+}
+
+func (p *parser) unary() (node, error) {
+	t := p.peek()
+	if t.kind == tokNot || t.kind == tokWord && t.text == "NOT" {
+		p.pos++
+		if p.peek() == nil {
+			return nil, errors.New("missing term after NOT")
+		}
+		n, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{n}, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (node, error) {
+	t := p.peek()
+	p.pos++
+	switch t.kind {
+	case tokOpen:
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.peek(); t == nil || t.kind != tokClose {
+			return nil, errors.New("missing )")
+		}
+		p.pos++
+		return n, nil
+
+	case tokField:
+		n, err := fields[t.field](t.text)
+		switch n := n.(type) {
+		case *threadNode:
+			p.threads = append(p.threads, n)
+		case *sizeNode:
+			p.sizes = append(p.sizes, n)
+		}
+		return n, err
+
+	case tokWord, tokPhrase:
+		if len(fts.Tokenize(t.text)) == 0 {
+			return nil, fmt.Errorf("nothing to search for in %q", t.text)
+		}
+		n := &textNode{phrase: t.text}
+		p.texts = append(p.texts, n)
+		return n, nil
+
+	default:
+		return nil, fmt.Errorf("unexpected %q", t.text)
+	}
+}
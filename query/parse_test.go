@@ -0,0 +1,241 @@
+package query
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/calmh/imapchive/db"
+)
+
+// format returns the parse tree of a node as an S-expression.
+func format(n node) string {
+	list := func(op string, ns []node) string {
+		parts := []string{op}
+		for _, n := range ns {
+			parts = append(parts, format(n))
+		}
+		return "(" + strings.Join(parts, " ") + ")"
+	}
+	switch n := n.(type) {
+	case nil:
+		return "all"
+	case andNode:
+		return list("and", n)
+	case orNode:
+		return list("or", n)
+	case notNode:
+		return "(not " + format(n.node) + ")"
+	case *textNode:
+		return fmt.Sprintf("%q", n.phrase)
+	case *headerNode:
+		return fmt.Sprintf("%s:%q", n.header, n.value)
+	case *labelNode:
+		return fmt.Sprintf("label:%q", n.label)
+	case *dateNode:
+		if n.after {
+			return "after:" + n.t.Format("2006-01-02")
+		}
+		return "before:" + n.t.Format("2006-01-02")
+	case *sizeNode:
+		if n.larger {
+			return fmt.Sprintf("larger:%d", n.size)
+		}
+		return fmt.Sprintf("smaller:%d", n.size)
+	case attachmentNode:
+		return "has:attachment"
+	case *uidNode:
+		return fmt.Sprintf("uid:%d-%d", n.lo, n.hi)
+	case *threadNode:
+		return fmt.Sprintf("thread:%d", n.id)
+	}
+	return fmt.Sprintf("?%T", n)
+}
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		query string
+		tree  string // or the start of the error
+		err   bool
+	}{
+		{query: "", tree: "all"},
+		{query: "   ", tree: "all"},
+		{query: "budget", tree: `"budget"`},
+		{query: "budget report", tree: `(and "budget" "report")`},
+		{query: `"quarterly review" draft`, tree: `(and "quarterly review" "draft")`},
+		{query: "a OR b c", tree: `(or "a" (and "b" "c"))`},
+		{query: "a (b OR c)", tree: `(and "a" (or "b" "c"))`},
+		{query: "NOT draft", tree: `(not "draft")`},
+		{query: "-draft -label:spam", tree: `(and (not "draft") (not label:"spam"))`},
+		{query: "NOT NOT a", tree: `(not (not "a"))`},
+		{query: "or", tree: `"or"`},
+		{query: "From:Alice", tree: `From:"alice"`},
+		{query: `subject:"Weekly Report" cc:bob`, tree: `(and Subject:"weekly report" Cc:"bob")`},
+		{query: `label:\Important`, tree: `label:"important"`},
+		{query: "after:2019-01-01 before:2019/02/01", tree: "(and after:2019-01-01 before:2019-02-01)"},
+		{query: "larger:5M smaller:100k", tree: "(and larger:5242880 smaller:102400)"},
+		{query: "has:attachment", tree: "has:attachment"},
+		{query: "uid:42 uid:100-200", tree: "(and uid:42-42 uid:100-200)"},
+		{query: "thread:7", tree: "thread:7"},
+		{query: "http://example.com", tree: `(and "http:" "//example.com")`},
+
+		{query: "(a", tree: "missing )", err: true},
+		{query: "to:(a", tree: "missing )", err: true},
+		{query: "a)", tree: `unexpected ")"`, err: true},
+		{query: "()", tree: "empty expression", err: true},
+		{query: "a OR", tree: "empty expression", err: true},
+		{query: "NOT", tree: "missing term after NOT", err: true},
+		{query: `"..."`, tree: "nothing to search for", err: true},
+		{query: "after:yesterday", tree: "invalid date", err: true},
+		{query: "larger:lots", tree: "invalid size", err: true},
+		{query: "has:wings", tree: "unknown has:wings", err: true},
+		{query: "uid:x", tree: "invalid uid", err: true},
+		{query: "uid:1-x", tree: "invalid uid", err: true},
+		{query: "thread:", tree: "invalid thread", err: true},
+	}
+	for _, tc := range cases {
+		q, err := Parse(tc.query)
+		if tc.err {
+			if err == nil {
+				t.Errorf("Parse(%q) = %s, want error %q", tc.query, format(q.root), tc.tree)
+			} else if !strings.HasPrefix(err.Error(), tc.tree) {
+				t.Errorf("Parse(%q): error %q, want %q", tc.query, err, tc.tree)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tc.query, err)
+			continue
+		}
+		if got := format(q.root); got != tc.tree {
+			t.Errorf("Parse(%q) = %s, want %s", tc.query, got, tc.tree)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	cases := []struct {
+		s    string
+		size int64
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"1234", 1234, true},
+		{"1k", 1 << 10, true},
+		{"1K", 1 << 10, true},
+		{"5M", 5 << 20, true},
+		{"2G", 2 << 30, true},
+		{"9223372036854775807", math.MaxInt64, true},
+		{"8589934591G", 8589934591 << 30, true},
+		{"8589934592G", 0, false},
+		{"9223372036854775807K", 0, false},
+		{"99999999999999999999", 0, false},
+		{"", 0, false},
+		{"K", 0, false},
+		{"-1", 0, false},
+		{"1.5M", 0, false},
+		{"5T", 0, false},
+	}
+	for _, tc := range cases {
+		size, err := ParseSize(tc.s)
+		if tc.ok && (err != nil || size != tc.size) {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d", tc.s, size, err, tc.size)
+		} else if !tc.ok && err == nil {
+			t.Errorf("ParseSize(%q) = %d, want error", tc.s, size)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	d, err := db.Open(filepath.Join(t.TempDir(), "test.imapchive"), db.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	msgs := []struct {
+		id     uint32
+		labels []string
+		data   string
+	}{
+		{1, []string{`\Important`}, "From: Alice <alice@example.com>\r\nTo: bob@example.com\r\nSubject: Budget\r\nDate: Sat, 5 Jan 2019 10:00:00 +0000\r\nMessage-ID: <1@x>\r\n\r\nThe quarterly review is due.\r\n"},
+		{2, nil, "From: bob@example.com\r\nTo: alice@example.com\r\nSubject: Re: Budget\r\nDate: Thu, 10 Jan 2019 10:00:00 +0000\r\nMessage-ID: <2@x>\r\nIn-Reply-To: <1@x>\r\n\r\nA draft of the review.\r\n"},
+		{3, []string{"Travel"}, "From: carol@example.com\r\nSubject: Trip\r\nDate: Fri, 1 Mar 2019 10:00:00 +0000\r\nMessage-ID: <3@x>\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\nContent-Type: text/plain\r\n\r\nTickets attached.\r\n--b\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=ticket.pdf\r\n\r\n%PDF\r\n--b--\r\n"},
+	}
+	for _, m := range msgs {
+		if err := d.WriteMessage(m.id, []byte(m.data), m.labels, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A message stored in chunks, which is streamed rather than read
+	// whole.
+	large := "From: dave@example.com\r\nSubject: Photos\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: image/jpeg\r\nContent-Disposition: attachment; filename=a.jpg\r\n\r\n" +
+		strings.Repeat("0123456789abcdef\r\n", 200000) + "--b--\r\n"
+	if err := d.WriteMessageStream(4, strings.NewReader(large), nil, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		query string
+		ids   []uint32
+	}{
+		{"", []uint32{1, 2, 3, 4}},
+		{"review", []uint32{1, 2}},
+		{`"quarterly review"`, []uint32{1}},
+		{"review NOT draft", []uint32{1}},
+		{"review OR tickets", []uint32{1, 2, 3}},
+		{"photos", []uint32{4}},
+		{"from:alice", []uint32{1}},
+		{"to:alice", []uint32{2}},
+		{`subject:"re: budget"`, []uint32{2}},
+		{"label:important", []uint32{1}},
+		{`-label:\Important`, []uint32{2, 3, 4}},
+		{"after:2019-01-08", []uint32{2, 3}},
+		{"before:2019-01-08", []uint32{1}},
+		{"has:attachment", []uint32{3, 4}},
+		{"NOT has:attachment", []uint32{1, 2}},
+		{"larger:250", []uint32{3, 4}},
+		{"larger:1M", []uint32{4}},
+		{"smaller:1M", []uint32{1, 2, 3}},
+		{"uid:2-3", []uint32{2, 3}},
+		{"thread:2", []uint32{1, 2}},
+		{"thread:3 OR uid:1", []uint32{1, 3}},
+		{"nonexistent", nil},
+	}
+	for _, tc := range cases {
+		q, err := Parse(tc.query)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tc.query, err)
+		}
+		ids, err := q.Matches(d)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.query, err)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(tc.ids) {
+			t.Errorf("%q matched %v, want %v", tc.query, ids, tc.ids)
+		}
+	}
+
+	// Sizes are read from the search index, and otherwise counted.
+	idx, err := d.SearchIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []uint32{1, 4} {
+		want := int64(len(msgs[0].data))
+		if id == 4 {
+			want = int64(len(large))
+		}
+		if sum := idx.Message(id); sum == nil || sum.Size != want {
+			t.Errorf("message %d: summary %v, want size %d", id, sum, want)
+		}
+		for _, m := range []*message{{db: d, id: id, size: -1, summary: idx.Message(id)}, {db: d, id: id, size: -1}} {
+			if size, err := m.rawSize(); err != nil || size != want {
+				t.Errorf("message %d: size %d, %v, want %d", id, size, err, want)
+			}
+		}
+	}
+}
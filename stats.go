@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/calmh/imapchive/db"
+)
+
+func printStats(s *db.Stats) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Messages:\t%d live, %d deleted\n", s.Messages, s.Deleted)
+	fmt.Fprintf(tw, "Records:\t%d messages, %d label updates, %d deletions\n", s.MessageRecords, s.LabelRecords, s.DeletionRecords)
+	fmt.Fprintf(tw, "Message data:\t%d bytes raw, %d bytes stored%s\n", s.RawBytes, s.StoredBytes, ratio(s.StoredBytes, s.RawBytes))
+	fmt.Fprintf(tw, "Label updates:\t%d bytes\n", s.LabelBytes)
+	fmt.Fprintf(tw, "Superseded data:\t%d bytes\n", s.SupersededBytes)
+	fmt.Fprintf(tw, "Other:\t%d bytes\n", s.OverheadBytes)
+	fmt.Fprintf(tw, "File size:\t%d bytes\n", s.FileBytes)
+
+	if len(s.Labels) > 0 {
+		fmt.Fprintln(tw, "\nLabels:")
+		labels := make([]string, 0, len(s.Labels))
+		for l := range s.Labels {
+			labels = append(labels, l)
+		}
+		sort.Strings(labels)
+		for _, l := range labels {
+			fmt.Fprintf(tw, "  %s\t%d\n", l, s.Labels[l])
+		}
+	}
+
+	if len(s.Years) > 0 {
+		fmt.Fprintln(tw, "\nYears:")
+		years := make([]int, 0, len(s.Years))
+		for y := range s.Years {
+			years = append(years, y)
+		}
+		sort.Ints(years)
+		for _, y := range years {
+			fmt.Fprintf(tw, "  %d\t%d\n", y, s.Years[y])
+		}
+	}
+
+	if len(s.TopSenders) > 0 {
+		fmt.Fprintln(tw, "\nTop senders:")
+		for _, sc := range s.TopSenders {
+			fmt.Fprintf(tw, "  %s\t%d\n", sc.Sender, sc.Messages)
+		}
+	}
+
+	if len(s.Largest) > 0 {
+		fmt.Fprintln(tw, "\nLargest messages:")
+		for _, m := range s.Largest {
+			fmt.Fprintf(tw, "  %d\t%d bytes\t%s\n", m.MessageID, m.Bytes, m.Subject)
+		}
+	}
+
+	if len(s.Duplicates) > 0 {
+		fmt.Fprintln(tw, "\nDuplicates:")
+		for _, d := range s.Duplicates {
+			ids := make([]string, len(d.MessageIDs))
+			for i, id := range d.MessageIDs {
+				ids[i] = fmt.Sprint(id)
+			}
+			fmt.Fprintf(tw, "  %s\t%s\n", d.Hash[:16], strings.Join(ids, ", "))
+		}
+	}
+
+	tw.Flush()
+}
+
+func ratio(a, b int64) string {
+	if b == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (%.1f%%)", 100*float64(a)/float64(b))
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// Exit codes of fetch and sync when not every new message was fetched.
+const (
+	exitFailed  = 1 // nothing could be fetched
+	exitPartial = 2 // some mailboxes or messages were left for the next run
+)
+
+const (
+	statusComplete = "complete"
+	statusPartial  = "partial"
+	statusFailed   = "failed"
+)
+
+// runSummary is the machine-readable outcome of a fetch or sync, written
+// with --summary.
+type runSummary struct {
+	Status    string           `json:"status"`
+	Started   time.Time        `json:"started"`
+	Duration  float64          `json:"duration_seconds"`
+	Mailboxes []mailboxSummary `json:"mailboxes"`
+
+	start time.Time
+}
+
+// mailboxSummary is the outcome of fetching a mailbox. Mailbox is empty
+// for an account whose mailboxes could not be listed. Deleted counts the
+// messages marked deleted in the archive, which fetching never does, as
+// messages deleted on the server are kept.
+type mailboxSummary struct {
+	Account      string   `json:"account"`
+	Mailbox      string   `json:"mailbox"`
+	Status       string   `json:"status"`
+	Scanned      int64    `json:"scanned"`
+	Fetched      int64    `json:"fetched"`
+	Deleted      int64    `json:"deleted"`
+	Relabelled   int64    `json:"relabelled"`
+	Failed       []uint32 `json:"failed"`
+	Error        string   `json:"error,omitempty"`
+	Duration     float64  `json:"duration_seconds"`
+	ArchiveBytes int64    `json:"archive_bytes"`
+}
+
+func newRunSummary() *runSummary {
+	now := time.Now()
+	return &runSummary{Started: now.UTC(), start: now}
+}
+
+// add adds the result of fetching a mailbox.
+func (s *runSummary) add(acc *account, res *fetchResult) {
+	ms := mailboxSummary{
+		Account:      acc.label(),
+		Mailbox:      res.Mailbox,
+		Status:       res.Status(),
+		Scanned:      res.Scanned,
+		Fetched:      res.Fetched,
+		Relabelled:   res.Labels,
+		Failed:       res.Failed,
+		Duration:     res.Duration.Seconds(),
+		ArchiveBytes: res.ArchiveBytes,
+	}
+	if ms.Failed == nil {
+		ms.Failed = []uint32{}
+	}
+	switch {
+	case res.Err != nil:
+		ms.Error = res.Err.Error()
+	case res.ScanErr != nil:
+		ms.Error = res.ScanErr.Error()
+	}
+	s.Mailboxes = append(s.Mailboxes, ms)
+}
+
+// addError adds an account that could not be synced.
+func (s *runSummary) addError(acc *account, err error) {
+	s.Mailboxes = append(s.Mailboxes, mailboxSummary{
+		Account: acc.label(),
+		Status:  statusFailed,
+		Failed:  []uint32{},
+		Error:   err.Error(),
+	})
+}
+
+// finish sets the overall status and the duration.
+func (s *runSummary) finish() {
+	s.Status = s.status()
+	s.Duration = time.Since(s.start).Seconds()
+}
+
+// status returns the overall status: complete if every mailbox is, and
+// failed if no mailbox got anywhere.
+func (s *runSummary) status() string {
+	complete, failed := 0, 0
+	for _, ms := range s.Mailboxes {
+		switch ms.Status {
+		case statusComplete:
+			complete++
+		case statusFailed:
+			failed++
+		}
+	}
+	switch {
+	case complete == len(s.Mailboxes):
+		return statusComplete
+	case failed == len(s.Mailboxes):
+		return statusFailed
+	default:
+		return statusPartial
+	}
+}
+
+// exitCode returns the exit code for the run.
+func (s *runSummary) exitCode() int {
+	switch s.status() {
+	case statusComplete:
+		return 0
+	case statusFailed:
+		return exitFailed
+	default:
+		return exitPartial
+	}
+}
+
+// write writes the summary as JSON to the named file, or to standard
+// output for "-".
+func (s *runSummary) write(name string) error {
+	s.finish()
+	bs, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	bs = append(bs, '\n')
+	if name == "-" {
+		_, err = os.Stdout.Write(bs)
+		return err
+	}
+	return os.WriteFile(name, bs, 0o644)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunSummaryStatus(t *testing.T) {
+	complete := &fetchResult{Mailbox: "INBOX", Scanned: 10, Fetched: 2}
+	partial := &fetchResult{Mailbox: "Sent", Scanned: 10, Failed: []uint32{7}}
+	scanStopped := &fetchResult{Mailbox: "Lists", Scanned: 3, ScanErr: errors.New("connection lost")}
+	notScanned := &fetchResult{Mailbox: "Spam", ScanErr: errors.New("connection lost")}
+	broken := &fetchResult{Mailbox: "Drafts", Err: errors.New("open archive: permission denied")}
+
+	cases := []struct {
+		name    string
+		results []*fetchResult
+		errs    int // accounts that could not be listed
+		status  string
+		code    int
+	}{
+		{name: "complete", results: []*fetchResult{complete, complete}, status: statusComplete, code: 0},
+		{name: "failed message", results: []*fetchResult{complete, partial}, status: statusPartial, code: exitPartial},
+		{name: "scan stopped", results: []*fetchResult{scanStopped}, status: statusPartial, code: exitPartial},
+		{name: "not scanned", results: []*fetchResult{notScanned}, status: statusFailed, code: exitFailed},
+		{name: "archive broken", results: []*fetchResult{broken, notScanned}, status: statusFailed, code: exitFailed},
+		{name: "one of two failed", results: []*fetchResult{broken, complete}, status: statusPartial, code: exitPartial},
+		{name: "account failed", results: []*fetchResult{complete}, errs: 1, status: statusPartial, code: exitPartial},
+		{name: "only account failed", errs: 1, status: statusFailed, code: exitFailed},
+	}
+	acc := &account{Email: "alice@example.com", Server: "imap.example.com"}
+	for _, tc := range cases {
+		s := newRunSummary()
+		for _, res := range tc.results {
+			s.add(acc, res)
+		}
+		for i := 0; i < tc.errs; i++ {
+			s.addError(acc, errors.New("login failed"))
+		}
+		if got := s.status(); got != tc.status {
+			t.Errorf("%s: status %s, want %s", tc.name, got, tc.status)
+		}
+		if got := s.exitCode(); got != tc.code {
+			t.Errorf("%s: exit code %d, want %d", tc.name, got, tc.code)
+		}
+	}
+}
+
+func TestRunSummaryWrite(t *testing.T) {
+	s := newRunSummary()
+	acc := &account{Email: "alice@example.com", Server: "imap.example.com"}
+	s.add(acc, &fetchResult{Mailbox: "INBOX", Scanned: 10, Fetched: 2, Labels: 1, ScanErr: errors.New("connection lost")})
+	s.addError(acc, errors.New("login failed"))
+	name := filepath.Join(t.TempDir(), "summary.json")
+	if err := s.write(name); err != nil {
+		t.Fatal(err)
+	}
+	bs, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got struct {
+		Status    string
+		Mailboxes []map[string]interface{}
+	}
+	if err := json.Unmarshal(bs, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != statusPartial || len(got.Mailboxes) != 2 {
+		t.Fatalf("summary %s", bs)
+	}
+	// Every count is present, and failed is a list even when empty.
+	for _, ms := range got.Mailboxes {
+		for _, field := range []string{"account", "mailbox", "status", "scanned", "fetched", "deleted", "relabelled", "failed", "error", "duration_seconds", "archive_bytes"} {
+			if _, ok := ms[field]; !ok {
+				t.Errorf("mailbox %v has no %s", ms["mailbox"], field)
+			}
+		}
+		if failed, ok := ms["failed"].([]interface{}); !ok || len(failed) != 0 {
+			t.Errorf("mailbox %v: failed %v", ms["mailbox"], ms["failed"])
+		}
+	}
+	if ms := got.Mailboxes[0]; ms["fetched"] != 2.0 || ms["relabelled"] != 1.0 || ms["deleted"] != 0.0 || ms["error"] != "connection lost" {
+		t.Errorf("mailbox %s", bs)
+	}
+}
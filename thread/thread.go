@@ -0,0 +1,415 @@
+// Package thread reconstructs conversations from archived messages, using
+// the algorithm described by Jamie Zawinski at
+// https://www.jwz.org/doc/threading.html, and Gmail's conversation IDs
+// where they are known.
+package thread
+
+import (
+	"bytes"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/calmh/imapchive/db"
+	"github.com/calmh/imapchive/fts"
+)
+
+// Message holds what threading needs to know about a message.
+type Message struct {
+	ID          uint32
+	MessageID   string
+	References  []string // ancestors, oldest first
+	Subject     string
+	From        string
+	Date        time.Time
+	GmailThread uint64 // X-GM-THRID, if known
+}
+
+// Parse returns the threading information of a raw RFC 822 message.
+func Parse(id uint32, data []byte) *Message {
+	m := &Message{ID: id}
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return m
+	}
+	hdr := msg.Header
+
+	if ids := messageIDs(hdr.Get("Message-Id")); len(ids) > 0 {
+		m.MessageID = ids[0]
+	}
+	m.References = messageIDs(hdr.Get("References"))
+	if irt := messageIDs(hdr.Get("In-Reply-To")); len(irt) > 0 {
+		if n := len(m.References); n == 0 || m.References[n-1] != irt[0] {
+			m.References = append(m.References, irt[0])
+		}
+	}
+	m.Subject = fts.DecodeHeader(hdr.Get("Subject"))
+	m.From = fts.DecodeHeader(hdr.Get("From"))
+	if date, err := hdr.Date(); err == nil {
+		m.Date = date
+	}
+	return m
+}
+
+var messageIDExp = regexp.MustCompile(`<[^<>\s]+>`)
+
+func messageIDs(s string) []string {
+	return messageIDExp.FindAllString(s, -1)
+}
+
+// Node is a message in a thread. Messages that are referred to but not
+// present have nodes without a message, holding their replies.
+type Node struct {
+	Message  *Message
+	Parent   *Node
+	Children []*Node
+}
+
+// IDs returns the message IDs in the thread rooted at n, depth first.
+func (n *Node) IDs() []uint32 {
+	var ids []uint32
+	n.Walk(func(n *Node, depth int) {
+		if n.Message != nil {
+			ids = append(ids, n.Message.ID)
+		}
+	})
+	return ids
+}
+
+// Walk calls fn for n and every node below it, depth first. The depth
+// counts messages only, so that replies to a missing message appear as
+// siblings.
+func (n *Node) Walk(fn func(n *Node, depth int)) {
+	n.walk(fn, 0)
+}
+
+func (n *Node) walk(fn func(n *Node, depth int), depth int) {
+	fn(n, depth)
+	if n.Message != nil {
+		depth++
+	}
+	for _, c := range n.Children {
+		c.walk(fn, depth)
+	}
+}
+
+// Find returns the thread containing the message with the given ID, or
+// nil.
+func Find(threads []*Node, id uint32) *Node {
+	for _, t := range threads {
+		found := false
+		t.Walk(func(n *Node, _ int) {
+			if n.Message != nil && n.Message.ID == id {
+				found = true
+			}
+		})
+		if found {
+			return t
+		}
+	}
+	return nil
+}
+
+// Load returns the threads of the live messages in an archive.
+func Load(d *db.DB) ([]*Node, error) {
+	var msgs []*Message
+	for _, id := range d.MessageIDs() {
+		rec, err := d.Message(id)
+		if err != nil {
+			return nil, err
+		}
+		m := Parse(id, rec.MessageData)
+		m.GmailThread = rec.ThreadId
+		msgs = append(msgs, m)
+	}
+	return Build(msgs), nil
+}
+
+// Build groups messages into threads, returned in order of their first
+// message. Messages are linked by their Message-ID, In-Reply-To and
+// References headers; threads without a common ancestor are joined when
+// their subjects are the same apart from reply prefixes, or when Gmail
+// puts their messages in the same conversation.
+func Build(msgs []*Message) []*Node {
+	t := &threader{byID: make(map[string]*Node)}
+	for _, m := range msgs {
+		t.add(m)
+	}
+
+	var roots []*Node
+	for _, n := range t.nodes {
+		if n.Parent == nil {
+			roots = append(roots, n)
+		}
+	}
+
+	roots = prune(roots, true)
+	roots = groupBySubject(roots)
+	roots = groupByGmail(roots)
+	for _, r := range roots {
+		r.sort()
+	}
+	sortNodes(roots)
+	return roots
+}
+
+type threader struct {
+	byID  map[string]*Node
+	nodes []*Node
+}
+
+func (t *threader) node(id string) *Node {
+	if n := t.byID[id]; n != nil {
+		return n
+	}
+	n := &Node{}
+	t.byID[id] = n
+	t.nodes = append(t.nodes, n)
+	return n
+}
+
+func (t *threader) add(m *Message) {
+	var n *Node
+	if m.MessageID != "" && (t.byID[m.MessageID] == nil || t.byID[m.MessageID].Message == nil) {
+		n = t.node(m.MessageID)
+	} else {
+		// Without a usable Message-ID, nothing can refer to the message.
+		n = &Node{}
+		t.nodes = append(t.nodes, n)
+	}
+	n.Message = m
+
+	// Link the references in sequence, keeping existing links.
+	var parent *Node
+	for _, ref := range m.References {
+		c := t.node(ref)
+		if parent != nil && c.Parent == nil && !isAncestor(c, parent) {
+			link(parent, c)
+		}
+		parent = c
+	}
+
+	// The last reference is the parent, overriding other messages'
+	// references to it.
+	if parent != nil && isAncestor(n, parent) {
+		parent = nil
+	}
+	if n.Parent != nil {
+		unlink(n)
+	}
+	if parent != nil {
+		link(parent, n)
+	}
+}
+
+// isAncestor returns whether a is b or one of its ancestors.
+func isAncestor(a, b *Node) bool {
+	for ; b != nil; b = b.Parent {
+		if a == b {
+			return true
+		}
+	}
+	return false
+}
+
+func link(parent, child *Node) {
+	child.Parent = parent
+	parent.Children = append(parent.Children, child)
+}
+
+func unlink(n *Node) {
+	siblings := n.Parent.Children
+	for i, c := range siblings {
+		if c == n {
+			n.Parent.Children = append(siblings[:i:i], siblings[i+1:]...)
+			break
+		}
+	}
+	n.Parent = nil
+}
+
+// prune removes nodes without a message, promoting their children,
+// except for missing messages at the root with several replies, which
+// keep them together.
+func prune(nodes []*Node, root bool) []*Node {
+	var out []*Node
+	for _, n := range nodes {
+		n.Children = prune(n.Children, false)
+		switch {
+		case n.Message == nil && len(n.Children) == 0:
+		case n.Message == nil && (!root || len(n.Children) == 1):
+			for _, c := range n.Children {
+				c.Parent = n.Parent
+			}
+			out = append(out, n.Children...)
+		default:
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+var replyPrefixExp = regexp.MustCompile(`^\s*((re|fwd?|aw|sv|vs)(\[\d+\])?\s*:|\[[^\]]*\])\s*`)
+
+// baseSubject returns the subject without reply and forward prefixes or
+// mailing list tags, and whether there were any.
+func baseSubject(s string) (string, bool) {
+	s = strings.ToLower(s)
+	stripped := false
+	for {
+		loc := replyPrefixExp.FindStringIndex(s)
+		if loc == nil {
+			break
+		}
+		s = s[loc[1]:]
+		stripped = true
+	}
+	return strings.Join(strings.Fields(s), " "), stripped
+}
+
+func (n *Node) subject() (string, bool) {
+	if n.Message == nil && len(n.Children) > 0 {
+		n = n.Children[0]
+	}
+	if n.Message == nil {
+		return "", false
+	}
+	return baseSubject(n.Message.Subject)
+}
+
+// groupBySubject joins threads with the same base subject. Where one of
+// them is not a reply, the others become its replies.
+func groupBySubject(roots []*Node) []*Node {
+	groups := make(map[string][]*Node)
+	for _, r := range roots {
+		if subj, _ := r.subject(); subj != "" {
+			groups[subj] = append(groups[subj], r)
+		}
+	}
+
+	rank := func(n *Node) int {
+		if n.Message == nil {
+			return 0
+		}
+		if _, reply := n.subject(); !reply {
+			return 1
+		}
+		return 2
+	}
+
+	var out []*Node
+	done := make(map[string]bool)
+	for _, r := range roots {
+		subj, _ := r.subject()
+		members := groups[subj]
+		if subj == "" || len(members) == 1 {
+			out = append(out, r)
+			continue
+		}
+		if done[subj] {
+			continue
+		}
+		done[subj] = true
+
+		sort.SliceStable(members, func(a, b int) bool { return rank(members[a]) < rank(members[b]) })
+		top := members[0]
+		for _, m := range members[1:] {
+			top = merge(top, m, rank(m) == 2)
+		}
+		out = append(out, top)
+	}
+	return out
+}
+
+// merge joins thread b into thread a, returning the new root.
+func merge(a, b *Node, bIsReply bool) *Node {
+	switch {
+	case a.Message == nil && b.Message == nil:
+		for _, c := range b.Children {
+			link(a, c)
+		}
+		return a
+	case a.Message == nil:
+		link(a, b)
+		return a
+	case bIsReply:
+		if _, aIsReply := a.subject(); !aIsReply {
+			link(a, b)
+			return a
+		}
+	}
+	root := &Node{}
+	link(root, a)
+	link(root, b)
+	return root
+}
+
+// groupByGmail joins threads holding messages of the same Gmail
+// conversation.
+func groupByGmail(roots []*Node) []*Node {
+	var out []*Node
+	pos := make(map[uint64]int)
+	for _, r := range roots {
+		var threads []uint64
+		r.Walk(func(n *Node, _ int) {
+			if n.Message != nil && n.Message.GmailThread != 0 {
+				threads = append(threads, n.Message.GmailThread)
+			}
+		})
+
+		i := -1
+		for _, t := range threads {
+			if p, ok := pos[t]; ok {
+				i = p
+				break
+			}
+		}
+		if i < 0 {
+			i = len(out)
+			out = append(out, r)
+		} else {
+			if out[i].Message != nil {
+				root := &Node{}
+				link(root, out[i])
+				out[i] = root
+			}
+			link(out[i], r)
+		}
+		for _, t := range threads {
+			if _, ok := pos[t]; !ok {
+				pos[t] = i
+			}
+		}
+	}
+	return out
+}
+
+// date returns the date of the earliest message in the thread.
+func (n *Node) date() time.Time {
+	var first time.Time
+	n.Walk(func(n *Node, _ int) {
+		if n.Message != nil && !n.Message.Date.IsZero() && (first.IsZero() || n.Message.Date.Before(first)) {
+			first = n.Message.Date
+		}
+	})
+	return first
+}
+
+func (n *Node) sort() {
+	for _, c := range n.Children {
+		c.sort()
+	}
+	sortNodes(n.Children)
+}
+
+func sortNodes(nodes []*Node) {
+	dates := make(map[*Node]time.Time, len(nodes))
+	for _, n := range nodes {
+		dates[n] = n.date()
+	}
+	sort.SliceStable(nodes, func(a, b int) bool {
+		return dates[nodes[a]].Before(dates[nodes[b]])
+	})
+}
@@ -0,0 +1,260 @@
+package thread
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// format returns the threads as nested lists of message IDs, with "_" for
+// missing messages, such as "1(2 3(4)) 5".
+func format(nodes []*Node) string {
+	var parts []string
+	for _, n := range nodes {
+		s := "_"
+		if n.Message != nil {
+			s = fmt.Sprint(n.Message.ID)
+		}
+		if len(n.Children) > 0 {
+			s += "(" + format(n.Children) + ")"
+		}
+		parts = append(parts, s)
+	}
+	return strings.Join(parts, " ")
+}
+
+// msg returns a message sent on the given day of January 2019.
+func msg(id uint32, messageID, subject string, day int, refs ...string) *Message {
+	return &Message{
+		ID:         id,
+		MessageID:  messageID,
+		References: refs,
+		Subject:    subject,
+		Date:       time.Date(2019, 1, day, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestBuild(t *testing.T) {
+	cases := []struct {
+		name    string
+		msgs    []*Message
+		threads string
+	}{
+		{
+			name: "unrelated",
+			msgs: []*Message{
+				msg(1, "<1>", "One", 2),
+				msg(2, "<2>", "Two", 1),
+			},
+			threads: "2 1",
+		},
+		{
+			name: "replies",
+			msgs: []*Message{
+				msg(1, "<1>", "Budget", 1),
+				msg(2, "<2>", "Re: Budget", 2, "<1>"),
+				msg(3, "<3>", "Re: Budget", 3, "<1>", "<2>"),
+				msg(4, "<4>", "Re: Budget", 4, "<1>"),
+			},
+			threads: "1(2(3) 4)",
+		},
+		{
+			name: "replies before the original",
+			msgs: []*Message{
+				msg(3, "<3>", "Re: Budget", 3, "<1>", "<2>"),
+				msg(2, "<2>", "Re: Budget", 2, "<1>"),
+				msg(1, "<1>", "Budget", 1),
+			},
+			threads: "1(2(3))",
+		},
+		{
+			name: "missing parent with one reply",
+			msgs: []*Message{
+				msg(2, "<2>", "Re: Lost", 2, "<1>"),
+			},
+			threads: "2",
+		},
+		{
+			name: "missing parent with several replies",
+			msgs: []*Message{
+				msg(2, "<2>", "Re: Lost", 2, "<1>"),
+				msg(3, "<3>", "Re: Lost", 3, "<1>"),
+			},
+			threads: "_(2 3)",
+		},
+		{
+			name: "missing message in the middle",
+			msgs: []*Message{
+				msg(1, "<1>", "Budget", 1),
+				msg(3, "<3>", "Re: Budget", 3, "<1>", "<2>"),
+			},
+			threads: "1(3)",
+		},
+		{
+			name: "the last reference wins",
+			msgs: []*Message{
+				msg(1, "<1>", "A", 1),
+				msg(2, "<2>", "B", 2),
+				msg(3, "<3>", "Re: B", 3, "<1>"),
+				msg(4, "<4>", "Re: B", 4, "<2>", "<3>"),
+			},
+			threads: "1(3(4)) 2",
+		},
+		{
+			// The earlier link is kept.
+			name: "reference loop",
+			msgs: []*Message{
+				msg(1, "<1>", "X", 1, "<2>"),
+				msg(2, "<2>", "Re: X", 2, "<1>"),
+			},
+			threads: "2(1)",
+		},
+		{
+			name: "duplicate Message-ID",
+			msgs: []*Message{
+				msg(1, "<1>", "Dup", 1),
+				msg(2, "<1>", "Dup", 2),
+			},
+			threads: "_(1 2)",
+		},
+		{
+			name: "same subject",
+			msgs: []*Message{
+				msg(1, "<1>", "Lunch?", 1),
+				msg(2, "<2>", "RE: [team] lunch?", 2),
+				msg(3, "<3>", "Fwd: Re:  Lunch?", 3),
+			},
+			threads: "1(2 3)",
+		},
+		{
+			name: "same subject, only replies",
+			msgs: []*Message{
+				msg(1, "<1>", "Re: Lunch", 1),
+				msg(2, "<2>", "Re: Lunch", 2),
+			},
+			threads: "_(1 2)",
+		},
+		{
+			name: "same subject, no replies",
+			msgs: []*Message{
+				msg(1, "<1>", "Report", 1),
+				msg(2, "<2>", "Report", 2),
+			},
+			threads: "_(1 2)",
+		},
+		{
+			name: "no subject",
+			msgs: []*Message{
+				msg(1, "<1>", "", 1),
+				msg(2, "<2>", "Re:", 2),
+			},
+			threads: "1 2",
+		},
+		{
+			name: "no Message-ID",
+			msgs: []*Message{
+				msg(1, "", "A", 1),
+				msg(2, "", "B", 2, "<1>"),
+			},
+			threads: "1 2",
+		},
+	}
+	for _, tc := range cases {
+		if got := format(Build(tc.msgs)); got != tc.threads {
+			t.Errorf("%s: threads %s, want %s", tc.name, got, tc.threads)
+		}
+	}
+}
+
+func TestBuildGmail(t *testing.T) {
+	a := msg(1, "<1>", "Hello", 1)
+	b := msg(2, "<2>", "Different subject", 2)
+	c := msg(3, "<3>", "Other", 3)
+	a.GmailThread, b.GmailThread, c.GmailThread = 7, 7, 8
+	if got, want := format(Build([]*Message{a, b, c})), "_(1 2) 3"; got != want {
+		t.Errorf("threads %s, want %s", got, want)
+	}
+}
+
+func TestParse(t *testing.T) {
+	data := "Message-ID: <3@example.com>\r\n" +
+		"References: <1@example.com>\r\n <2@example.com>\r\n" +
+		"In-Reply-To: <2@example.com> (Bob's message)\r\n" +
+		"Subject: =?UTF-8?Q?Re:_Gr=C3=BC=C3=9Fe?=\r\n" +
+		"From: Alice <alice@example.com>\r\n" +
+		"Date: Sat, 5 Jan 2019 10:00:00 +0000\r\n\r\nbody\r\n"
+	m := Parse(3, []byte(data))
+	if m.ID != 3 || m.MessageID != "<3@example.com>" || m.Subject != "Re: Grüße" || m.From != "Alice <alice@example.com>" {
+		t.Errorf("parsed %+v", m)
+	}
+	if got := strings.Join(m.References, " "); got != "<1@example.com> <2@example.com>" {
+		t.Errorf("references %s", got)
+	}
+	if !m.Date.Equal(time.Date(2019, 1, 5, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("date %v", m.Date)
+	}
+
+	// In-Reply-To is added when it is not the last reference.
+	m = Parse(4, []byte("In-Reply-To: <9@x>\r\nReferences: <1@x>\r\n\r\n"))
+	if got := strings.Join(m.References, " "); got != "<1@x> <9@x>" {
+		t.Errorf("references %s", got)
+	}
+
+	if m := Parse(5, []byte("not a message")); m.ID != 5 || m.MessageID != "" {
+		t.Errorf("parsed %+v", m)
+	}
+}
+
+func TestBaseSubject(t *testing.T) {
+	cases := []struct {
+		in    string
+		base  string
+		reply bool
+	}{
+		{"Hello", "hello", false},
+		{"Re: Hello", "hello", true},
+		{"RE[2]: Re: hello", "hello", true},
+		{"Fwd: FW: AW: SV: VS: x", "x", true},
+		{"[list] Re: Weekly   report ", "weekly report", true},
+		{"Regarding: x", "regarding: x", false},
+		{"", "", false},
+	}
+	for _, tc := range cases {
+		base, reply := baseSubject(tc.in)
+		if base != tc.base || reply != tc.reply {
+			t.Errorf("baseSubject(%q) = %q, %v, want %q, %v", tc.in, base, reply, tc.base, tc.reply)
+		}
+	}
+}
+
+func TestWalk(t *testing.T) {
+	threads := Build([]*Message{
+		msg(1, "<1>", "A", 1),
+		msg(2, "<2>", "Re: A", 2, "<1>"),
+		msg(3, "<3>", "Re: A", 3, "<1>", "<2>"),
+		msg(4, "<4>", "Re: Lost", 4, "<0>"),
+		msg(5, "<5>", "Re: Lost", 5, "<0>"),
+	})
+
+	var depths []string
+	for _, th := range threads {
+		th.Walk(func(n *Node, depth int) {
+			if n.Message != nil {
+				depths = append(depths, fmt.Sprintf("%d:%d", n.Message.ID, depth))
+			}
+		})
+	}
+	if got, want := strings.Join(depths, " "), "1:0 2:1 3:2 4:0 5:0"; got != want {
+		t.Errorf("depths %s, want %s", got, want)
+	}
+
+	if th := Find(threads, 5); th == nil {
+		t.Error("Find(5) = nil")
+	} else if fmt.Sprint(th.IDs()) != "[4 5]" {
+		t.Errorf("Find(5) = %s", format([]*Node{th}))
+	}
+	if th := Find(threads, 6); th != nil {
+		t.Errorf("Find(6) = %s", format([]*Node{th}))
+	}
+}
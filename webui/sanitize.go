@@ -0,0 +1,141 @@
+package webui
+
+import (
+	"io"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Elements kept in sanitised HTML. Other elements are removed, keeping
+// their text, except those in dropElements which are removed entirely.
+var allowedElements = map[string]bool{
+	"a": true, "abbr": true, "address": true, "article": true, "b": true,
+	"big": true, "blockquote": true, "br": true, "caption": true,
+	"center": true, "cite": true, "code": true, "col": true,
+	"colgroup": true, "dd": true, "div": true, "dl": true, "dt": true,
+	"em": true, "font": true, "footer": true, "h1": true, "h2": true,
+	"h3": true, "h4": true, "h5": true, "h6": true, "header": true,
+	"hr": true, "i": true, "img": true, "li": true, "ol": true, "p": true,
+	"pre": true, "q": true, "s": true, "section": true, "small": true,
+	"span": true, "strike": true, "strong": true, "sub": true, "sup": true,
+	"table": true, "tbody": true, "td": true, "tfoot": true, "th": true,
+	"thead": true, "tr": true, "tt": true, "u": true, "ul": true,
+}
+
+var dropElements = map[string]bool{
+	"embed": true, "head": true, "iframe": true, "math": true,
+	"noscript": true, "object": true, "script": true, "style": true,
+	"svg": true, "template": true, "title": true, "select": true,
+	"textarea": true,
+}
+
+// Attributes kept on allowed elements. Styles are not kept, as they can
+// load external resources.
+var allowedAttrs = map[string]bool{
+	"align": true, "alt": true, "bgcolor": true, "border": true,
+	"cellpadding": true, "cellspacing": true, "color": true,
+	"colspan": true, "dir": true, "face": true, "height": true,
+	"href": true, "lang": true, "rowspan": true, "size": true, "src": true,
+	"title": true, "valign": true, "width": true,
+}
+
+// sanitize returns the HTML with everything but basic formatting removed:
+// no scripts, styles, forms or frames, no event handlers, links only to
+// web and mail addresses, and images only when embedded as data URLs, so
+// that viewing a message loads nothing from elsewhere.
+func sanitize(s string) string {
+	var out strings.Builder
+	z := html.NewTokenizer(strings.NewReader(s))
+	drop := 0
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() != io.EOF {
+				break
+			}
+			return out.String()
+		}
+		tok := z.Token()
+		name := tok.Data
+
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if dropElements[name] {
+				if tt == html.StartTagToken && !voidElement(name) {
+					drop++
+				}
+				continue
+			}
+			if drop > 0 || !allowedElements[name] {
+				continue
+			}
+			out.WriteString("<" + name)
+			for _, a := range tok.Attr {
+				if v, ok := sanitizeAttr(name, a); ok {
+					out.WriteString(" " + a.Key + `="` + html.EscapeString(v) + `"`)
+				}
+			}
+			if name == "a" {
+				out.WriteString(` target="_blank" rel="noopener noreferrer"`)
+			}
+			out.WriteString(">")
+
+		case html.EndTagToken:
+			if dropElements[name] {
+				if drop > 0 {
+					drop--
+				}
+				continue
+			}
+			if drop > 0 || !allowedElements[name] || voidElement(name) {
+				continue
+			}
+			out.WriteString("</" + name + ">")
+
+		case html.TextToken:
+			if drop == 0 {
+				out.WriteString(html.EscapeString(tok.Data))
+			}
+		}
+	}
+	return out.String()
+}
+
+func voidElement(name string) bool {
+	switch name {
+	case "br", "col", "embed", "hr", "img":
+		return true
+	}
+	return false
+}
+
+func sanitizeAttr(elem string, a html.Attribute) (string, bool) {
+	if a.Namespace != "" || !allowedAttrs[a.Key] {
+		return "", false
+	}
+	switch a.Key {
+	case "href":
+		if elem != "a" {
+			return "", false
+		}
+		u, err := url.Parse(strings.TrimSpace(a.Val))
+		if err != nil {
+			return "", false
+		}
+		switch strings.ToLower(u.Scheme) {
+		case "http", "https", "mailto":
+			return u.String(), true
+		}
+		return "", false
+
+	case "src":
+		v := strings.TrimSpace(a.Val)
+		if elem != "img" || !strings.HasPrefix(strings.ToLower(v), "data:image/") {
+			return "", false
+		}
+		return v, true
+	}
+	return a.Val, true
+}
@@ -0,0 +1,55 @@
+package webui
+
+import "testing"
+
+func TestSanitize(t *testing.T) {
+	cases := []struct{ in, out string }{
+		{"plain & simple", "plain &amp; simple"},
+		{"<p>Hello <b>world</b></p>", "<p>Hello <b>world</b></p>"},
+		{"<P CLASS=x Align=center>x</P>", `<p align="center">x</p>`},
+		{"a<br>b<br/>c<hr>", "a<br>b<br>c<hr>"},
+
+		// Dropped elements go with their content, other unknown
+		// elements leave their text.
+		{"a<script>alert(1)</script>b", "ab"},
+		{"a<style>body { color: red }</style>b", "ab"},
+		{"a<iframe src=https://example.com>x</iframe>b", "ab"},
+		{"<svg><script>x</script><g>y</g></svg>z", "z"},
+		{"<head><title>t</title></head><body>text</body>", "text"},
+		{"<form action=x><input name=q>kept</form>", "kept"},
+		{"<blink>kept</blink>", "kept"},
+		{"<embed src=x>after", "after"},
+
+		// Attributes.
+		{`<p onclick="x()" style="background:url(x)">t</p>`, "<p>t</p>"},
+		{`<td colspan=2 bgcolor="#fff" id=x>t</td>`, `<td colspan="2" bgcolor="#fff">t</td>`},
+		{`<font face='"x"'>t</font>`, `<font face="&#34;x&#34;">t</font>`},
+		{`<p xlink:href=x>t</p>`, "<p>t</p>"},
+
+		// Links.
+		{`<a href="https://example.com/?a=1&amp;b=2">l</a>`, `<a href="https://example.com/?a=1&amp;b=2" target="_blank" rel="noopener noreferrer">l</a>`},
+		{`<a href=" mailto:a@example.com ">l</a>`, `<a href="mailto:a@example.com" target="_blank" rel="noopener noreferrer">l</a>`},
+		{`<a href="javascript:alert(1)">l</a>`, `<a target="_blank" rel="noopener noreferrer">l</a>`},
+		{`<a href="JaVaScRiPt:alert(1)">l</a>`, `<a target="_blank" rel="noopener noreferrer">l</a>`},
+		{`<a href="/relative">l</a>`, `<a target="_blank" rel="noopener noreferrer">l</a>`},
+		{`<p href="https://example.com">t</p>`, "<p>t</p>"},
+
+		// Images only from data URLs.
+		{`<img src="https://example.com/track.gif" alt=x>`, `<img alt="x">`},
+		{`<img src="data:image/png;base64,AAAA">`, `<img src="data:image/png;base64,AAAA">`},
+		{`<img src="data:text/html,<script>">`, `<img>`},
+		{`<p src="data:image/png;base64,AAAA">t</p>`, "<p>t</p>"},
+
+		// Malformed input.
+		{"<p>unclosed", "<p>unclosed"},
+		{"</b>stray", "</b>stray"},
+		{"a<script>never closed", "a"},
+		{"1 < 2 > 0", "1 &lt; 2 &gt; 0"},
+		{"<!-- <script>x</script> -->c", "c"},
+	}
+	for _, tc := range cases {
+		if got := sanitize(tc.in); got != tc.out {
+			t.Errorf("sanitize(%q)\n got %q\nwant %q", tc.in, got, tc.out)
+		}
+	}
+}
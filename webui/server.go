@@ -0,0 +1,501 @@
+// Package webui provides a web interface and JSON API for browsing an
+// archive. Archives are only ever read.
+package webui
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/mail"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/calmh/imapchive/db"
+	"github.com/calmh/imapchive/fts"
+	"github.com/calmh/imapchive/query"
+)
+
+// pageSize is the number of messages per page in the web interface, and
+// the default for the API.
+const pageSize = 50
+
+//go:embed templates/*.html
+var templateFS embed.FS
+
+var templates = template.Must(template.New("").Funcs(template.FuncMap{
+	"date": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format("2006-01-02 15:04")
+	},
+	// System labels are shown without their leading backslash.
+	"label": func(l string) string { return strings.TrimPrefix(l, `\`) },
+}).ParseFS(templateFS, "templates/*.html"))
+
+// Server serves an archive over HTTP.
+type Server struct {
+	DB   *db.DB
+	Name string // shown in page titles
+
+	// User and Password, if set, are required using basic
+	// authentication.
+	User, Password string
+
+	mut sync.Mutex
+	idx *fts.Index // read when first needed
+}
+
+// Handler returns the HTTP handler for the web interface and API:
+//
+//	GET /                                 message list, with q, label and page parameters
+//	GET /messages/{uid}                   message view
+//	GET /messages/{uid}/raw               message as an .eml file
+//	GET /messages/{uid}/html              sanitised HTML body
+//	GET /messages/{uid}/attachments/{n}   attachment download
+//	GET /api/messages                     message list, with q, label, offset and limit parameters
+//	GET /api/messages/{uid}               message details and bodies
+//	GET /api/labels                       labels and their message counts
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", s.index)
+	mux.HandleFunc("GET /messages/{uid}", s.message)
+	mux.HandleFunc("GET /messages/{uid}/raw", s.raw)
+	mux.HandleFunc("GET /messages/{uid}/html", s.html)
+	mux.HandleFunc("GET /messages/{uid}/attachments/{n}", s.attachment)
+	mux.HandleFunc("GET /api/messages", s.apiMessages)
+	mux.HandleFunc("GET /api/messages/{uid}", s.apiMessage)
+	mux.HandleFunc("GET /api/labels", s.apiLabels)
+	return s.auth(mux)
+}
+
+func (s *Server) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+		if s.User != "" || s.Password != "" {
+			user, pass, _ := r.BasicAuth()
+			okUser := subtle.ConstantTimeCompare([]byte(user), []byte(s.User)) == 1
+			okPass := subtle.ConstantTimeCompare([]byte(pass), []byte(s.Password)) == 1
+			if !okUser || !okPass {
+				w.Header().Set("WWW-Authenticate", `Basic realm="imapchive"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Summary describes a message in a list.
+type Summary struct {
+	UID     uint32    `json:"uid"`
+	Date    time.Time `json:"date"`
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	Subject string    `json:"subject"`
+	Labels  []string  `json:"labels"`
+	Size    int       `json:"size"`
+}
+
+// Message describes a message with its content.
+type Message struct {
+	Summary
+	Cc          string       `json:"cc"`
+	Text        string       `json:"text"`
+	HTML        string       `json:"html"` // sanitised
+	Attachments []Attachment `json:"attachments"`
+}
+
+// Attachment describes an attachment of a message.
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+	URL         string `json:"url"`
+}
+
+// Label is a label and the number of live messages with it.
+type Label struct {
+	Label    string `json:"label"`
+	Messages int    `json:"messages"`
+}
+
+// searchIndex returns the full-text index of the archive. It is read
+// once, as the archive is opened read-only and does not change while it
+// is served.
+func (s *Server) searchIndex() (*fts.Index, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.idx == nil {
+		idx, err := s.DB.SearchIndex()
+		if err != nil {
+			return nil, err
+		}
+		s.idx = idx
+	}
+	return s.idx, nil
+}
+
+// summary returns the summary of a message and its header. Only the header
+// is read; the size comes from the search index, unless it predates
+// recording sizes and the message must be read through.
+func (s *Server) summary(uid uint32) (Summary, mail.Header, error) {
+	idx, err := s.searchIndex()
+	if err != nil {
+		return Summary{}, nil, err
+	}
+	r, err := s.DB.MessageReader(uid)
+	if err != nil {
+		return Summary{}, nil, err
+	}
+	hdr := make(mail.Header)
+	if m, err := mail.ReadMessage(r); err == nil {
+		hdr = m.Header
+	}
+
+	sum := Summary{
+		UID:     uid,
+		Labels:  s.DB.Labels(uid),
+		From:    fts.DecodeHeader(hdr.Get("From")),
+		To:      fts.DecodeHeader(hdr.Get("To")),
+		Subject: fts.DecodeHeader(hdr.Get("Subject")),
+	}
+	if sum.Labels == nil {
+		sum.Labels = []string{}
+	}
+	if date, err := hdr.Date(); err == nil {
+		sum.Date = date
+	}
+	if m := idx.Message(uid); m != nil && m.Size > 0 {
+		sum.Size = int(m.Size)
+	} else {
+		r, err := s.DB.MessageReader(uid)
+		if err != nil {
+			return Summary{}, nil, err
+		}
+		n, err := io.Copy(io.Discard, r)
+		if err != nil {
+			return Summary{}, nil, err
+		}
+		sum.Size = int(n)
+	}
+	return sum, hdr, nil
+}
+
+// matching returns the IDs of the messages matching the query and label,
+// newest first.
+func (s *Server) matching(q, label string) ([]uint32, error) {
+	pq, err := query.Parse(q)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := pq.Matches(s.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	res := ids[:0]
+	for _, id := range ids {
+		if label == "" || hasLabel(s.DB.Labels(id), label) {
+			res = append(res, id)
+		}
+	}
+	sort.Slice(res, func(a, b int) bool { return res[a] > res[b] })
+	return res, nil
+}
+
+func hasLabel(labels []string, label string) bool {
+	for _, l := range labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) summaries(ids []uint32) ([]Summary, error) {
+	res := make([]Summary, 0, len(ids))
+	for _, id := range ids {
+		sum, _, err := s.summary(id)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, sum)
+	}
+	return res, nil
+}
+
+func (s *Server) labels() []Label {
+	counts := make(map[string]int)
+	for _, id := range s.DB.MessageIDs() {
+		for _, l := range s.DB.Labels(id) {
+			counts[l]++
+		}
+	}
+	res := make([]Label, 0, len(counts))
+	for l, n := range counts {
+		res = append(res, Label{Label: l, Messages: n})
+	}
+	sort.Slice(res, func(a, b int) bool { return res[a].Label < res[b].Label })
+	return res
+}
+
+// lookup returns the live message given by the uid path parameter, and a
+// reader for it.
+func (s *Server) lookup(w http.ResponseWriter, r *http.Request) (uint32, io.Reader, bool) {
+	uid, err := strconv.ParseUint(r.PathValue("uid"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return 0, nil, false
+	}
+	rd, err := s.DB.MessageReader(uint32(uid))
+	if errors.Is(err, os.ErrNotExist) {
+		http.NotFound(w, r)
+		return 0, nil, false
+	} else if err != nil {
+		s.fail(w, err)
+		return 0, nil, false
+	}
+	return uint32(uid), rd, true
+}
+
+// details returns a message with its content. The message is read as a
+// stream, once for the text and once for the attachments, so that only
+// the text is held in memory.
+func (s *Server) details(uid uint32, rd io.Reader) (Message, error) {
+	sum, hdr, err := s.summary(uid)
+	if err != nil {
+		return Message{}, err
+	}
+	msg := Message{
+		Summary:     sum,
+		Cc:          fts.DecodeHeader(hdr.Get("Cc")),
+		Attachments: []Attachment{},
+	}
+	var html string
+	msg.Text, html = fts.BodyReader(rd)
+	if html != "" {
+		msg.HTML = sanitize(html)
+	}
+
+	rd, err = s.DB.MessageReader(uid)
+	if err != nil {
+		return Message{}, err
+	}
+	fts.WalkAttachments(rd, func(a fts.Attachment, content io.Reader) bool {
+		n, _ := io.Copy(io.Discard, content)
+		msg.Attachments = append(msg.Attachments, Attachment{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Size:        int(n),
+			URL:         fmt.Sprintf("/messages/%d/attachments/%d", uid, len(msg.Attachments)),
+		})
+		return true
+	})
+	return msg, nil
+}
+
+func (s *Server) fail(w http.ResponseWriter, err error) {
+	log.Println("HTTP:", err)
+	http.Error(w, "Internal server error", http.StatusInternalServerError)
+}
+
+func (s *Server) render(w http.ResponseWriter, name string, data interface{}) {
+	var buf bytes.Buffer
+	if err := templates.ExecuteTemplate(&buf, name, data); err != nil {
+		s.fail(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func (s *Server) index(w http.ResponseWriter, r *http.Request) {
+	q, label := r.FormValue("q"), r.FormValue("label")
+	page, _ := strconv.Atoi(r.FormValue("page"))
+	if page < 1 {
+		page = 1
+	}
+
+	data := struct {
+		Name, Query, Label, Error string
+		Labels                    []Label
+		Messages                  []Summary
+		Total, Page, Pages        int
+		Prev, Next                int
+	}{
+		Name:   s.Name,
+		Query:  q,
+		Label:  label,
+		Labels: s.labels(),
+		Page:   page,
+		Prev:   page - 1,
+		Next:   page + 1,
+	}
+
+	ids, err := s.matching(q, label)
+	if err != nil {
+		data.Error = err.Error()
+	} else {
+		data.Total = len(ids)
+		data.Pages = (len(ids) + pageSize - 1) / pageSize
+		start := min((page-1)*pageSize, len(ids))
+		if data.Messages, err = s.summaries(ids[start:min(start+pageSize, len(ids))]); err != nil {
+			s.fail(w, err)
+			return
+		}
+	}
+	s.render(w, "index.html", data)
+}
+
+func (s *Server) message(w http.ResponseWriter, r *http.Request) {
+	uid, rd, ok := s.lookup(w, r)
+	if !ok {
+		return
+	}
+	msg, err := s.details(uid, rd)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	s.render(w, "message.html", struct {
+		Name, Query string
+		Message
+	}{s.Name, "", msg})
+}
+
+// raw serves the message as stored, streaming large messages rather than
+// reading them into memory.
+func (s *Server) raw(w http.ResponseWriter, r *http.Request) {
+	uid, err := strconv.ParseUint(r.PathValue("uid"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+	rd, err := s.DB.MessageReader(uint32(uid))
+	if errors.Is(err, os.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		s.fail(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "message/rfc822")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fmt.Sprintf("%d.eml", uid)}))
+	if _, err := io.Copy(w, rd); err != nil {
+		log.Printf("Serving message %d: %v", uid, err)
+	}
+}
+
+// html serves the sanitised HTML body, for display in a sandboxed frame.
+// The content security policy blocks anything the sanitiser missed.
+func (s *Server) html(w http.ResponseWriter, r *http.Request) {
+	_, rd, ok := s.lookup(w, r)
+	if !ok {
+		return
+	}
+	_, html := fts.BodyReader(rd)
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; img-src data:; sandbox allow-popups allow-popups-to-escape-sandbox")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<meta charset=\"utf-8\">\n%s", sanitize(html))
+}
+
+// attachment serves an attachment, decoding it as it is read from the
+// message.
+func (s *Server) attachment(w http.ResponseWriter, r *http.Request) {
+	uid, rd, ok := s.lookup(w, r)
+	if !ok {
+		return
+	}
+	n, err := strconv.Atoi(r.PathValue("n"))
+	if err != nil || n < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	i, found := 0, false
+	fts.WalkAttachments(rd, func(a fts.Attachment, content io.Reader) bool {
+		if i < n {
+			i++
+			return true
+		}
+		found = true
+		name := a.Filename
+		if name == "" {
+			name = fmt.Sprintf("attachment-%d", n)
+		}
+
+		// Attachments are always downloaded, never displayed, so that
+		// they cannot run scripts in the context of the interface.
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+		if _, err := io.Copy(w, content); err != nil {
+			log.Printf("Serving attachment %d of message %d: %v", n, uid, err)
+		}
+		return false
+	})
+	if !found {
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) apiMessages(w http.ResponseWriter, r *http.Request) {
+	offset, _ := strconv.Atoi(r.FormValue("offset"))
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit <= 0 {
+		limit = pageSize
+	}
+	offset = max(offset, 0)
+
+	ids, err := s.matching(r.FormValue("q"), r.FormValue("label"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	start := min(offset, len(ids))
+	msgs, err := s.summaries(ids[start:min(start+limit, len(ids))])
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	writeJSON(w, struct {
+		Total    int       `json:"total"`
+		Messages []Summary `json:"messages"`
+	}{len(ids), msgs})
+}
+
+func (s *Server) apiMessage(w http.ResponseWriter, r *http.Request) {
+	uid, rd, ok := s.lookup(w, r)
+	if !ok {
+		return
+	}
+	msg, err := s.details(uid, rd)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	writeJSON(w, msg)
+}
+
+func (s *Server) apiLabels(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.labels())
+}
@@ -0,0 +1,124 @@
+package webui
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/calmh/imapchive/db"
+)
+
+// testServer serves an archive holding a small message and a large one,
+// stored in chunks, with an attachment.
+func testServer(t *testing.T) (srv *httptest.Server, small, large string) {
+	t.Helper()
+	small = "From: alice@example.com\r\nTo: bob@example.com\r\nCc: carol@example.com\r\nSubject: Hello\r\nDate: Sat, 5 Jan 2019 10:00:00 +0000\r\n\r\nHi Bob.\r\n"
+	photo := strings.Repeat("0123456789abcdef", 150000)
+	large = "From: dave@example.com\r\nSubject: Photos\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nSee attached.\r\n" +
+		"--b\r\nContent-Type: image/jpeg\r\nContent-Disposition: attachment; filename=a.jpg\r\n\r\n" + photo + "\r\n--b--\r\n"
+
+	name := filepath.Join(t.TempDir(), "test.imapchive")
+	d, err := db.Open(name, db.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.WriteMessage(1, []byte(small), []string{`\Inbox`}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.WriteMessageStream(2, strings.NewReader(large), nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.WriteClose(); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	d, err = db.Open(name, db.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	srv = httptest.NewServer((&Server{DB: d}).Handler())
+	t.Cleanup(srv.Close)
+	return srv, small, large
+}
+
+func get(t *testing.T, url string) (int, []byte) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	bs, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, bs
+}
+
+func TestAPI(t *testing.T) {
+	srv, small, large := testServer(t)
+
+	code, bs := get(t, srv.URL+"/api/messages")
+	var list struct {
+		Total    int
+		Messages []Summary
+	}
+	if err := json.Unmarshal(bs, &list); code != http.StatusOK || err != nil {
+		t.Fatalf("messages: %d, %v", code, err)
+	}
+	if list.Total != 2 || len(list.Messages) != 2 {
+		t.Fatalf("messages: %s", bs)
+	}
+	// Newest first.
+	if m := list.Messages[0]; m.UID != 2 || m.Subject != "Photos" || m.Size != len(large) {
+		t.Errorf("large message summary %+v", m)
+	}
+	if m := list.Messages[1]; m.UID != 1 || m.From != "alice@example.com" || m.To != "bob@example.com" || m.Size != len(small) || m.Date.IsZero() || len(m.Labels) != 1 {
+		t.Errorf("small message summary %+v", m)
+	}
+
+	code, bs = get(t, srv.URL+"/api/messages/2")
+	var msg Message
+	if err := json.Unmarshal(bs, &msg); code != http.StatusOK || err != nil {
+		t.Fatalf("message: %d, %v", code, err)
+	}
+	if strings.TrimSpace(msg.Text) != "See attached." || len(msg.Attachments) != 1 {
+		t.Fatalf("message %q with attachments %+v", msg.Text, msg.Attachments)
+	}
+	if a := msg.Attachments[0]; a.Filename != "a.jpg" || a.ContentType != "image/jpeg" || a.Size != 16*150000 {
+		t.Errorf("attachment %+v", a)
+	}
+
+	code, bs = get(t, srv.URL+"/api/messages/1")
+	if err := json.Unmarshal(bs, &msg); code != http.StatusOK || err != nil || msg.Cc != "carol@example.com" || len(msg.Attachments) != 0 {
+		t.Errorf("small message: %d, %s", code, bs)
+	}
+
+	for _, tc := range []struct {
+		path string
+		code int
+		size int
+	}{
+		{"/", http.StatusOK, -1},
+		{"/messages/2", http.StatusOK, -1},
+		{"/messages/2/attachments/0", http.StatusOK, 16 * 150000},
+		{"/messages/2/attachments/1", http.StatusNotFound, -1},
+		{"/messages/1/attachments/0", http.StatusNotFound, -1},
+		{"/messages/2/attachments/x", http.StatusNotFound, -1},
+		{"/messages/3", http.StatusNotFound, -1},
+		{"/messages/x", http.StatusBadRequest, -1},
+		{"/messages/2/raw", http.StatusOK, len(large)},
+	} {
+		code, bs := get(t, srv.URL+tc.path)
+		if code != tc.code || tc.size >= 0 && len(bs) != tc.size {
+			t.Errorf("%s: %d with %d bytes, want %d with %d", tc.path, code, len(bs), tc.code, tc.size)
+		}
+	}
+}